@@ -18,6 +18,23 @@ import (
 type Config struct {
 	// Parent value from the types package.
 	Types types.Config
+
+	// MaxIterations limits the number of statements interpreted for a
+	// loop or block before giving up. Zero means DefaultMaxIterations.
+	MaxIterations int
+
+	// MaxErrors is the number of errors after which checking stops. Zero
+	// means DefaultMaxErrors, a negative value means no limit.
+	MaxErrors int
+
+	// UseCFG interprets function bodies using a control-flow graph instead
+	// of walking the syntax tree.
+	UseCFG bool
+
+	// Defaults chooses the permissions of values that are not annotated,
+	// see permission.DefaultPolicy for presets. Nil means
+	// permission.MutableDefaults.
+	Defaults permission.DefaultPolicy
 }
 
 // Info stores the results of a capability check.
@@ -29,7 +46,16 @@ type Info struct {
 	Permissions map[ast.Node]permission.Permission
 
 	// Errors occured during capability checking.
-	Errors []error
+	Errors []Diagnostic
+
+	// Warnings are problems that do not make the check fail, such as
+	// annotations that can be written in a canonical form.
+	Warnings []Diagnostic
+
+	// Skipped is the number of functions that were not checked, because
+	// neither they nor their package were opted in by a "//lingo:check"
+	// directive.
+	Skipped int
 }
 
 // Check performs a capability check on a package.
@@ -37,6 +63,8 @@ func (conf *Config) Check(path string, fset *token.FileSet, files []*ast.File, i
 	checker := NewChecker(conf, info, path, fset)
 	err := checker.Files(files)
 	info.Errors = checker.Errors
+	info.Warnings = checker.Warnings
+	info.Skipped = checker.Skipped
 	if err != nil {
 		return err
 	}
@@ -44,3 +72,11 @@ func (conf *Config) Check(path string, fset *token.FileSet, files []*ast.File, i
 	info.Permissions = checker.pmap
 	return nil
 }
+
+// defaults returns the default permission policy.
+func (conf *Config) defaults() permission.DefaultPolicy {
+	if conf.Defaults == nil {
+		return permission.MutableDefaults
+	}
+	return conf.Defaults
+}
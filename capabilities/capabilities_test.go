@@ -6,10 +6,16 @@
 package capabilities
 
 import (
+	"fmt"
 	"go/ast"
 	goparser "go/parser"
 	"go/token"
+	"go/types"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/julian-klode/lingolang/permission"
 )
 
 func TestCapabilitiesSuccess(t *testing.T) {
@@ -96,6 +102,233 @@ func TestCapabilitiesErrorBailout(t *testing.T) {
 	}
 }
 
+func TestCapabilitiesMultipleErrors(t *testing.T) {
+	src := `//lingo:check
+            package main
+            // @perm func (om * om)
+            func consume(p *int) {
+            }
+            func f() {
+                a := new(int)
+                b := new(int)
+                consume(a)
+                consume(a)
+                consume(a)
+                consume(b)
+                consume(b)
+            }
+            func g() {
+                c := new(int)
+                consume(c)
+                println(*c)
+            }`
+
+	for _, test := range []struct {
+		maxErrors int
+		errors    int
+	}{{0, 3}, {-1, 3}, {2, 2}} {
+		fset := token.NewFileSet()
+		f, err := goparser.ParseFile(fset, "TestCapabilitiesMultipleErrors.go", src, goparser.ParseComments)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err) // parse error
+		}
+
+		config := Config{MaxErrors: test.maxErrors}
+		info := Info{}
+		err = config.Check("hello", fset, []*ast.File{f}, &info)
+
+		if err == nil {
+			t.Errorf("err is nil, expected an error.")
+		}
+		if len(info.Errors) != test.errors {
+			t.Errorf("MaxErrors=%d: have %v, expected %d errors", test.maxErrors, info.Errors, test.errors)
+		}
+		codes := []Code{CodeCannotMove, CodeCannotMove, CodeMissingPermission}
+		for k, d := range info.Errors {
+			if d.Code != codes[k] {
+				t.Errorf("Expected error %d to be %s, received %v", k, codes[k], d)
+			}
+		}
+	}
+}
+
+func TestCapabilitiesDiagnostics(t *testing.T) {
+	testCases := []struct {
+		name    string
+		src     string
+		line    int
+		code    Code
+		related []int
+	}{
+		{"typeError", "package main\nvar a = 5\nvar a = 5", 3, CodeTypeError, nil},
+		{"badPermission", "package main\n// @perm om * om\nvar a = 5", 3, CodeBadPermission, []int{2}},
+		{"deferredCall", `//lingo:check
+			package main
+			func f(a *int, g func(*int)) *int {
+				defer func() { g(a) }()
+				return a
+			}`, 5, CodeDeferredCall, []int{4}},
+		{"mismatchedName", `package main
+			// @perm func (q om * om)
+			func consume(p *int) {}`, 3, CodeBadPermission, []int{2}},
+		{"movedIntoNamedParameter", `//lingo:check
+			package main
+			// @perm p: om * om
+			func consume(p *int) {}
+			func f() {
+				a := new(int)
+				consume(a)
+				consume(a)
+			}`, 8, CodeCannotMove, []int{7}},
+		{"movedIntoIdentifierParameter", `//lingo:check
+			package main
+			// @perm buf2: om * om, n_bytes: v
+			func consume(buf2 *int, n_bytes int) {}
+			func f() {
+				a := new(int)
+				consume(a, 1)
+				consume(a, 2)
+			}`, 8, CodeCannotMove, []int{7}},
+		{"localConflictsWithField", `//lingo:check
+			package main
+			type T struct {
+				x int // @perm ol
+			}
+			func f() {
+				// @perm om struct { om }
+				t := T{}
+				println(t.x)
+			}`, 7, CodeBadPermission, nil},
+		{"localAnnotationRestricts", `//lingo:check
+			package main
+			func f() {
+				// @perm or * or
+				p := new(int)
+				consume(p)
+			}
+			func consume(p *int) {}`, 6, CodeCannotMove, nil},
+		{"unknownParameterName", `package main
+			// @perm p: om * om, q: om
+			func consume(p *int) {}`, 2, CodeBadAnnotation, nil},
+		{"namedOutsideFunction", `package main
+			// @perm p: om * om
+			var a *int`, 2, CodeBadAnnotation, nil},
+		{"fieldConflict", `package main
+			type T struct {
+				x *int // @perm or * or
+			}
+			// @perm om struct { om * om }
+			var a T`, 6, CodeBadPermission, []int{5}},
+		{"badFieldTag", "package main\ntype T struct {\n\tx int `lingo:\"o(\"`\n}", 3, CodeBadAnnotation, nil},
+		{"badFieldPermission", "package main\ntype T struct {\n\tx int `lingo:\"om * om\"`\n}", 3, CodeBadPermission, nil},
+		{"fieldCommentAndTag", "package main\ntype T struct {\n\tx int `lingo:\"or\"` // @perm or\n}", 3, CodeBadAnnotation, nil},
+		{"readFromUnreadableField", `//lingo:check
+			package main
+			type T struct {
+				x int // @perm n
+			}
+			func f(t *T) int { return t.x + 1 }`, 6, CodeMissingPermission, nil},
+		{"badTypeDefault", `package main
+			// @perm om * om
+			type T struct{}`, 3, CodeBadPermission, []int{2}},
+		{"movedIntoCall", `//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {}
+			func f() {
+				a := new(int)
+				consume(a)
+				consume(a)
+			}`, 8, CodeCannotMove, []int{7}},
+		{"movedIntoAppend", `//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {}
+			func f() []*int {
+				a := new(int)
+				s := append([]*int(nil), a)
+				consume(a)
+				return s
+			}`, 8, CodeCannotMove, []int{7}},
+		{"capturedByClosure", `//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {}
+			func f() {
+				a := new(int)
+				g := func() { println(*a) }
+				consume(a)
+				g()
+			}`, 8, CodeCannotMove, []int{7}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			f, err := goparser.ParseFile(fset, "diagnostics.go", test.src, goparser.ParseComments)
+			if err != nil {
+				t.Fatalf("Parse error: %s", err) // parse error
+			}
+			config := Config{}
+			info := Info{}
+			config.Check("hello", fset, []*ast.File{f}, &info)
+			if len(info.Errors) != 1 {
+				t.Fatalf("have %v, expected one error", info.Errors)
+			}
+			d := info.Errors[0]
+			if d.Pos.Filename != "diagnostics.go" || d.Pos.Line != test.line || d.Code != test.code {
+				t.Errorf("Expected %s at line %d, received %v", test.code, test.line, d)
+			}
+			if len(d.Related) != len(test.related) {
+				t.Fatalf("Expected related lines %v, received %v", test.related, d.Related)
+			}
+			for k, line := range test.related {
+				if d.Related[k].Pos.Line != line {
+					t.Errorf("Expected related line %d, received %v", line, d.Related[k])
+				}
+			}
+			if !strings.HasPrefix(d.Error(), d.Pos.String()+": ") || !strings.HasSuffix(d.Error(), "["+string(d.Code)+"]") {
+				t.Errorf("Badly formatted diagnostic %s", d.Error())
+			}
+		})
+	}
+}
+
+// importerFunc imports packages by calling a function.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+func TestCapabilitiesImportedFieldTag(t *testing.T) {
+	fset := token.NewFileSet()
+	dep, err := goparser.ParseFile(fset, "dep.go", "package dep\ntype T struct {\n\tX int `lingo:\"om * om\"`\n}", 0)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+	depPkg, err := (&types.Config{}).Check("dep", fset, []*ast.File{dep}, nil)
+	if err != nil {
+		t.Fatalf("Type error: %s", err)
+	}
+	f, err := goparser.ParseFile(fset, "main.go", `//lingo:check
+		package main
+		import "dep"
+		func f(t dep.T) int {
+			return t.X
+		}`, goparser.ParseComments)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+
+	config := Config{}
+	config.Types.Importer = importerFunc(func(path string) (*types.Package, error) { return depPkg, nil })
+	info := Info{}
+	config.Check("hello", fset, []*ast.File{f}, &info)
+	if len(info.Errors) != 1 || info.Errors[0].Code != CodeBadPermission || info.Errors[0].Pos.Filename != "dep.go" || info.Errors[0].Pos.Line != 3 {
+		t.Errorf("Expected an error for the tag of X, received %v", info.Errors)
+	}
+}
+
 func TestCapabilitiesTypeError(t *testing.T) {
 	fset := token.NewFileSet()
 	f, err := goparser.ParseFile(fset, "TestCapabilitiesTypeError.go",
@@ -118,6 +351,212 @@ func TestCapabilitiesTypeError(t *testing.T) {
 	}
 }
 
+func TestCapabilitiesBadAnnotation(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "bad.go", "package main\n\n// @perm om struct {ox; om * y}\nvar a struct{ a, b *int }", goparser.ParseComments)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err) // parse error
+	}
+
+	config := Config{}
+	info := Info{}
+	config.Check("hello", fset, []*ast.File{f}, &info)
+
+	var columns []int
+	for _, d := range info.Errors {
+		if d.Code != CodeBadAnnotation || d.Pos.Line != 3 {
+			t.Errorf("Unexpected diagnostic %s", d)
+		}
+		columns = append(columns, d.Pos.Column)
+	}
+	if !reflect.DeepEqual(columns, []int{22, 30}) {
+		t.Errorf("Expected errors in columns 22 and 30, received %v", info.Errors)
+	}
+}
+
+func TestCapabilitiesWarnings(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "warn.go", "package main\n\n// @perm orwRW\nvar a = 5", goparser.ParseComments)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err) // parse error
+	}
+
+	config := Config{}
+	info := Info{}
+	if err := config.Check("hello", fset, []*ast.File{f}, &info); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(info.Warnings) != 1 {
+		t.Fatalf("have %v, expected one warning", info.Warnings)
+	}
+	d := info.Warnings[0]
+	if d.Code != CodeNonCanonical || d.Pos.Line != 3 || d.Pos.Column != 10 {
+		t.Errorf("Unexpected warning %s", d)
+	}
+	if d.Fix == nil || d.Fix.End.Column != 15 || d.Fix.NewText != "om" {
+		t.Errorf("Unexpected fix %+v", d.Fix)
+	}
+}
+
+func TestCapabilitiesPermTypes(t *testing.T) {
+	check := func(src string) Info {
+		fset := token.NewFileSet()
+		f, err := goparser.ParseFile(fset, "permtype.go", src, goparser.ParseComments)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err) // parse error
+		}
+		config := Config{}
+		info := Info{}
+		config.Check("hello", fset, []*ast.File{f}, &info)
+		return info
+	}
+
+	info := check(`package main
+		// @perm om * List
+		var head *List
+
+		// @permtype List = om struct { om; om * List }
+		type List struct {
+			value int
+			next  *List
+		}`)
+	if len(info.Errors) != 0 {
+		t.Fatalf("Unexpected errors %v", info.Errors)
+	}
+	expected, _ := permission.NewParser("om * A = om struct {om; om * A}").Parse()
+	for node, perm := range info.Permissions {
+		if _, ok := node.(*ast.GenDecl); ok && !permission.Equal(perm, expected) {
+			t.Errorf("Expected %v, received %v", expected, perm)
+		}
+	}
+
+	// The closing */ of a block comment is not part of the annotation.
+	info = check(`package main
+		/* @perm om * List */
+		var head *List
+
+		/* @permtype List = om struct { om; om * List } */
+		type List struct {
+			value int
+			next  *List
+		}`)
+	if len(info.Errors) != 0 {
+		t.Fatalf("Unexpected errors %v", info.Errors)
+	}
+	for node, perm := range info.Permissions {
+		if _, ok := node.(*ast.GenDecl); ok && !permission.Equal(perm, expected) {
+			t.Errorf("Expected %v, received %v", expected, perm)
+		}
+	}
+
+	info = check(`package main
+		// @permtype List = om struct { om; om * List }
+		// @permtype List = om
+		// @permtype Other = om * Unknown
+		type List struct {
+			value int
+			next  *List
+		}
+		func f() {
+			// @permtype Local = om
+		}`)
+	var lines []int
+	for _, d := range info.Errors {
+		if d.Code != CodeBadAnnotation {
+			t.Errorf("Unexpected diagnostic %s", d)
+		}
+		lines = append(lines, d.Pos.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{3, 10, 4}) || len(info.Errors[0].Related) != 1 {
+		t.Errorf("Expected errors at lines 3, 10, and 4, received %v", info.Errors)
+	}
+}
+
+func TestCapabilitiesNamedList(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "named.go", `package main
+		type T struct{ x int }
+		// @perm recv: om * om, return: om * om
+		func (t *T) get(n int) *int { return &t.x }`, goparser.ParseComments)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err) // parse error
+	}
+	config := Config{}
+	info := Info{}
+	if err := config.Check("hello", fset, []*ast.File{f}, &info); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	for node, perm := range info.Permissions {
+		if _, ok := node.(*ast.FuncDecl); ok {
+			expected := "om (om * om) func (m) om * om"
+			if fmt.Sprint(perm) != expected {
+				t.Errorf("Expected %s, received %s", expected, perm)
+			}
+		}
+	}
+}
+
+func TestCapabilitiesTypeDefaults(t *testing.T) {
+	check := func(annotation string) []Diagnostic {
+		fset := token.NewFileSet()
+		f, err := goparser.ParseFile(fset, "defaults.go", `//lingo:check
+			package main
+			`+annotation+`
+			type Config struct{ name *string }
+			func f() {
+				var c Config
+				d := c
+				e := c
+				_, _ = d, e
+			}`, goparser.ParseComments)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err) // parse error
+		}
+		config := Config{}
+		info := Info{}
+		config.Check("hello", fset, []*ast.File{f}, &info)
+		return info.Errors
+	}
+
+	if errs := check(""); len(errs) == 0 || errs[0].Pos.Line != 8 {
+		t.Errorf("Expected linear values without a default, received %v", errs)
+	}
+	if errs := check("// @perm ov"); len(errs) != 0 {
+		t.Errorf("Expected copyable values with a default, received %v", errs)
+	}
+}
+
+func TestCapabilitiesDefaultPolicies(t *testing.T) {
+	check := func(defaults permission.DefaultPolicy) []Diagnostic {
+		fset := token.NewFileSet()
+		f, err := goparser.ParseFile(fset, "policy.go", `//lingo:check
+			package main
+			func use(p *int) {}
+			func f() {
+				a := new(int)
+				use(a)
+				use(a)
+			}`, goparser.ParseComments)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err) // parse error
+		}
+		config := Config{Defaults: defaults}
+		info := Info{}
+		config.Check("hello", fset, []*ast.File{f}, &info)
+		return info.Errors
+	}
+
+	if errs := check(nil); len(errs) != 0 {
+		t.Errorf("Expected parameters to be borrowed by default, received %v", errs)
+	}
+	if errs := check(permission.LegacyDefaults); len(errs) != 0 {
+		t.Errorf("Expected no errors with legacy defaults, received %v", errs)
+	}
+	if errs := check(permission.StrictDefaults); len(errs) != 1 || errs[0].Code != CodeCannotMove || errs[0].Pos.Line != 7 {
+		t.Errorf("Expected the argument to be moved with strict defaults, received %v", errs)
+	}
+}
+
 func TestChecker_Files_panic(t *testing.T) {
 	defer func() {
 		e := recover()
@@ -0,0 +1,436 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"go/ast"
+	"go/token"
+
+	"github.com/julian-klode/lingolang/permission"
+)
+
+// This file implements an alternative engine for interpreting statements,
+// enabled by Interpreter.UseCFG. Instead of walking the syntax tree and
+// passing exits upwards, the statements are turned into a control-flow
+// graph, and the stores are propagated along its edges with a worklist,
+// merging them where paths join. The nodes of the graph use the same
+// functions for statements and expressions as the recursive interpreter.
+
+// cfgKind describes what a node of a control-flow graph does to a store.
+type cfgKind int
+
+const (
+	cfgNop       cfgKind = iota // Nothing, used for joins and branches
+	cfgLabel                    // A labeled statement, see cfgSolver.flow()
+	cfgStmt                     // A simple statement, see visitStmt()
+	cfgCond                     // A condition, see visitCondition()
+	cfgBegin                    // Begins a block
+	cfgEnd                      // Ends a block
+	cfgCase                     // The alternatives of a case clause
+	cfgTag                      // The tag of a switch statement
+	cfgRangeX                   // The container of a range statement
+	cfgRangeVars                // The key and value of a range statement
+	cfgRelease                  // Releases a switch tag or range container
+	cfgExit                     // Falls off the end of the statements
+)
+
+// cfgNode is a node in a control-flow graph.
+type cfgNode struct {
+	index int
+	kind  cfgKind
+	node  ast.Node // The statement or expression, also for diagnostics
+	depth int      // The number of blocks begun when entering the node
+	succs []*cfgNode
+
+	loopHead bool     // The node is the target of a back edge
+	release  *cfgNode // For cfgRangeVars, the node releasing the container
+}
+
+// outDepth is the number of blocks begun when leaving the node.
+func (n *cfgNode) outDepth() int {
+	switch n.kind {
+	case cfgBegin:
+		return n.depth + 1
+	case cfgEnd:
+		return n.depth - 1
+	}
+	return n.depth
+}
+
+// cfgTarget is a statement that break, and for loops continue, can refer to.
+type cfgTarget struct {
+	label string
+	brk   *cfgNode
+	cont  *cfgNode // nil for switch and select statements
+}
+
+// cfgBuilder builds control-flow graphs. Statements are built backwards,
+// starting with their successor, so each node is created knowing where it
+// leads to.
+type cfgBuilder struct {
+	nodes   []*cfgNode
+	labels  map[string]*cfgNode
+	targets []cfgTarget // The enclosing break targets, innermost last
+	label   string      // The label of the statement being built
+	fallsTo *cfgNode    // The body of the next case clause, for fallthrough
+}
+
+// newCFG builds a control-flow graph for a list of statements and returns
+// its entry node.
+func newCFG(stmts []ast.Stmt) (*cfgBuilder, *cfgNode) {
+	b := &cfgBuilder{labels: make(map[string]*cfgNode)}
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncLit:
+				return false // Has its own labels
+			case *ast.LabeledStmt:
+				b.labels[node.Label.Name] = b.newNode(cfgLabel, node, 0)
+			}
+			return true
+		})
+	}
+	exit := b.newNode(cfgExit, stmts[len(stmts)-1], 0)
+	return b, b.buildList(stmts, exit, 0)
+}
+
+// newNode creates a new node.
+func (b *cfgBuilder) newNode(kind cfgKind, node ast.Node, depth int, succs ...*cfgNode) *cfgNode {
+	n := &cfgNode{index: len(b.nodes), kind: kind, node: node, depth: depth, succs: succs}
+	b.nodes = append(b.nodes, n)
+	return n
+}
+
+// buildList builds a list of statements leading to next.
+func (b *cfgBuilder) buildList(stmts []ast.Stmt, next *cfgNode, depth int) *cfgNode {
+	for k := len(stmts) - 1; k >= 0; k-- {
+		next = b.build(stmts[k], next, depth)
+	}
+	return next
+}
+
+// build builds a statement leading to next, and returns its entry node.
+func (b *cfgBuilder) build(stmt ast.Stmt, next *cfgNode, depth int) *cfgNode {
+	label := b.label
+	b.label = ""
+
+	switch stmt := stmt.(type) {
+	case nil:
+		return next
+	case *ast.BlockStmt:
+		end := b.newNode(cfgEnd, stmt, depth+1, next)
+		return b.newNode(cfgBegin, stmt, depth, b.buildList(stmt.List, end, depth+1))
+	case *ast.LabeledStmt:
+		l := b.labels[stmt.Label.Name]
+		l.depth = depth
+		b.label = stmt.Label.Name
+		l.succs = []*cfgNode{b.build(stmt.Stmt, next, depth)}
+		return l
+	case *ast.BranchStmt:
+		if target := b.branchTarget(stmt); target != nil {
+			return b.newNode(cfgNop, stmt, depth, target)
+		}
+		// Leaves the statements, see visitBranchStmt()
+		return b.newNode(cfgStmt, stmt, depth)
+	case *ast.IfStmt:
+		end := b.newNode(cfgEnd, stmt, depth+1, next)
+		body := b.build(stmt.Body, end, depth+1)
+		els := b.build(stmt.Else, end, depth+1)
+		cond := b.newNode(cfgCond, stmt.Cond, depth+1, body, els)
+		return b.newNode(cfgBegin, stmt, depth, b.build(stmt.Init, cond, depth+1))
+	case *ast.ForStmt:
+		end := b.newNode(cfgEnd, stmt, depth+1, next)
+		head := b.newNode(cfgNop, stmt, depth+1)
+		if stmt.Cond != nil {
+			head = b.newNode(cfgCond, stmt.Cond, depth+1)
+		}
+		head.loopHead = true
+		post := b.build(stmt.Post, head, depth+1)
+		b.targets = append(b.targets, cfgTarget{label, end, post})
+		body := b.build(stmt.Body, post, depth+1)
+		b.targets = b.targets[:len(b.targets)-1]
+		head.succs = []*cfgNode{body}
+		if stmt.Cond != nil {
+			head.succs = append(head.succs, end)
+		}
+		return b.newNode(cfgBegin, stmt, depth, b.build(stmt.Init, head, depth+1))
+	case *ast.RangeStmt:
+		// Like visitRangeStmt(), the loop can be left without evaluating
+		// the container, or after an iteration.
+		release := b.newNode(cfgRelease, stmt, depth, next)
+		iterEnd := b.newNode(cfgEnd, stmt, depth+1, release)
+		b.targets = append(b.targets, cfgTarget{label, release, iterEnd})
+		body := b.build(stmt.Body, iterEnd, depth+1)
+		b.targets = b.targets[:len(b.targets)-1]
+		vars := b.newNode(cfgRangeVars, stmt, depth+1, body)
+		vars.release = release
+		iter := b.newNode(cfgBegin, stmt, depth, vars)
+		iter.loopHead = true
+		iterEnd.succs = append(iterEnd.succs, iter)
+		x := b.newNode(cfgRangeX, stmt, depth, iter)
+		return b.newNode(cfgNop, stmt, depth, x, release)
+	case *ast.SwitchStmt:
+		// Like visitStmtList() for switches, no clause might match.
+		end := b.newNode(cfgEnd, stmt, depth+1, next)
+		release := b.newNode(cfgRelease, stmt, depth+1, end)
+		b.targets = append(b.targets, cfgTarget{label, release, nil})
+		oldFallsTo := b.fallsTo
+		b.fallsTo = nil
+		clauses := make([]*cfgNode, len(stmt.Body.List), len(stmt.Body.List)+1)
+		for k := len(stmt.Body.List) - 1; k >= 0; k-- {
+			clause := stmt.Body.List[k].(*ast.CaseClause)
+			clauseEnd := b.newNode(cfgEnd, clause, depth+2, release)
+			body := b.newNode(cfgBegin, clause, depth+1, b.buildList(clause.Body, clauseEnd, depth+2))
+			b.fallsTo = body
+			clauses[k] = b.newNode(cfgCase, clause, depth+1, body)
+		}
+		b.fallsTo = oldFallsTo
+		b.targets = b.targets[:len(b.targets)-1]
+		tag := b.newNode(cfgTag, stmt, depth+1, append(clauses, release)...)
+		return b.newNode(cfgBegin, stmt, depth, b.build(stmt.Init, tag, depth+1))
+	case *ast.SelectStmt:
+		// Like visitStmtList() for selects, no clause might be selected.
+		end := b.newNode(cfgEnd, stmt, depth+1, next)
+		b.targets = append(b.targets, cfgTarget{label, end, nil})
+		clauses := make([]*cfgNode, len(stmt.Body.List), len(stmt.Body.List)+1)
+		for k, clause := range stmt.Body.List {
+			clause := clause.(*ast.CommClause)
+			clauseEnd := b.newNode(cfgEnd, clause, depth+2, end)
+			body := b.buildList(clause.Body, clauseEnd, depth+2)
+			clauses[k] = b.newNode(cfgBegin, clause, depth+1, b.build(clause.Comm, body, depth+2))
+		}
+		b.targets = b.targets[:len(b.targets)-1]
+		return b.newNode(cfgBegin, stmt, depth, b.newNode(cfgNop, stmt, depth+1, append(clauses, end)...))
+	default:
+		return b.newNode(cfgStmt, stmt, depth, next)
+	}
+}
+
+// branchTarget returns the node a branch statement leads to, or nil if it
+// leaves the statements the graph is built for.
+func (b *cfgBuilder) branchTarget(stmt *ast.BranchStmt) *cfgNode {
+	if stmt.Tok == token.GOTO {
+		return b.labels[stmt.Label.Name]
+	}
+	if stmt.Tok == token.FALLTHROUGH {
+		return b.fallsTo
+	}
+	for k := len(b.targets) - 1; k >= 0; k-- {
+		target := b.targets[k]
+		if stmt.Label != nil && stmt.Label.Name != target.label {
+			continue
+		}
+		switch {
+		case stmt.Tok == token.BREAK:
+			return target.brk
+		case stmt.Tok == token.CONTINUE && target.cont != nil:
+			return target.cont
+		}
+	}
+	return nil
+}
+
+// cfgBorrow is what a switch or range statement borrowed for its tag or
+// container, along with the permissions of keys and values of containers.
+type cfgBorrow struct {
+	deps       []Borrowed
+	rkey, rval permission.Permission
+	keep       bool // An owned key or value was taken out of the container
+}
+
+// cfgSolver propagates stores through a control-flow graph.
+type cfgSolver struct {
+	i          *Interpreter
+	in         []Store // The merged store entering each node
+	reached    []bool
+	visits     []int // Number of times the store entering a node changed
+	queue      []*cfgNode
+	queued     []bool
+	iterations int
+	borrows    map[ast.Stmt]*cfgBorrow
+	exits      []StmtExit // Merged by branch statement
+}
+
+// visitStmtCFG interprets a list of statements using a control-flow graph,
+// and returns the exits of the list, like visitStmtList does. Exits at the
+// same statement are merged.
+func (i *Interpreter) visitStmtCFG(st Store, stmts ...ast.Stmt) []StmtExit {
+	if len(stmts) == 0 {
+		return []StmtExit{{st, nil}}
+	}
+	b, entry := newCFG(stmts)
+	s := &cfgSolver{
+		i:       i,
+		in:      make([]Store, len(b.nodes)),
+		reached: make([]bool, len(b.nodes)),
+		visits:  make([]int, len(b.nodes)),
+		queued:  make([]bool, len(b.nodes)),
+		borrows: make(map[ast.Stmt]*cfgBorrow),
+	}
+	s.in[entry.index] = st
+	s.reached[entry.index] = true
+	s.enqueue(entry)
+
+	for len(s.queue) > 0 {
+		n := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queued[n.index] = false
+		if maxIterations := i.maxIterations(); s.iterations+1 > maxIterations {
+			i.Errorf(CodeNoConvergence, n.node, "Permissions did not stabilize after %d iterations, giving up", maxIterations)
+		}
+		s.iterations++
+		// Continue after nodes with errors as if they were not there.
+		if st, ok := i.recoverError(s.in[n.index], func() { s.visit(n, s.in[n.index]) }); !ok {
+			for _, succ := range n.succs {
+				i.recoverError(st, func() { s.flow(n, succ, st) })
+			}
+		}
+	}
+	return s.exits
+}
+
+// enqueue schedules a node to be visited, unless it already is.
+func (s *cfgSolver) enqueue(n *cfgNode) {
+	if !s.queued[n.index] {
+		s.queued[n.index] = true
+		s.queue = append(s.queue, n)
+	}
+}
+
+// visit applies a node to the store entering it, and passes the result on
+// to the successors of the node.
+func (s *cfgSolver) visit(n *cfgNode, st Store) {
+	i := s.i
+	switch n.kind {
+	case cfgBegin:
+		st = st.BeginBlock()
+	case cfgEnd:
+		st = st.EndBlock()
+	case cfgStmt:
+		for _, exit := range i.visitStmt(st, n.node.(ast.Stmt)) {
+			if exit.branch != nil {
+				s.exit(n, exit)
+				continue
+			}
+			for _, succ := range n.succs {
+				s.flow(n, succ, exit.Store)
+			}
+		}
+		return
+	case cfgCond:
+		st = i.visitCondition(st, n.node.(ast.Expr))
+	case cfgCase:
+		st = i.visitCaseList(st, n.node.(*ast.CaseClause).List)
+	case cfgTag:
+		stmt := n.node.(*ast.SwitchStmt)
+		perm, deps, store := i.visitExprOwnerToDeps(st, stmt.Tag)
+		if stmt.Tag != nil {
+			i.Assert(stmt.Tag, perm, permission.Read)
+		}
+		s.borrow(stmt).deps = deps
+		st = store
+	case cfgRangeX:
+		stmt := n.node.(*ast.RangeStmt)
+		perm, deps, store := i.visitExprOwnerToDeps(st, stmt.X)
+		i.Assert(stmt.X, perm, permission.Read)
+		b := s.borrow(stmt)
+		b.deps = deps
+		b.rkey, b.rval = rangePermissions(perm)
+		st = store
+	case cfgRangeVars:
+		b := s.borrow(n.node.(ast.Stmt))
+		store, canRelease := i.defineRangeVars(st, n.node.(*ast.RangeStmt), b.rkey, b.rval)
+		if !canRelease && !b.keep {
+			// Stores might already have been released, so do that again.
+			b.keep = true
+			if s.reached[n.release.index] {
+				s.enqueue(n.release)
+			}
+		}
+		st = store
+	case cfgRelease:
+		if b := s.borrow(n.node.(ast.Stmt)); !b.keep {
+			st = i.Release(n.node, st, b.deps)
+		}
+	case cfgExit:
+		s.exit(n, StmtExit{st, nil})
+		return
+	}
+	for _, succ := range n.succs {
+		s.flow(n, succ, st)
+	}
+}
+
+// borrow returns what a switch or range statement borrowed.
+func (s *cfgSolver) borrow(stmt ast.Stmt) *cfgBorrow {
+	b := s.borrows[stmt]
+	if b == nil {
+		b = &cfgBorrow{}
+		s.borrows[stmt] = b
+	}
+	return b
+}
+
+// flow passes the store leaving a node on to a successor. The blocks the
+// edge leaves are ended. The store is merged with the other stores entering
+// the successor, and the successor is visited again if that changed it.
+func (s *cfgSolver) flow(from, to *cfgNode, st Store) {
+	var err error
+	for depth := from.outDepth(); depth > to.depth; depth-- {
+		st = st.EndBlock()
+	}
+	if to.kind == cfgLabel {
+		st = dropDeclaredAfter(st, to.node.Pos())
+	}
+	if !s.reached[to.index] {
+		s.reached[to.index] = true
+		s.in[to.index] = st
+		s.enqueue(to)
+		return
+	}
+
+	merged := s.in[to.index]
+	if to.loopHead && s.visits[to.index] >= widenAfter {
+		merged, err = merged.Widen(st)
+	} else {
+		merged, err = merged.Merge(st)
+	}
+	if err != nil {
+		s.i.errorRelated(CodeCannotMerge, to.node, []relatedNode{{from.node.Pos(), "merged from here"}}, "Cannot merge stores: %s", err)
+	}
+	if !merged.Equal(s.in[to.index]) {
+		s.in[to.index] = merged
+		s.visits[to.index]++
+		s.enqueue(to)
+	}
+}
+
+// exit records an exit from the statements at a node, after ending the
+// blocks begun inside them. Exits at the same branch statement are merged.
+func (s *cfgSolver) exit(n *cfgNode, exit StmtExit) {
+	var err error
+	for depth := n.outDepth(); depth > 0; depth-- {
+		exit.Store = exit.Store.EndBlock()
+	}
+	for k := range s.exits {
+		if s.exits[k].branch != exit.branch {
+			continue
+		}
+		if s.exits[k].Store, err = s.exits[k].Store.Merge(exit.Store); err != nil {
+			s.i.Errorf(CodeCannotMerge, n.node, "Cannot merge with previous exit: %s", err)
+		}
+		return
+	}
+	s.exits = append(s.exits, exit)
+}
+
+// dropDeclaredAfter removes the variables declared after pos from the
+// innermost block of the store. A goto jumping back to a label leaves the
+// scope of variables declared after the label.
+func dropDeclaredAfter(st Store, pos token.Pos) Store {
+	for e := st.innermost(); e != nil && e.obj != nil && e.obj.Pos() > pos; e = st.innermost() {
+		st = st.truncate(st.Len() - 1)
+	}
+	return st
+}
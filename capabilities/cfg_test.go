@@ -0,0 +1,128 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+	"testing"
+
+	"github.com/julian-klode/lingolang/permission"
+)
+
+func TestVisitStmtCFG(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"labeledBreak",
+			`//lingo:check
+			package main
+			func f(a *int) *int {
+			L:
+				for {
+					for {
+						break L
+					}
+				}
+				return a
+			}`,
+			"",
+		},
+		{"labeledContinue",
+			`//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {
+			}
+			func f() {
+				a := new(int)
+			L:
+				for i := 0; i < 2; i++ {
+					for {
+						consume(a)
+						continue L
+					}
+				}
+			}`,
+			"Cannot bind parameter 0: Cannot copy or move",
+		},
+		{"gotoLeavesScope",
+			`//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {
+			}
+			func f(n int) {
+			x:
+				y := new(int)
+				consume(y)
+				if n > 0 {
+					goto x
+				}
+			}`,
+			"",
+		},
+		{"switchClauseScope",
+			`//lingo:check
+			package main
+			func f(n int) {
+				switch n {
+				case 0:
+					x := new(int)
+					println(x)
+					fallthrough
+				case 1:
+					y := new(int)
+					println(y)
+				}
+			}`,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			c := checkSummariesWith(t, Config{UseCFG: true}, test.src)
+			if test.err == "" && len(c.Errors) > 0 {
+				t.Fatalf("Unexpected errors %v", c.Errors)
+			}
+			if test.err != "" && (len(c.Errors) == 0 || !strings.Contains(c.Errors[0].Error(), test.err)) {
+				t.Fatalf("Expected error %s, received %v", test.err, c.Errors)
+			}
+		})
+	}
+}
+
+func TestCfgSolver_flowMergeError(t *testing.T) {
+	var errors []*interpreterError
+	i := &Interpreter{
+		onError:  func(err *interpreterError) { errors = append(errors, err) },
+		reported: make(map[ast.Node]bool),
+		poisoned: make(map[types.Object]bool),
+	}
+	from := &cfgNode{index: 0, node: &ast.EmptyStmt{Semicolon: 1}}
+	to := &cfgNode{index: 1, node: &ast.EmptyStmt{Semicolon: 2}}
+	s := &cfgSolver{
+		i:       i,
+		in:      make([]Store, 2),
+		reached: make([]bool, 2),
+		visits:  make([]int, 2),
+		queued:  make([]bool, 2),
+	}
+	st, _ := NewStore().Define(newVar("a"), permission.Mutable)
+	s.flow(from, to, st)
+
+	// The stores cannot be merged. The error is recorded like errors in
+	// statements, instead of escaping the solver.
+	other, _ := NewStore().Define(newVar("b"), permission.Mutable)
+	if _, ok := i.recoverError(st, func() { s.flow(from, to, other) }); ok {
+		t.Fatalf("Expected merge to fail")
+	}
+	if len(errors) != 1 || errors[0].code != CodeCannotMerge || errors[0].node != to.node || len(errors[0].related) != 1 {
+		t.Errorf("Expected merge error, received %v", errors)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"go/ast"
 	"go/token"
 	"go/types"
+	"strconv"
 	"strings"
 
 	"github.com/julian-klode/lingolang/permission"
@@ -22,21 +23,75 @@ type Checker struct {
 	conf   *Config
 	info   *Info
 	pmap   map[ast.Node]permission.Permission
-	passes []pass
+	// Positions of the annotations in pmap, for diagnostics.
+	annotations map[ast.Node]token.Pos
+	// Comments holding the @perm annotations of statements and
+	// declarations.
+	comments map[ast.Node]*ast.Comment
+	// Annotated permissions of local variables, and the comments they
+	// were given in, see annotateLocals().
+	locals        map[ast.Expr]permission.Permission
+	localComments map[ast.Expr]*ast.Comment
+	passes        []pass
+	pkg           *types.Package
+	// Permission types declared by @permtype annotations
+	scope     *permission.Scope
+	permTypes map[string]*permType
+	// State for checking functions, see summary.go
+	typeMapper *permission.TypeMapper
+	summaries  map[*types.Func]*permission.FuncPermission
+	globals    map[*types.Var]permission.Permission
+	noReturn   map[*types.Func]exitKind
+	// Whether the package is opted in to be checked, see checkFunctions()
+	checkPackage bool
+	// Number of functions that were not checked, as they were not opted in.
+	Skipped int
+	// Suppressions of diagnostics, see suppress.go
+	suppressions []*suppression
 	// Errors occured during capability checking.
-	Errors []error
+	Errors []Diagnostic
+	// Warnings found during capability checking. They do not count
+	// towards Config.MaxErrors.
+	Warnings []Diagnostic
 }
 
 // NewChecker returns a new checker with the specified settings.
 func NewChecker(conf *Config, info *Info, path string, fset *token.FileSet) *Checker {
 	pkg := types.NewPackage(path, "")
+	// Checking functions needs these to be recorded.
+	if info.Types.Types == nil {
+		info.Types.Types = make(map[ast.Expr]types.TypeAndValue)
+	}
+	if info.Types.Defs == nil {
+		info.Types.Defs = make(map[*ast.Ident]types.Object)
+	}
+	if info.Types.Uses == nil {
+		info.Types.Uses = make(map[*ast.Ident]types.Object)
+	}
+	if info.Types.Selections == nil {
+		info.Types.Selections = make(map[*ast.SelectorExpr]*types.Selection)
+	}
 	checker := &Checker{
-		parent: types.NewChecker(&conf.Types, fset, pkg, &info.Types),
-		path:   path,
-		fset:   fset,
-		conf:   conf,
-		info:   info,
-		pmap:   make(map[ast.Node]permission.Permission),
+		parent:      types.NewChecker(&conf.Types, fset, pkg, &info.Types),
+		path:        path,
+		fset:        fset,
+		conf:        conf,
+		info:        info,
+		pmap:        make(map[ast.Node]permission.Permission),
+		annotations: make(map[ast.Node]token.Pos),
+		comments:    make(map[ast.Node]*ast.Comment),
+		pkg:         pkg,
+		typeMapper:  permission.NewTypeMapperWithDefaults(conf.defaults()),
+		summaries:   make(map[*types.Func]*permission.FuncPermission),
+		globals:     make(map[*types.Var]permission.Permission),
+		noReturn:    make(map[*types.Func]exitKind),
+		scope:       permission.NewScope(),
+		permTypes:   make(map[string]*permType),
+	}
+	checker.scope.Resolve = func(name string) {
+		if decl, ok := checker.permTypes[name]; ok {
+			checker.resolvePermType(decl)
+		}
 	}
 	// Configure all passes here.
 	checker.passes = []pass{
@@ -59,13 +114,28 @@ func (c *Checker) Files(files []*ast.File) (err error) {
 			err = c.Errors[0]
 		}
 	}()
+	// Runs before the recovery above, also when checking bails out.
+	defer c.warnUnusedSuppressions()
+
 	// Perform the type check.
 	err = c.parent.Files(files)
 	if err != nil {
-		c.Errors = append(c.Errors, err)
+		if err, ok := err.(types.Error); ok {
+			c.errorf(err.Pos, CodeTypeError, "%s", err.Msg)
+		} else {
+			c.report(Diagnostic{Code: CodeTypeError, Message: err.Error()})
+		}
 		return
 	}
 
+	c.collectSuppressions(files)
+
+	// Declare the permission types, so annotations can refer to them.
+	c.declarePermTypes(files)
+	// Fields and types must be annotated before any type is mapped.
+	c.annotateFields(files)
+	c.annotateTypes(files)
+
 	// Run the individual capability checking passes.
 	// TODO: Error handling.
 	for _, p := range c.passes {
@@ -74,6 +144,11 @@ func (c *Checker) Files(files []*ast.File) (err error) {
 		}
 	}
 
+	// Check the function bodies.
+	c.annotateLocals(files)
+	c.checkFunctions(files)
+	c.reportFieldErrors()
+
 	if len(c.Errors) > 0 {
 		return c.Errors[0]
 	}
@@ -84,10 +159,58 @@ func (c *Checker) Files(files []*ast.File) (err error) {
 // bailout is a type to throw to end capability checking.
 type bailout struct{}
 
-// errorf inserts a new error into the error log.
-func (c *Checker) errorf(format string, a ...interface{}) {
-	c.Errors = append(c.Errors, fmt.Errorf(format, a...))
-	if len(c.Errors) >= 10 {
+// DefaultMaxErrors is the default for Config.MaxErrors.
+const DefaultMaxErrors = 10
+
+// errorf inserts a new error at pos into the error log.
+func (c *Checker) errorf(pos token.Pos, code Code, format string, a ...interface{}) {
+	c.report(c.diagnostic(pos, code, format, a...))
+}
+
+// diagnostic creates a diagnostic at pos.
+func (c *Checker) diagnostic(pos token.Pos, code Code, format string, a ...interface{}) Diagnostic {
+	return Diagnostic{Pos: c.fset.Position(pos), Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// warnf records a warning at pos, with a fix replacing the source code
+// from pos to end by newText.
+func (c *Checker) warnf(pos, end token.Pos, newText string, code Code, format string, a ...interface{}) {
+	d := c.diagnostic(pos, code, format, a...)
+	d.Fix = &Fix{Pos: c.fset.Position(pos), End: c.fset.Position(end), NewText: newText}
+	if c.suppressed(d) {
+		return
+	}
+	c.Warnings = append(c.Warnings, d)
+}
+
+// annotatedHere returns the position of the annotation of node, as a
+// position related to a diagnostic.
+func (c *Checker) annotatedHere(node ast.Node) []Related {
+	return []Related{{c.fset.Position(c.annotations[node]), "annotation declared here"}}
+}
+
+// interpreterDiagnostic converts an error found by the interpreter.
+func (c *Checker) interpreterDiagnostic(err *interpreterError) Diagnostic {
+	d := c.diagnostic(err.node.Pos(), err.code, "%s", err.message)
+	for _, r := range err.related {
+		d.Related = append(d.Related, Related{c.fset.Position(r.pos), r.message})
+	}
+	return d
+}
+
+// report inserts a diagnostic into the error log, and ends checking once
+// the maximum number of errors is reached. Suppressed diagnostics are
+// dropped.
+func (c *Checker) report(d Diagnostic) {
+	if c.suppressed(d) {
+		return
+	}
+	c.Errors = append(c.Errors, d)
+	maxErrors := c.conf.MaxErrors
+	if maxErrors == 0 {
+		maxErrors = DefaultMaxErrors
+	}
+	if maxErrors > 0 && len(c.Errors) >= maxErrors {
 		panic(bailout{})
 	}
 }
@@ -112,6 +235,14 @@ func (p assignPass) Visit(node ast.Node) (w ast.Visitor) {
 	if f, ok := node.(*ast.File); ok {
 		p.commentMap = ast.NewCommentMap(p.checker.fset, f, f.Comments)
 	}
+	// Annotations of struct fields and types are handled by annotateFields()
+	// and annotateTypes().
+	if _, ok := node.(*ast.StructType); ok {
+		return nil
+	}
+	if gen, ok := node.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+		return nil
+	}
 
 	// If we don't have comments for this node, no need to continue
 	cmtGrps, ok := p.commentMap[node]
@@ -123,18 +254,287 @@ func (p assignPass) Visit(node ast.Node) (w ast.Visitor) {
 	// starts with @perm and parse the specification there.
 	for _, cmtGrp := range cmtGrps {
 		for _, cmt := range cmtGrp.List {
-			text := cmt.Text[2:]
-			if strings.HasPrefix(strings.TrimSpace(text), "@perm") {
-				cap := text[strings.Index(text, "@perm")+len("@perm"):]
-
-				perm, err := permission.NewParser(cap).Parse()
-				if err != nil {
-					p.checker.errorf("%s: Cannot parse permission: %s", p.checker.fset.Position(cmt.Slash), err)
+			if text, _, ok := annotationText(cmt, "@noreturn"); ok {
+				p.checker.declareNoReturn(node, text, cmt.Slash)
+			}
+			if cap, offset, ok := annotationText(cmt, "@perm"); ok {
+				pos := cmt.Slash + token.Pos(offset)
+				parser := permission.NewScopedParser(cap, p.checker.scope)
+				var perm permission.Permission
+				if permission.IsNamedList(cap) {
+					list, err := parser.ParseNamedList()
+					p.checker.reportParser(parser, err, pos)
+					if err == nil {
+						perm = p.checker.funcFromNamedList(node, list, pos)
+					}
+				} else {
+					var err error
+					perm, err = parser.Parse()
+					p.checker.reportParser(parser, err, pos)
 				}
 				p.checker.pmap[node] = perm
+				p.checker.annotations[node] = cmt.Slash
+				p.checker.comments[node] = cmt
 			}
 		}
 	}
 
 	return p
 }
+
+// declareNoReturn declares that the function declared by node does not
+// return, but exits as given by the text of its "@noreturn" annotation at pos.
+func (c *Checker) declareNoReturn(node ast.Node, text string, pos token.Pos) {
+	decl, ok := node.(*ast.FuncDecl)
+	if !ok {
+		c.errorf(pos, CodeBadAnnotation, "Only functions can be declared to not return")
+		return
+	}
+	kind, ok := exitKinds[strings.TrimSpace(text)]
+	if !ok {
+		c.errorf(pos, CodeBadAnnotation, "Unknown kind of exit %q, expected exit, goexit, or panic", strings.TrimSpace(text))
+		return
+	}
+	if fn, ok := c.info.Types.Defs[decl.Name].(*types.Func); ok {
+		c.noReturn[fn] = kind
+	}
+}
+
+// funcFromNamedList creates the permission of a function from permissions
+// given for the names of its parameters and results, and "recv" for the
+// receiver and "return" for a single result. The other parameters and
+// results get the permissions of their types. The list was given at pos.
+func (c *Checker) funcFromNamedList(node ast.Node, list []permission.NamedPermission, pos token.Pos) permission.Permission {
+	decl, ok := node.(*ast.FuncDecl)
+	if !ok {
+		c.errorf(pos, CodeBadAnnotation, "Permissions for names can only be given for functions")
+		return nil
+	}
+	fn, ok := c.info.Types.Defs[decl.Name].(*types.Func)
+	if !ok {
+		return nil
+	}
+	sig := fn.Type().(*types.Signature)
+	perm := c.defaultSummary(sig)
+
+	given := make(map[string]bool)
+	for _, named := range list {
+		namePos := pos + token.Pos(named.Start)
+		if given[named.Name] {
+			c.errorf(namePos, CodeBadAnnotation, "Permission for %s given twice", named.Name)
+			continue
+		}
+		given[named.Name] = true
+
+		target := lookupVar(named.Name, sig.Params(), perm.Params)
+		if target == nil {
+			target = lookupVar(named.Name, sig.Results(), perm.Results)
+		}
+		switch {
+		case target != nil:
+		case named.Name == "recv" && sig.Recv() != nil:
+			target = &perm.Receivers[0]
+		case named.Name == "return" && sig.Results().Len() == 1:
+			target = &perm.Results[0]
+		case named.Name == "return":
+			c.errorf(namePos, CodeBadAnnotation, "Function %s does not have exactly one result, name the results instead", fn.Name())
+			continue
+		default:
+			c.errorf(namePos, CodeBadAnnotation, "Function %s has no parameter or result named %s", fn.Name(), named.Name)
+			continue
+		}
+		*target = named.Permission
+	}
+	return perm
+}
+
+// annotateFields declares the permissions of struct fields given by "@perm"
+// comments or "lingo" struct tags to the type mapper, so they are used
+// wherever the struct type is used.
+func (c *Checker) annotateFields(files []*ast.File) {
+	for _, f := range files {
+		ast.Inspect(f, func(node ast.Node) bool {
+			st, ok := node.(*ast.StructType)
+			if !ok {
+				return true
+			}
+			typ, ok := c.info.Types.TypeOf(st).(*types.Struct)
+			if !ok {
+				return true
+			}
+			i := 0
+			for _, field := range st.Fields.List {
+				ann, pos := c.fieldAnnotation(field)
+				names := len(field.Names)
+				if names == 0 {
+					names = 1 // An embedded field
+				}
+				for ; names > 0; names-- {
+					v := typ.Field(i)
+					i++
+					if pos == token.NoPos {
+						continue
+					}
+					var perm permission.Permission
+					if ann != nil {
+						perm = c.checkFieldAnnotation(ann, v, pos)
+					}
+					c.typeMapper.AnnotateField(v, perm)
+					c.pmap[field] = perm
+					c.annotations[field] = pos
+				}
+			}
+			return true
+		})
+	}
+}
+
+// fieldAnnotation parses the annotation of a struct field, and returns it
+// with its position, or token.NoPos if the field is not annotated.
+func (c *Checker) fieldAnnotation(field *ast.Field) (permission.Permission, token.Pos) {
+	text, pos := commentAnnotation(field.Doc, field.Comment)
+	if field.Tag != nil {
+		tag, _ := strconv.Unquote(field.Tag.Value)
+		if cap, ok := permission.FieldTag(tag); ok && pos != token.NoPos {
+			c.errorf(field.Tag.Pos(), CodeBadAnnotation, "Field has both a @perm comment and a lingo tag")
+		} else if ok {
+			text, pos = cap, field.Tag.Pos()
+			if offset := strings.Index(field.Tag.Value, cap); offset >= 0 {
+				pos += token.Pos(offset)
+			}
+		}
+	}
+	if pos == token.NoPos {
+		return nil, pos
+	}
+	return c.parseAnnotation(text, pos), pos
+}
+
+// checkFieldAnnotation checks that the permission declared at pos fits the
+// type of the field v, and returns it with its names resolved, or nil.
+func (c *Checker) checkFieldAnnotation(perm permission.Permission, v *types.Var, pos token.Pos) permission.Permission {
+	perm, errs := permission.ResolveNames(perm, v.Type())
+	for _, err := range errs {
+		c.errorf(pos, CodeBadPermission, "Cannot use permission %s for field %s: %s", perm, v.Name(), err)
+	}
+	if len(errs) > 0 {
+		return nil
+	}
+	if _, err := permission.ConvertTo(permission.NewTypeMapper().NewFromType(v.Type()), perm); err != nil {
+		c.errorf(pos, CodeBadPermission, "Cannot use permission %s for field %s: %s", perm, v.Name(), err)
+		return nil
+	}
+	return perm
+}
+
+// reportFieldErrors reports the errors in the permissions declared for
+// fields that the type mapper found. These are fields of imported types,
+// the annotations of fields in the package are checked by annotateFields().
+func (c *Checker) reportFieldErrors() {
+	for _, err := range c.typeMapper.Errors {
+		c.errorf(err.Field.Pos(), CodeBadPermission, "%s", err)
+	}
+	c.typeMapper.Errors = nil
+}
+
+// annotateTypes declares the default permissions of named types given by
+// "@perm" comments on their declarations to the type mapper, so they are
+// used for all values of the types.
+func (c *Checker) annotateTypes(files []*ast.File) {
+	type typeAnnotation struct {
+		spec *ast.TypeSpec
+		obj  *types.TypeName
+		perm permission.Permission
+	}
+	var decls []typeAnnotation
+	for _, f := range files {
+		ast.Inspect(f, func(node ast.Node) bool {
+			gen, ok := node.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				return true
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.TypeSpec)
+				groups := []*ast.CommentGroup{spec.Doc, spec.Comment}
+				if len(gen.Specs) == 1 {
+					groups = append(groups, gen.Doc)
+				}
+				text, pos := commentAnnotation(groups...)
+				obj, ok := c.info.Types.Defs[spec.Name].(*types.TypeName)
+				if pos == token.NoPos || !ok {
+					continue
+				}
+				perm := c.parseAnnotation(text, pos)
+				if perm != nil {
+					var errs []error
+					perm, errs = permission.ResolveNames(perm, obj.Type())
+					for _, err := range errs {
+						c.errorf(pos, CodeBadPermission, "Cannot use permission %s for type %s: %s", perm, obj.Name(), err)
+					}
+					if len(errs) > 0 {
+						perm = nil
+					}
+				}
+				c.typeMapper.AnnotateType(obj, perm)
+				c.pmap[spec] = perm
+				c.annotations[spec] = pos
+				decls = append(decls, typeAnnotation{spec, obj, perm})
+			}
+			return true
+		})
+	}
+	// Types may refer to each other, so they can only be checked once all
+	// of them are annotated.
+	for _, decl := range decls {
+		if decl.perm == nil {
+			continue
+		}
+		if _, err := permission.ConvertTo(c.typeMapper.NewFromType(decl.obj.Type().Underlying()), decl.perm); err != nil {
+			d := c.diagnostic(decl.spec.Name.Pos(), CodeBadPermission, "Cannot use permission %s for type %s: %s", decl.perm, decl.obj.Name(), err)
+			d.Related = c.annotatedHere(decl.spec)
+			c.report(d)
+			c.typeMapper.AnnotateType(decl.obj, nil)
+		}
+	}
+}
+
+// commentAnnotation returns the text of the last "@perm" annotation in the
+// comment groups, and its position, or token.NoPos if there is none.
+func commentAnnotation(groups ...*ast.CommentGroup) (string, token.Pos) {
+	var text string
+	var pos token.Pos
+	for _, cmtGrp := range groups {
+		if cmtGrp == nil {
+			continue
+		}
+		for _, cmt := range cmtGrp.List {
+			if cap, offset, ok := annotationText(cmt, "@perm"); ok {
+				text, pos = cap, cmt.Slash+token.Pos(offset)
+			}
+		}
+	}
+	return text, pos
+}
+
+// parseAnnotation parses the text of an annotation at pos, reporting any
+// errors, and returns nil if it cannot be parsed.
+func (c *Checker) parseAnnotation(text string, pos token.Pos) permission.Permission {
+	parser := permission.NewScopedParser(text, c.scope)
+	perm, err := parser.Parse()
+	c.reportParser(parser, err, pos)
+	if err != nil {
+		return nil
+	}
+	return perm
+}
+
+// lookupVar returns a pointer to the permission of the variable named
+// name in a tuple, or nil if there is no such variable.
+func lookupVar(name string, tuple *types.Tuple, perms []permission.Permission) *permission.Permission {
+	for i := 0; i < tuple.Len(); i++ {
+		if v := tuple.At(i); v.Name() == name && name != "_" {
+			return &perms[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"fmt"
+	"go/token"
+)
+
+// Code identifies the kind of problem a diagnostic describes. Codes are
+// stable, so they can be referred to from documentation and source code.
+type Code string
+
+// The codes of diagnostics.
+const (
+	CodeTypeError         Code = "LINGO001" // The package does not type check
+	CodeBadAnnotation     Code = "LINGO002" // An annotation cannot be parsed
+	CodeBadPermission     Code = "LINGO003" // An annotation does not fit its type
+	CodeNonCanonical      Code = "LINGO004" // An annotation can be written simpler
+	CodeUnusedSuppression Code = "LINGO005" // A //lingo:ignore comment is not needed
+	CodeInterpreter       Code = "LINGO010" // Unsupported or invalid code
+	CodeMissingPermission Code = "LINGO011" // A value lacks a permission
+	CodeCannotMove        Code = "LINGO012" // A value can neither be copied nor moved
+	CodeCannotBorrow      Code = "LINGO013" // A variable cannot be borrowed or released
+	CodeCannotMerge       Code = "LINGO014" // Paths through the code do not fit together
+	CodeNoConvergence     Code = "LINGO015" // A loop did not stabilize
+	CodeDeferredCall      Code = "LINGO016" // A deferred call lost access to a value
+)
+
+// Diagnostic is a problem found during capability checking.
+type Diagnostic struct {
+	Pos     token.Position
+	Code    Code
+	Message string
+	Related []Related // Other positions involved in the problem
+	Fix     *Fix      // A suggested fix for the problem, if any
+}
+
+// Fix suggests to replace the source code between Pos and End by NewText.
+type Fix struct {
+	Pos     token.Position
+	End     token.Position
+	NewText string
+}
+
+// Related is a position related to a diagnostic, with a note explaining
+// the relation, like "moved here".
+type Related struct {
+	Pos     token.Position
+	Message string
+}
+
+// Error formats the diagnostic as "position: message [code]", so a
+// diagnostic can be used as an error.
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s [%s]", d.Pos, d.Message, d.Code)
+}
@@ -10,7 +10,6 @@ import (
 	"go/types"
 	"log"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/julian-klode/lingolang/permission"
 )
 
@@ -20,13 +19,147 @@ type Interpreter struct {
 	curFunc              *permission.FuncPermission
 	fset                 *token.FileSet
 	AnnotatedPermissions map[ast.Expr]permission.Permission
-	typeMapper           permission.TypeMapper
+	// annotationComments are the comments the annotated permissions
+	// were given in, for diagnostics.
+	annotationComments map[ast.Expr]*ast.Comment
+	typeMapper           *permission.TypeMapper
+	// summaries maps the functions declared in the checked package to
+	// their permissions, see summary.go.
+	summaries map[*types.Func]*permission.FuncPermission
+	// noReturn maps the functions annotated with "@noreturn" to how
+	// they exit.
+	noReturn map[*types.Func]exitKind
+	// While inferring a summary, returned values are not checked against
+	// the results of curFunc but intersected into inferred.
+	inferring bool
+	inferred  []permission.Permission
+	// synthesized holds objects for identifiers without type information,
+	// see objectOf().
+	synthesized map[string]types.Object
+	// MaxIterations limits the number of statements interpreted for a
+	// single loop or block, see blockManager. Zero means
+	// DefaultMaxIterations.
+	MaxIterations int
+	// UseCFG selects the engine interpreting function bodies based on a
+	// control-flow graph, see cfg.go.
+	UseCFG bool
+	// onError, if set, is called for errors in statements, and the
+	// interpretation continues after them, see recoverError().
+	onError  func(err *interpreterError)
+	reported map[ast.Node]bool
+	poisoned map[types.Object]bool
+}
+
+// interpreterError is an error found while interpreting a function. The
+// checker turns it into a Diagnostic.
+type interpreterError struct {
+	code    Code
+	node    ast.Node // The node the error is about
+	message string
+	related []relatedNode
+}
+
+// relatedNode is a position related to an error, see Related.
+type relatedNode struct {
+	pos     token.Pos
+	message string
+}
+
+func (e *interpreterError) Error() string {
+	return fmt.Sprintf("%v: In %s: %s", e.node.Pos(), e.node, e.message)
+}
+
+// DefaultMaxIterations is the default for Interpreter.MaxIterations.
+const DefaultMaxIterations = 10000
+
+// maxIterations returns the limit on the number of statements interpreted
+// for a single loop or block.
+func (i *Interpreter) maxIterations() int {
+	if i.MaxIterations == 0 {
+		return DefaultMaxIterations
+	}
+	return i.MaxIterations
+}
+
+// mergeAfter is the number of times a statement in a block is visited with
+// different stores before the stores are merged, and widenAfter the number
+// before they are widened, see blockManager.
+const (
+	mergeAfter = 4
+	widenAfter = 2 * mergeAfter
+)
+
+// deferredCall is a call registered by a defer statement in the current
+// function, along with the unowned values it borrowed. These values are
+// released when the call is deferred, but the call only runs at an exit of
+// the function, so they need to be borrowed again there. Pending calls are
+// recorded in the Store, so they follow the paths through the function.
+type deferredCall struct {
+	stmt     *ast.DeferStmt
+	released []Borrowed
+	recovers bool // The deferred call calls recover()
+}
+
+// exitKind describes how a call leaves the function calling it.
+type exitKind int
+
+// The kinds of exits of calls.
+const (
+	returns        exitKind = iota // The call returns normally
+	exitsProgram                   // The program ends, deferred calls do not run
+	exitsGoroutine                 // The deferred calls run, then the goroutine ends
+	panics                         // The deferred calls run, and may recover
+)
+
+// noReturnFunctions lists functions and methods outside the checked code
+// that never return to their caller, by their full name. Functions in the
+// checked code are annotated with "@noreturn" instead.
+var noReturnFunctions = map[string]exitKind{
+	"os.Exit":                    exitsProgram,
+	"runtime.Goexit":             exitsGoroutine,
+	"log.Fatal":                  exitsProgram,
+	"log.Fatalf":                 exitsProgram,
+	"log.Fatalln":                exitsProgram,
+	"log.Panic":                  panics,
+	"log.Panicf":                 panics,
+	"log.Panicln":                panics,
+	"(*log.Logger).Fatal":        exitsProgram,
+	"(*log.Logger).Fatalf":       exitsProgram,
+	"(*log.Logger).Fatalln":      exitsProgram,
+	"(*log.Logger).Panic":        panics,
+	"(*log.Logger).Panicf":       panics,
+	"(*log.Logger).Panicln":      panics,
+	"(*testing.common).FailNow":  exitsGoroutine,
+	"(*testing.common).Fatal":    exitsGoroutine,
+	"(*testing.common).Fatalf":   exitsGoroutine,
+	"(*testing.common).SkipNow":  exitsGoroutine,
+	"(*testing.common).Skip":     exitsGoroutine,
+	"(*testing.common).Skipf":    exitsGoroutine,
+}
+
+// exitKinds maps the arguments of "@noreturn" annotations to kinds of exits.
+var exitKinds = map[string]exitKind{
+	"":       exitsProgram,
+	"exit":   exitsProgram,
+	"goexit": exitsGoroutine,
+	"panic":  panics,
+}
+
+// builtinParams lists the base permissions of the parameters of builtin
+// functions that need more than reading their arguments, by name. A
+// missing entry repeats the one before it.
+var builtinParams = map[string][]permission.BasePermission{
+	"append": {permission.Owned | permission.Mutable}, // The arguments are stored in the result
+	"copy":   {permission.Mutable, permission.Read},
+	"delete": {permission.Mutable, permission.Read},
+	"close":  {permission.Mutable},
+	"clear":  {permission.Mutable},
 }
 
 // Borrowed describes a variable that had to be borrowed from, along
 // with it's associated original permission.
 type Borrowed struct {
-	id   *ast.Ident
+	obj  types.Object
 	perm permission.Permission
 }
 
@@ -91,22 +224,129 @@ func (i *Interpreter) Release(node ast.Node, st Store, undo []Borrowed) Store {
 		if b == Borrowed(NoOwner) {
 			continue
 		}
-		st, err = st.SetEffective(b.id.Name, b.perm)
+		st, err = st.SetEffective(b.obj, b.perm)
 		if err != nil {
-			i.Error(node, "Cannot release borrowed variable %s: %s", b.id, err)
+			i.Errorf(CodeCannotBorrow, node, "Cannot release borrowed variable %s: %s", b.obj.Name(), err)
 		}
 	}
 	return st
 }
 
-// Assert asserts that the base permissions of subject are a superset or the same as has.
+// Error reports an error about the given node. It does not return, the
+// error is passed to the caller of the statement, see recoverError().
 func (i *Interpreter) Error(node ast.Node, format string, args ...interface{}) (permission.Permission, Owner, []Borrowed, Store) {
-	panic(fmt.Errorf("%v: In %s: %s", node.Pos(), node, fmt.Sprintf(format, args...)))
+	return i.Errorf(CodeInterpreter, node, format, args...)
+}
+
+// Errorf is like Error, but with a code identifying the kind of error.
+func (i *Interpreter) Errorf(code Code, node ast.Node, format string, args ...interface{}) (permission.Permission, Owner, []Borrowed, Store) {
+	return i.errorRelated(code, node, nil, format, args...)
+}
+
+// errorRelated is like Errorf, but with other nodes involved in the error.
+func (i *Interpreter) errorRelated(code Code, node ast.Node, related []relatedNode, format string, args ...interface{}) (permission.Permission, Owner, []Borrowed, Store) {
+	panic(&interpreterError{code: code, node: node, message: fmt.Sprintf(format, args...), related: related})
 }
 
+// recoverError runs f, which interprets something starting with the store
+// st. If f reports an error and errors are recorded, the error is recorded
+// and false is returned along with st, in which the variables the error is
+// about have become unusable.
+//
+// Errors about a variable that is already unusable are not recorded, as they
+// are usually just follow-up errors.
+func (i *Interpreter) recoverError(st Store, f func()) (result Store, ok bool) {
+	if i.onError == nil {
+		f()
+		return st, true
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err, isError := r.(*interpreterError)
+		if !isError {
+			panic(r)
+		}
+		objects := i.objectsIn(st, err.node)
+		if !i.reported[err.node] && !i.aboutPoisoned(err.node) {
+			i.reported[err.node] = true
+			err.related = append(err.related, i.provenanceOf(st, objects)...)
+			i.onError(err)
+		}
+		for _, obj := range objects {
+			i.poisoned[obj] = true
+			st, _ = st.update(obj, func(e *storeEntry) error {
+				e.eff = permission.ConvertToBase(e.eff, 0)
+				return nil
+			})
+		}
+		result, ok = st, false
+	}()
+	f()
+	return st, true
+}
+
+// objectsIn returns the objects in the store that node refers to.
+func (i *Interpreter) objectsIn(st Store, node ast.Node) []types.Object {
+	var objects []types.Object
+	seen := make(map[types.Object]bool)
+	ast.Inspect(node, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if obj := i.objectOf(ident); !seen[obj] && st.find(obj) != nil {
+				seen[obj] = true
+				objects = append(objects, obj)
+			}
+		}
+		return true
+	})
+	return objects
+}
+
+// provenanceOf explains why the objects have lost permissions in st, like
+// the borrow checker of Rust shows where a value was moved.
+func (i *Interpreter) provenanceOf(st Store, objects []types.Object) []relatedNode {
+	var related []relatedNode
+	for _, obj := range objects {
+		if pos, reason := st.Provenance(obj); pos != token.NoPos {
+			related = append(related, relatedNode{pos, fmt.Sprintf("%s %s here", obj.Name(), reason)})
+		}
+	}
+	return related
+}
+
+// aboutPoisoned checks whether node is about a variable that has been made
+// unusable by an earlier error, that is, whether the variable is the root of
+// the expression node. Other variables used by node do not count, errors
+// about them are not follow-up errors.
+func (i *Interpreter) aboutPoisoned(node ast.Node) bool {
+	for {
+		switch e := node.(type) {
+		case *ast.Ident:
+			return i.poisoned[i.objectOf(e)]
+		case *ast.ParenExpr:
+			node = e.X
+		case *ast.StarExpr:
+			node = e.X
+		case *ast.UnaryExpr:
+			node = e.X
+		case *ast.SelectorExpr:
+			node = e.X
+		case *ast.IndexExpr:
+			node = e.X
+		case *ast.SliceExpr:
+			node = e.X
+		default:
+			return false
+		}
+	}
+}
+
+// Assert asserts that the base permissions of subject are a superset or the same as has.
 func (i *Interpreter) Assert(node ast.Node, subject permission.Permission, has permission.BasePermission) {
 	if has&^subject.GetBasePermission() != 0 {
-		i.Error(node, "Required permissions %s, but only have %s", has, subject)
+		i.Errorf(CodeMissingPermission, node, "Required permissions %s, but only have %s", has, subject)
 	}
 }
 
@@ -117,19 +357,84 @@ func (i *Interpreter) visitIdent(st Store, e *ast.Ident) (permission.Permission,
 	if e.Name == "true" || e.Name == "false" {
 		return permission.Mutable | permission.Owned, NoOwner, nil, st
 	}
-	perm := st.GetEffective(e.Name)
+	obj := i.objectOf(e)
+	if st.GetEffective(obj) == nil {
+		if perm := i.objectPermission(e); perm != nil {
+			return perm, NoOwner, nil, st
+		}
+		i.Errorf(CodeCannotBorrow, e, "Cannot borow %s: Unknown variable in %s", e, st)
+	}
+	return i.borrow(e, st, obj)
+}
+
+// borrow borrows an object from the store. It cannot be used anymore until
+// the returned owner is released.
+func (i *Interpreter) borrow(node ast.Node, st Store, obj types.Object) (permission.Permission, Owner, []Borrowed, Store) {
+	perm := st.GetEffective(obj)
 	if perm == nil {
-		i.Error(e, "Cannot borow %s: Unknown variable in %s", e, st)
+		i.Errorf(CodeCannotBorrow, node, "Cannot borow %s: Unknown variable in %v", obj.Name(), st)
 	}
-	owner := Owner{e, perm}
+	owner := Owner{obj, perm}
 	dead := permission.ConvertToBase(perm, permission.None)
-	st, err := st.SetEffective(e.Name, dead)
+	st, err := st.SetEffectiveAt(obj, dead, node.Pos(), "borrowed")
 	if err != nil {
-		i.Error(e, "Cannot borrow identifier: %s", err)
+		i.Errorf(CodeCannotBorrow, node, "Cannot borrow identifier: %s", err)
 	}
 	return perm, owner, nil, st
 }
 
+// objectOf returns the object an identifier defines or refers to. Without
+// type information, a variable is synthesized for each name, so the
+// interpreter can be used on plain expressions as well.
+func (i *Interpreter) objectOf(e *ast.Ident) types.Object {
+	if i.typesInfo != nil {
+		if obj := i.typesInfo.Defs[e]; obj != nil {
+			return obj
+		}
+		if obj := i.typesInfo.Uses[e]; obj != nil {
+			return obj
+		}
+	}
+	if obj, ok := i.synthesized[e.Name]; ok {
+		return obj
+	}
+	if i.synthesized == nil {
+		i.synthesized = make(map[string]types.Object)
+	}
+	obj := types.NewVar(e.Pos(), nil, e.Name, nil)
+	i.synthesized[e.Name] = obj
+	return obj
+}
+
+// objectPermission returns the permission of an identifier that does not
+// live in the store: Functions (using their summary, if there is one), types,
+// constants, and package-level variables of other packages. These are not
+// borrowed from anything. Returns nil for all other identifiers.
+func (i *Interpreter) objectPermission(e *ast.Ident) permission.Permission {
+	if i.typesInfo == nil {
+		return nil
+	}
+	if i.typeMapper == nil {
+		i.typeMapper = permission.NewTypeMapper()
+	}
+	switch obj := i.typesInfo.Uses[e].(type) {
+	case *types.Func:
+		if perm, ok := i.summaries[obj]; ok {
+			return perm
+		}
+	case *types.Builtin:
+		return i.builtinPermission(e)
+	case *types.Var:
+		if obj.Pkg() == nil || obj.Parent() != obj.Pkg().Scope() {
+			return nil
+		}
+	case *types.Const, *types.TypeName:
+	default:
+		return nil
+	}
+	return i.typeMapper.NewFromTypeIn(i.typesInfo.Uses[e].Type(), permission.GlobalContext)
+}
+
 func (i *Interpreter) moveOrCopy(e ast.Node, st Store, from, to permission.Permission, owner Owner, deps []Borrowed) (Store, Owner, []Borrowed, error) {
 	switch {
 	// If the value can be copied into the caller, we don't need to borrow it
@@ -140,7 +445,7 @@ func (i *Interpreter) moveOrCopy(e ast.Node, st Store, from, to permission.Permi
 		deps = nil
 	// The value cannot be moved either, error out.
 	case !permission.MovableTo(from, to):
-		return nil, NoOwner, nil, fmt.Errorf("Cannot copy or move: Needed %s, received %s", to, from)
+		return Store{}, NoOwner, nil, fmt.Errorf("Cannot copy or move: Needed %s, received %s: %s", to, from, permission.ExplainMove(from, to))
 
 	// All borrows for unowned parameters are released after the call is done.
 	case to.GetBasePermission()&permission.Owned == 0:
@@ -155,6 +460,7 @@ func (i *Interpreter) moveOrCopy(e ast.Node, st Store, from, to permission.Permi
 		deps = nil
 	// The value was moved, so all its deps are lost
 	default:
+		st = i.markMoved(e, st, owner, deps)
 		deps = nil
 		owner = NoOwner
 	}
@@ -163,6 +469,45 @@ func (i *Interpreter) moveOrCopy(e ast.Node, st Store, from, to permission.Permi
 
 }
 
+// markMoved records why the owner and the deps of a value moved at node e
+// cannot be used anymore. They were borrowed when the value was evaluated,
+// so the position of the borrow is kept, it is more precise.
+func (i *Interpreter) markMoved(e ast.Node, st Store, owner Owner, deps []Borrowed) Store {
+	reason := moveReason(e)
+	for _, b := range append([]Borrowed{Borrowed(owner)}, deps...) {
+		if b.obj == nil || st.find(b.obj) == nil {
+			continue
+		}
+		st, _ = st.update(b.obj, func(entry *storeEntry) error {
+			if entry.why.pos == token.NoPos {
+				entry.why.pos = e.Pos()
+			}
+			entry.why.reason = reason
+			return nil
+		})
+	}
+	return st
+}
+
+// moveReason describes what happens to a value that is moved at node e.
+func moveReason(e ast.Node) string {
+	switch e.(type) {
+	case *ast.CallExpr:
+		return "moved into a call"
+	case *ast.CompositeLit:
+		return "moved into a field"
+	case *ast.SendStmt:
+		return "sent on a channel"
+	case *ast.ReturnStmt:
+		return "returned"
+	case *ast.SelectorExpr:
+		return "bound to a method value"
+	case *ast.IndexExpr:
+		return "moved into a map key"
+	}
+	return "moved"
+}
+
 // visitBinaryExpr - A binary expression is either logical, arithmetic, or a comparison.
 func (i *Interpreter) visitBinaryExpr(st Store, e *ast.BinaryExpr) (permission.Permission, Owner, []Borrowed, Store) {
 	var err error
@@ -182,7 +527,7 @@ func (i *Interpreter) visitBinaryExpr(st Store, e *ast.BinaryExpr) (permission.P
 	case token.LAND, token.LOR:
 		st, err = stl.Merge(str)
 		if err != nil {
-			return i.Error(e, "Cannot merge different outcomes of logical operator")
+			return i.Errorf(CodeCannotMerge, e, "Cannot merge different outcomes of logical operator")
 		}
 	default:
 		st = str
@@ -220,13 +565,13 @@ func (i *Interpreter) visitIndexExpr(st Store, e *ast.IndexExpr) (permission.Per
 		// Ensures(map): If the key can be copied, we don't borrow it.
 		st, owner2, deps2, err = i.moveOrCopy(e, st, p2, p1.KeyPermission, owner2, deps2)
 		if err != nil {
-			return i.Error(e, "Cannot move or copy from %s to %s: %s", p2, p1.KeyPermission, err)
+			return i.Errorf(CodeCannotMove, e, "Cannot use index: %s", err)
 		}
 		return p1.ValuePermission, owner1, deps1, st
 	}
 
 	i.Error(e, "Indexing unknown type")
-	return nil, NoOwner, nil, nil
+	return nil, NoOwner, nil, Store{}
 }
 
 func (i *Interpreter) visitStarExpr(st Store, e *ast.StarExpr) (permission.Permission, Owner, []Borrowed, Store) {
@@ -278,18 +623,31 @@ func (i *Interpreter) visitBasicLit(st Store, e *ast.BasicLit) (permission.Permi
 func (i *Interpreter) visitCallExpr(st Store, e *ast.CallExpr, isDeferredOrGoroutine bool) (permission.Permission, Owner, []Borrowed, Store) {
 	var err error
 
+	if i.isBuiltinCall(e, "panic") || i.isBuiltinCall(e, "recover") {
+		return i.visitBuiltinCall(st, e)
+	}
+	if i.typesInfo != nil && i.typesInfo.Types[e.Fun].IsType() && len(e.Args) == 1 {
+		// A conversion. It produces the same value, with the same owner.
+		return i.VisitExpr(st, e.Args[0])
+	}
+
 	fun, owner, funDeps, st := i.VisitExpr(st, e.Fun)
 
 	var accumulatedUnownedDeps []Borrowed
 	switch fun := fun.(type) {
 	case *permission.FuncPermission:
 		for j, arg := range e.Args {
+			// Builtins like new() take types, they are not values.
+			if i.typesInfo != nil && i.typesInfo.Types[arg].IsType() {
+				continue
+			}
 			argPerm, argOwner, argDeps, store := i.VisitExpr(st, arg)
 			st = store
 
-			st, argOwner, argDeps, err = i.moveOrCopy(e, st, argPerm, fun.Params[j], argOwner, argDeps)
+			param := i.paramPermission(e, fun, j)
+			st, argOwner, argDeps, err = i.moveOrCopy(e, st, argPerm, param, argOwner, argDeps)
 			if err != nil {
-				return i.Error(arg, "Cannot copy or move to parameter: Needed %#v, received %#v", fun.Params[j], argPerm)
+				return i.Errorf(CodeCannotMove, arg, "Cannot bind parameter %d: %s", j, err)
 			}
 
 			accumulatedUnownedDeps = append(accumulatedUnownedDeps, Borrowed(argOwner))
@@ -318,6 +676,142 @@ func (i *Interpreter) visitCallExpr(st Store, e *ast.CallExpr, isDeferredOrGorou
 
 }
 
+// paramPermission returns the permission of the parameter that the j-th
+// argument of the call is passed to. Excess arguments to a variadic function
+// are passed to elements of the last parameter.
+func (i *Interpreter) paramPermission(e *ast.CallExpr, fun *permission.FuncPermission, j int) permission.Permission {
+	n := len(fun.Params)
+	variadic := false
+	if n > 0 && e.Ellipsis == token.NoPos && i.typesInfo != nil {
+		sig, ok := i.typesInfo.TypeOf(e.Fun).(*types.Signature)
+		variadic = ok && sig.Variadic()
+	}
+	if j >= n && !variadic {
+		i.Error(e, "Too many arguments in call, expected %d", n)
+	}
+	if variadic && j >= n-1 {
+		slice, ok := fun.Params[n-1].(*permission.SlicePermission)
+		if !ok {
+			i.Error(e, "Expected a slice permission for the variadic parameter, received %s", fun.Params[n-1])
+		}
+		return slice.ElementPermission
+	}
+	return fun.Params[j]
+}
+
+// isBuiltin checks whether the expression refers to a builtin function.
+func (i *Interpreter) isBuiltin(e ast.Expr) bool {
+	ident, ok := e.(*ast.Ident)
+	if !ok || i.typesInfo == nil {
+		return false
+	}
+	if _, ok := i.typesInfo.Uses[ident].(*types.Builtin); ok {
+		return true
+	}
+	tv, ok := i.typesInfo.Types[ident]
+	return ok && tv.IsBuiltin()
+}
+
+// isBuiltinCall checks whether the call is a call to the builtin function
+// with the given name.
+func (i *Interpreter) isBuiltinCall(e *ast.CallExpr, name string) bool {
+	ident, ok := e.Fun.(*ast.Ident)
+	return ok && ident.Name == name && i.isBuiltin(ident)
+}
+
+// builtinPermission returns the permission of a builtin function at a call,
+// from the signature of the call. The arguments of most builtins only need
+// to be readable, see builtinParams for the others.
+func (i *Interpreter) builtinPermission(e *ast.Ident) permission.Permission {
+	sig, ok := i.typesInfo.TypeOf(e).(*types.Signature)
+	if !ok {
+		return nil
+	}
+	perm := &permission.FuncPermission{BasePermission: permission.Owned | permission.Mutable}
+	bases := builtinParams[e.Name]
+	base := permission.Read
+	for j := 0; j < sig.Params().Len(); j++ {
+		if j < len(bases) {
+			base = bases[j]
+		}
+		param := i.typeMapper.NewFromTypeIn(sig.Params().At(j).Type(), permission.ParamContext)
+		perm.Params = append(perm.Params, permission.ConvertToBase(param, base))
+	}
+	for j := 0; j < sig.Results().Len(); j++ {
+		perm.Results = append(perm.Results, i.typeMapper.NewFromTypeIn(sig.Results().At(j).Type(), permission.ResultContext))
+	}
+	return perm
+}
+
+// visitBuiltinCall handles calls to the builtin functions panic() and
+// recover(). The arguments only need to be readable, and the result is a
+// new owned value.
+func (i *Interpreter) visitBuiltinCall(st Store, e *ast.CallExpr) (permission.Permission, Owner, []Borrowed, Store) {
+	for _, arg := range e.Args {
+		perm, deps, store := i.visitExprOwnerToDeps(st, arg)
+		i.Assert(arg, perm, permission.Read)
+		st = i.Release(arg, store, deps)
+	}
+	typ := i.typesInfo.TypeOf(e)
+	if tuple, ok := typ.(*types.Tuple); typ == nil || ok && tuple.Len() == 0 {
+		return &permission.TuplePermission{BasePermission: permission.Owned | permission.Mutable}, NoOwner, nil, st
+	}
+	if i.typeMapper == nil {
+		i.typeMapper = permission.NewTypeMapper()
+	}
+	return i.typeMapper.NewFromTypeIn(typ, permission.LocalContext), NoOwner, nil, st
+}
+
+// isNoReturnCall checks whether the call never returns, either because it
+// panics, or because it is known to terminate the program or goroutine.
+func (i *Interpreter) isNoReturnCall(e *ast.CallExpr) bool {
+	return i.exitKindOf(e) != returns
+}
+
+// exitKindOf returns how the call leaves the function calling it.
+func (i *Interpreter) exitKindOf(e *ast.CallExpr) exitKind {
+	if i.isBuiltinCall(e, "panic") {
+		return panics
+	}
+	if i.typesInfo == nil {
+		return returns
+	}
+	var ident *ast.Ident
+	switch fun := e.Fun.(type) {
+	case *ast.Ident:
+		ident = fun
+	case *ast.SelectorExpr:
+		ident = fun.Sel
+	default:
+		return returns
+	}
+	fun, ok := i.typesInfo.Uses[ident].(*types.Func)
+	if !ok {
+		return returns
+	}
+	if kind, ok := i.noReturn[fun]; ok {
+		return kind
+	}
+	return noReturnFunctions[fun.FullName()]
+}
+
+// callsRecover checks whether the deferred call is a function literal
+// calling recover().
+func (i *Interpreter) callsRecover(e *ast.CallExpr) bool {
+	lit, ok := e.Fun.(*ast.FuncLit)
+	if !ok {
+		return false
+	}
+	found := false
+	ast.Inspect(lit.Body, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok && i.isBuiltinCall(call, "recover") {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
 func (i *Interpreter) visitSliceExpr(st Store, e *ast.SliceExpr) (permission.Permission, Owner, []Borrowed, Store) {
 	arr, owner, arrDeps, st := i.VisitExpr(st, e.X)
 	low, lowDeps, st := i.visitExprOwnerToDeps(st, e.Low)
@@ -349,6 +843,13 @@ func (i *Interpreter) visitSliceExpr(st Store, e *ast.SliceExpr) (permission.Per
 
 func (i *Interpreter) visitSelectorExpr(st Store, e *ast.SelectorExpr) (permission.Permission, Owner, []Borrowed, Store) {
 	selection := i.typesInfo.Selections[e]
+	if selection == nil {
+		// A qualified identifier, like fmt.Println
+		if perm := i.objectPermission(e.Sel); perm != nil {
+			return perm, NoOwner, nil, st
+		}
+		return i.Error(e, "Unknown qualified identifier")
+	}
 	path := selection.Index()
 	pathLen := len(path)
 	lhs, owner, deps, st := i.VisitExpr(st, e.X)
@@ -364,8 +865,6 @@ func (i *Interpreter) visitSelectorExpr(st Store, e *ast.SelectorExpr) (permissi
 }
 
 func (i *Interpreter) visitSelectorExprOne(st Store, e ast.Expr, p permission.Permission, index int, kind types.SelectionKind, owner Owner, deps []Borrowed) (permission.Permission, Owner, []Borrowed, Store) {
-	var err error
-
 	switch kind {
 	case types.FieldVal:
 		/* A field value might be accessed through a pointer, fix it */
@@ -375,27 +874,26 @@ func (i *Interpreter) visitSelectorExprOne(st Store, e ast.Expr, p permission.Pe
 
 		strct, ok := p.(*permission.StructPermission)
 		if !ok {
-			return i.Error(e, "Cannot read field %s of non-struct type %#v", index, p)
+			return i.Error(e, "Cannot read field %d of non-struct type %s", index, p)
 		}
 		return strct.Fields[index], owner, deps, st
 	case types.MethodVal:
 		// TODO: NamedType
 		switch p := p.(type) {
 		case *permission.InterfacePermission:
-			target := p.Methods[index].Receivers[0]
-			if st, owner, deps, err = i.moveOrCopy(e, st, p, target, owner, deps); err != nil {
-				return i.Error(e, spew.Sprintf("Cannot bind receiver: %s in %v", err, p))
+			return i.bindReceiver(st, e, p, p.Methods[index], owner, deps)
+		default:
+			perm := i.methodSummary(e)
+			if perm == nil {
+				return i.Error(e, "Incompatible or unknown type on left side of method value for index %d", index)
 			}
-
-			perm := p.Methods[index]
-			// If we are binding unowned, our function value must be unowned too.
-			if perm.Receivers[0].GetBasePermission()&permission.Owned == 0 {
-				perm = permission.ConvertToBase(perm, perm.GetBasePermission()&^permission.Owned).(*permission.FuncPermission)
+			// Pointer receivers can be called on addressable values.
+			if _, ok := perm.Receivers[0].(*permission.PointerPermission); ok {
+				if _, ok := p.(*permission.PointerPermission); !ok {
+					p = &permission.PointerPermission{BasePermission: permission.Owned | permission.Mutable, Target: p}
+				}
 			}
-
-			return stripReceiver(perm), owner, deps, st
-		default:
-			return i.Error(e, "Incompatible or unknown type on left side of method value for index %d", index)
+			return i.bindReceiver(st, e, p, perm, owner, deps)
 		}
 	case types.MethodExpr:
 		switch p := p.(type) {
@@ -404,12 +902,47 @@ func (i *Interpreter) visitSelectorExprOne(st Store, e ast.Expr, p permission.Pe
 			st = i.Release(e, st, deps)
 			return pushReceiverToParams(p.Methods[index]), NoOwner, nil, st
 		default:
+			if perm := i.methodSummary(e); perm != nil {
+				st = i.Release(e, st, []Borrowed{Borrowed(owner)})
+				st = i.Release(e, st, deps)
+				return pushReceiverToParams(perm), NoOwner, nil, st
+			}
 			return i.Error(e, "Incompatible or unknown type on left side of method value for index %d", index)
 		}
 	}
 	return i.Error(e, "Invalid kind of selector expression")
 }
 
+// bindReceiver binds the receiver p to the method perm, and returns the
+// resulting method value.
+func (i *Interpreter) bindReceiver(st Store, e ast.Expr, p permission.Permission, perm *permission.FuncPermission, owner Owner, deps []Borrowed) (permission.Permission, Owner, []Borrowed, Store) {
+	var err error
+	if st, owner, deps, err = i.moveOrCopy(e, st, p, perm.Receivers[0], owner, deps); err != nil {
+		return i.Errorf(CodeCannotMove, e, "Cannot bind receiver: %s", err)
+	}
+
+	// If we are binding unowned, our function value must be unowned too.
+	if perm.Receivers[0].GetBasePermission()&permission.Owned == 0 {
+		perm = permission.ConvertToBase(perm, perm.GetBasePermission()&^permission.Owned).(*permission.FuncPermission)
+	}
+
+	return stripReceiver(perm), owner, deps, st
+}
+
+// methodSummary returns the summary of the method selected by e, if it is
+// declared in the checked package.
+func (i *Interpreter) methodSummary(e ast.Expr) *permission.FuncPermission {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok || i.typesInfo == nil || i.typesInfo.Selections[sel] == nil {
+		return nil
+	}
+	fn, ok := i.typesInfo.Selections[sel].Obj().(*types.Func)
+	if !ok || i.summaries[fn] == nil || len(i.summaries[fn].Receivers) == 0 {
+		return nil
+	}
+	return i.summaries[fn]
+}
+
 // stripReceiver returns perm with an empty receiver list.
 func stripReceiver(perm *permission.FuncPermission) *permission.FuncPermission {
 	var perm2 permission.FuncPermission
@@ -476,7 +1009,7 @@ func (i *Interpreter) visitCompositeLit(st Store, e *ast.CompositeLit) (permissi
 		st = store
 
 		if st, _, valDeps, err = i.moveOrCopy(e, st, valPerm, typPerm.Fields[index], NoOwner, valDeps); err != nil {
-			return i.Error(value, spew.Sprintf("Cannot bind field: %s in %v", err, typPerm.Fields[index]))
+			return i.Errorf(CodeCannotMove, value, "Cannot bind field: %s", err)
 		}
 		// FIXME(jak): This might conflict with some uses of dependencies which use A depends on B as B contains A.
 		deps = append(deps, valDeps...)
@@ -489,25 +1022,46 @@ func (i *Interpreter) visitFuncLit(st Store, e *ast.FuncLit) (permission.Permiss
 	if i.typeMapper == nil {
 		i.typeMapper = permission.NewTypeMapper()
 	}
+	oldInferring := i.inferring
 	typ := i.typesInfo.TypeOf(e).(*types.Signature)
-	i.curFunc = i.typeMapper.NewFromType(typ).(*permission.FuncPermission)
+	i.curFunc = i.typeMapper.NewFromTypeIn(typ, permission.LocalContext).(*permission.FuncPermission)
+	// Only the results of the function being summarized are inferred.
+	i.inferring = false
 	defer func() {
 		i.curFunc = oldCurFunc
+		i.inferring = oldInferring
 	}()
-	return i.buildFunction(st, e, typ, e.Body)
+	return i.buildFunction(st, e, typ, i.curFunc, e.Body)
 }
 
-func (i *Interpreter) buildFunction(st Store, node ast.Node, typ *types.Signature, body *ast.BlockStmt) (permission.Permission, Owner, []Borrowed, Store) {
+// visitFuncDecl interprets the body of a function declaration, using the
+// given permission for the function, usually its summary.
+func (i *Interpreter) visitFuncDecl(st Store, decl *ast.FuncDecl, perm *permission.FuncPermission) (permission.Permission, Owner, []Borrowed, Store) {
+	oldCurFunc := i.curFunc
+	if i.typeMapper == nil {
+		i.typeMapper = permission.NewTypeMapper()
+	}
+	typ := i.typesInfo.Defs[decl.Name].Type().(*types.Signature)
+	i.curFunc = perm
+	defer func() {
+		i.curFunc = oldCurFunc
+	}()
+	return i.buildFunction(st, decl, typ, perm, decl.Body)
+}
+
+func (i *Interpreter) buildFunction(st Store, node ast.Node, typ *types.Signature, perm *permission.FuncPermission, body *ast.BlockStmt) (permission.Permission, Owner, []Borrowed, Store) {
 	var deps []Borrowed
 	var err error
 	origStore := st
-	perm := i.typeMapper.NewFromType(typ).(*permission.FuncPermission)
-	perm.BasePermission |= permission.Owned
 
-	st = st.BeginBlock()
+	// Deferred calls are per function.
+	st = st.withoutDeferred().BeginBlock()
 	if len(perm.Receivers) > 0 {
 		for _, recv := range perm.Receivers {
-			st, err = st.Define(typ.Recv().Name(), recv)
+			if !isNamed(typ.Recv().Name()) {
+				continue
+			}
+			st, err = st.Define(typ.Recv(), recv)
 			if err != nil {
 				i.Error(node, "Cannot define receiver %s", err)
 			}
@@ -517,42 +1071,67 @@ func (i *Interpreter) buildFunction(st Store, node ast.Node, typ *types.Signatur
 	params := typ.Params()
 	for j := 0; j < params.Len(); j++ {
 		param := params.At(j)
-		st, err = st.Define(param.Name(), perm.Params[j])
+		if !isNamed(param.Name()) {
+			continue
+		}
+		st, err = st.Define(param, perm.Params[j])
 		if err != nil {
 			i.Error(node, "Cannot define parameter %d called %s: %s", j, param.Name(), err)
 		}
 		log.Printf("Defined %s to %s", param.Name(), perm.Params[j])
 	}
 
-	exits := i.visitStmtList(st, body.List, false)
-	st = append(NewStore(), origStore...)
+	var exits []StmtExit
+	if i.UseCFG {
+		exits = i.visitStmtCFG(st, body.List...)
+	} else {
+		exits = i.visitStmtList(st, body.List, false)
+	}
+	exits = i.unwindPanics(body, exits)
+	st = origStore
 	for _, exit := range exits {
+		// Falling off the end of the function runs deferred calls as well.
+		if exit.branch == nil {
+			exit.Store = i.runDeferred(body, exit.Store)
+		}
 		exit.Store = exit.Store.EndBlock()
-		if len(exit.Store) != len(origStore) {
-			i.Error(node, "Store in wrong state after exit: expected %d, received %d", len(origStore), len(exit.Store))
+		if exit.Store.Len() != origStore.Len() {
+			i.Error(node, "Store in wrong state after exit: expected %d, received %d", origStore.Len(), exit.Store.Len())
 		}
 
-		for j := range exit.Store {
-			if exit.Store[j].name != origStore[j].name {
-				i.Error(node, "Invalid behavior: Function literal changes name of %d from %s to %s", j, origStore[j].name, exit.Store[j].name)
+		// Entries shared with the original store have not been touched.
+		var changed [][2]*storeEntry
+		exit.Store.changedEntries(origStore, func(k int, e, o *storeEntry) bool {
+			if e.obj != o.obj {
+				i.Error(node, "Invalid behavior: Function literal changes name of %d from %s to %s", k, objectName(o.obj), objectName(e.obj))
 			}
-			if exit.Store[j].eff != origStore[j].eff {
-				i.Error(node, "Invalid behavior: Function literal changes permission of borrowed value %s from %s to %s", exit.Store[j].name, origStore[j].eff, exit.Store[j].eff)
+			changed = append(changed, [2]*storeEntry{e, o})
+			return true
+		})
+		for j := len(changed) - 1; j >= 0; j-- {
+			e, o := changed[j][0], changed[j][1]
+			if !permission.Equal(e.eff, o.eff) {
+				i.Error(node, "Invalid behavior: Function literal changes permission of borrowed value %s from %s to %s", objectName(e.obj), o.eff, e.eff)
 			}
-			if exit.Store[j].eff == nil {
+			if e.eff == nil {
 				continue
 			}
-			if exit.Store[j].uses <= origStore[j].uses {
+			if e.uses <= o.uses {
 				continue
 			}
-			log.Printf("Borrowing %s = %s", st[j].name, exit.Store[j].eff)
-			deps = append(deps, Borrowed{ast.NewIdent(st[j].name), st[j].eff})
-			st[j].eff = permission.ConvertToBase(st[j].eff, 0)
-			log.Printf("Borrowed %s is now %s", st[j].name, st[j].eff)
-			st[j].uses = exit.Store[j].uses
-
-			if exit.Store[j].eff.GetBasePermission()&permission.Owned == 0 && perm.GetBasePermission()&permission.Owned != 0 {
-				log.Printf("Converting function to unowned due to %s", exit.Store[j].name)
+			log.Printf("Borrowing %s = %s", objectName(o.obj), e.eff)
+			deps = append(deps, Borrowed{o.obj, st.GetEffective(o.obj)})
+			uses := e.uses
+			st, _ = st.update(o.obj, func(s *storeEntry) error {
+				s.eff = permission.ConvertToBase(s.eff, 0)
+				s.uses = uses
+				s.why = provenance{node.Pos(), "captured by a closure"}
+				return nil
+			})
+			log.Printf("Borrowed %s is now %s", objectName(o.obj), st.GetEffective(o.obj))
+
+			if e.eff.GetBasePermission()&permission.Owned == 0 && perm.GetBasePermission()&permission.Owned != 0 {
+				log.Printf("Converting function to unowned due to %s", objectName(e.obj))
 				perm = permission.ConvertToBase(perm, perm.GetBasePermission()&^permission.Owned).(*permission.FuncPermission)
 			}
 		}
@@ -563,15 +1142,86 @@ func (i *Interpreter) buildFunction(st Store, node ast.Node, typ *types.Signatur
 	return perm, NoOwner, deps, st
 }
 
+// isNamed checks whether a receiver or parameter name can be referred to.
+func isNamed(name string) bool {
+	return name != "" && name != "_"
+}
+
+// unwindPanics handles the exits of a function body that do not return. Calls
+// like os.Exit() just end the program, but a panic or runtime.Goexit() runs
+// the calls deferred on its path first. If one of them calls recover() in a
+// panic, the function returns normally from there.
+//
+// The deferred calls run against the store of each panic, so their errors
+// refer to the state at that panic. The function then returns with the union
+// of the stores of all recovered panics, as a single exit.
+func (i *Interpreter) unwindPanics(body *ast.BlockStmt, exits []StmtExit) []StmtExit {
+	var out []StmtExit
+	var recovered *Store
+	for _, exit := range exits {
+		stmt, ok := exit.branch.(*ast.ExprStmt)
+		if !ok {
+			out = append(out, exit)
+			continue
+		}
+		kind := i.exitKindOf(stmt.X.(*ast.CallExpr))
+		if kind == exitsProgram {
+			continue
+		}
+		st := i.runDeferred(body, exit.Store)
+		if kind != panics || !recovers(exit.Store.deferred) {
+			continue
+		}
+		if recovered != nil {
+			merged, err := recovered.Merge(st)
+			if err != nil {
+				i.Errorf(CodeCannotMerge, stmt, "Cannot merge with the other recovered panics: %s", err)
+			}
+			st = merged
+		}
+		recovered = &st
+	}
+	if recovered != nil {
+		out = append(out, StmtExit{*recovered, nil})
+	}
+	return out
+}
+
+// recovers checks whether one of the deferred calls recovers from panics.
+func recovers(deferred []deferredCall) bool {
+	for _, call := range deferred {
+		if call.recovers {
+			return true
+		}
+	}
+	return false
+}
+
 // StmtExit is a store with an optional field specifying any early exit from a block, like
 // a return, goto, or a continue. The idea is simple: Each block handler checks if it should
 // handle such a branch, and do that or pass it up to the upper layer.
+//
+// Calls that do not return, like panic(), are exits too, with the expression statement
+// as their branch.
 type StmtExit struct {
 	Store
-	branch ast.Stmt // *ReturnStmt or *BranchStmt, or nil if normal exit
+	branch ast.Stmt // *ReturnStmt, *BranchStmt, *ExprStmt, or nil if normal exit
+}
+
+// visitStmt interprets a statement. If errors are recorded, a statement with
+// an error is treated as if it had not been executed, see recoverError().
+func (i *Interpreter) visitStmt(st Store, stmt ast.Stmt) (exits []StmtExit) {
+	if st, ok := i.recoverError(st, func() { exits = i.visitStmtUnrecovered(st, stmt) }); !ok {
+		// A return statement still returns.
+		if stmt, isReturn := stmt.(*ast.ReturnStmt); isReturn {
+			return []StmtExit{{st, stmt}}
+		}
+		return []StmtExit{{st, nil}}
+	}
+	return exits
 }
 
-func (i *Interpreter) visitStmt(st Store, stmt ast.Stmt) []StmtExit {
+func (i *Interpreter) visitStmtUnrecovered(st Store, stmt ast.Stmt) []StmtExit {
 	switch stmt := stmt.(type) {
 	case nil:
 		return []StmtExit{{st, nil}}
@@ -629,22 +1279,46 @@ func (i *Interpreter) visitBlockStmt(st Store, stmt *ast.BlockStmt) []StmtExit {
 }
 
 func (i *Interpreter) visitCaseClause(st Store, stmt *ast.CaseClause) []StmtExit {
+	return i.visitStmtList(i.visitCaseList(st, stmt.List), stmt.Body, false)
+}
+
+// visitCaseList evaluates the alternatives A, B, C, ... of a case clause. Each
+// one is only evaluated if the previous ones did not match, so the result is
+// the merge of the stores after each alternative.
+func (i *Interpreter) visitCaseList(st Store, list []ast.Expr) Store {
 	var err error
 	var mergedStore Store
-	// List of alternatives A, B, C, ...
-	for _, e := range stmt.List {
-		perm, deps, store := i.visitExprOwnerToDeps(st, e)
-		st = store
-		i.Assert(e, perm, permission.Read)
-		st = i.Release(e, st, deps)
+	if len(list) == 0 {
+		return st
+	}
+	for _, e := range list {
+		st = i.visitCondition(st, e)
 		if mergedStore, err = mergedStore.Merge(st); err != nil {
-			i.Error(e, "Could not merge with previous results: %s", err)
+			i.Errorf(CodeCannotMerge, e, "Could not merge with previous results: %s", err)
 		}
 	}
-	return i.visitStmtList(mergedStore, stmt.Body, false)
+	return mergedStore
+}
+
+// visitCondition evaluates a condition, which must be readable. Anything
+// borrowed for it is released afterwards.
+func (i *Interpreter) visitCondition(st Store, cond ast.Expr) Store {
+	perm, deps, st := i.visitExprOwnerToDeps(st, cond)
+	i.Assert(cond, perm, permission.Read)
+	return i.Release(cond, st, deps)
 }
 
 func (i *Interpreter) visitExprStmt(st Store, stmt *ast.ExprStmt) []StmtExit {
+	// A call that does not return only needs its arguments evaluated, the
+	// function is not coming back anyway.
+	if call, ok := stmt.X.(*ast.CallExpr); ok && i.isNoReturnCall(call) {
+		for _, arg := range call.Args {
+			perm, deps, store := i.visitExprOwnerToDeps(st, arg)
+			i.Assert(arg, perm, permission.Read)
+			st = i.Release(arg, store, deps)
+		}
+		return []StmtExit{{st, stmt}}
+	}
 	_, deps, st := i.visitExprOwnerToDeps(st, stmt.X)
 	st = i.Release(stmt.X, st, deps)
 	return []StmtExit{{st, nil}}
@@ -657,9 +1331,7 @@ func (i *Interpreter) visitIfStmt(st Store, stmt *ast.IfStmt) []StmtExit {
 		i.Error(stmt.Init, "Initializer to if statement has %d exits", len(exits))
 	}
 	st = exits[0].Store // assert len(exits) == 1
-	perm, deps, st := i.visitExprOwnerToDeps(st, stmt.Cond)
-	i.Assert(stmt.Cond, perm, permission.Read)
-	st = i.Release(stmt.Cond, st, deps)
+	st = i.visitCondition(st, stmt.Cond)
 
 	exitsThen := i.visitStmt(st, stmt.Body)
 	exitsElse := i.visitStmt(st, stmt.Else)
@@ -670,8 +1342,8 @@ func (i *Interpreter) visitIfStmt(st Store, stmt *ast.IfStmt) []StmtExit {
 	for i := range exitsElse {
 		exitsElse[i].Store = exitsElse[i].Store.EndBlock()
 	}
-	log.Printf("then a is now: %v", exitsThen[0].GetEffective("a"))
-	log.Printf("else a is now: %v", exitsElse[0].GetEffective("a"))
+	log.Printf("then store is now: %v", exitsThen[0].Store)
+	log.Printf("else store is now: %v", exitsElse[0].Store)
 
 	out := append(exitsThen, exitsElse...)
 
@@ -687,32 +1359,68 @@ type work struct {
 	int
 }
 
+// blockManager manages the work list of stores to interpret the statements
+// of a block or loop in. To ensure termination, stores for a statement that
+// has already been visited mergeAfter times are merged with the previous
+// store for the statement, and widened once it has been visited widenAfter
+// times. The number of iterations is limited as well.
 type blockManager struct {
+	i     *Interpreter
+	node  ast.Node // The block or loop, for diagnostics
 	todo  []work
-	seen  []work
+	seen  map[uint64][]work // keyed by statement and hash of the store
 	exits []StmtExit
+
+	visits     map[int]int   // number of stores a statement was visited with
+	last       map[int]Store // store a statement was last visited with
+	iterations int
+}
+
+// newBlockManager creates a block manager for the given block or loop.
+func (i *Interpreter) newBlockManager(node ast.Node) *blockManager {
+	return &blockManager{i: i, node: node, visits: make(map[int]int), last: make(map[int]Store)}
 }
 
 func (bm *blockManager) isDuplicate(start work) bool {
-	for _, sn := range bm.seen {
+	key := mixHash(start.Hash(), uint64(start.int))
+	for _, sn := range bm.seen[key] {
 		if sn.int == start.int && sn.Store.Equal(start.Store) {
 			return true
 		}
 	}
-	bm.seen = append(bm.seen, start)
+	if bm.seen == nil {
+		bm.seen = make(map[uint64][]work)
+	}
+	bm.seen[key] = append(bm.seen[key], start)
 	return false
 }
 
 func (bm *blockManager) nextWork() (work, Store) {
+	if maxIterations := bm.i.maxIterations(); bm.iterations+1 > maxIterations {
+		bm.i.Errorf(CodeNoConvergence, bm.node, "Permissions did not stabilize after %d iterations, giving up", maxIterations)
+	}
+	bm.iterations++
 	last := (bm.todo)[len(bm.todo)-1]
 	bm.todo = (bm.todo)[:len(bm.todo)-1]
 	return last, last.Store
 }
 
 func (bm *blockManager) addWork(todo ...work) {
+	var err error
 	for _, w := range todo {
+		switch {
+		case bm.visits[w.int] >= widenAfter:
+			w.Store, err = bm.last[w.int].Widen(w.Store)
+		case bm.visits[w.int] >= mergeAfter:
+			w.Store, err = bm.last[w.int].Merge(w.Store)
+		}
+		if err != nil {
+			bm.i.Errorf(CodeCannotMerge, bm.node, "Cannot widen store: %s", err)
+		}
 		if !bm.isDuplicate(w) {
 			bm.todo = append(bm.todo, w)
+			bm.visits[w.int]++
+			bm.last[w.int] = w.Store
 		}
 	}
 }
@@ -736,11 +1444,12 @@ func collectLabels(stmts []ast.Stmt) map[string]int {
 }
 
 func (i *Interpreter) visitStmtList(initStore Store, stmts []ast.Stmt, isASwitch bool) []StmtExit {
-	var bm blockManager
-
 	if len(stmts) == 0 {
 		return []StmtExit{{initStore, nil}}
-	} else if isASwitch {
+	}
+
+	bm := i.newBlockManager(stmts[0])
+	if isASwitch {
 		bm.addExit(StmtExit{initStore, nil})
 		for i := range stmts {
 			bm.addWork(work{initStore, i})
@@ -753,7 +1462,7 @@ func (i *Interpreter) visitStmtList(initStore Store, stmts []ast.Stmt, isASwitch
 	for bm.hasWork() {
 		item, _ := bm.nextWork()
 
-		log.Printf("Visiting statement %d of %d in %v", item.int, len(stmts), item.Store.GetEffective("a"))
+		log.Printf("Visiting statement %d of %d in %v", item.int, len(stmts), item.Store)
 		exits := i.visitStmt(item.Store, stmts[item.int])
 		log.Printf("Leaving statement with %d exits at %d outputs and %d work", len(exits), len(bm.exits), len(bm.todo))
 		for _, exit := range exits {
@@ -764,7 +1473,7 @@ func (i *Interpreter) visitStmtList(initStore Store, stmts []ast.Stmt, isASwitch
 				} else {
 					bm.addExit(StmtExit{exit.Store, nil})
 				}
-			case *ast.ReturnStmt:
+			case *ast.ReturnStmt, *ast.ExprStmt:
 				bm.addExit(exit) // Always exits the block
 			case *ast.BranchStmt:
 				branchingThis := (branch.Label == nil || branch.Label.Name == "" /* | TODO current label */)
@@ -804,16 +1513,37 @@ func (i *Interpreter) visitReturnStmt(st Store, s *ast.ReturnStmt) []StmtExit {
 		// to name in the interpreter (random name for unnamed results) and then look them
 		// up in the store.
 		perm, owner, deps, store := i.VisitExpr(st, s.Results[k])
-		store, owner, _, err := i.moveOrCopy(s, store, perm, i.curFunc.Results[k], owner, deps)
+		target := i.curFunc.Results[k]
+		if i.inferring {
+			// Inferring a summary: The result is whatever we return.
+			i.inferred[k] = i.intersectResult(s, i.inferred[k], perm)
+			target = perm
+		}
+		store, owner, _, err := i.moveOrCopy(s, store, perm, target, owner, deps)
 		if err != nil {
-			i.Error(s, "Cannot bind return value %d: %s", k, err)
+			i.Errorf(CodeCannotMove, s, "Cannot bind return value %d: %s", k, err)
 		}
 		st = store
 	}
+	// Deferred calls run after the results have been bound.
+	st = i.runDeferred(s, st)
 	// A return statement is a singular exit.
 	return []StmtExit{{st, s}}
 }
 
+// intersectResult intersects a returned permission into the permission
+// inferred for the result so far, if any.
+func (i *Interpreter) intersectResult(s *ast.ReturnStmt, inferred, perm permission.Permission) permission.Permission {
+	if inferred == nil {
+		return perm
+	}
+	result, err := permission.Intersect(inferred, perm)
+	if err != nil {
+		i.Errorf(CodeCannotMerge, s, "Cannot infer result permission: %s", err)
+	}
+	return result
+}
+
 func (i *Interpreter) visitIncDecStmt(st Store, stmt *ast.IncDecStmt) []StmtExit {
 	p, deps, st := i.visitExprOwnerToDeps(st, stmt.X)
 	i.Assert(stmt.X, p, permission.Read|permission.Write)
@@ -833,7 +1563,7 @@ func (i *Interpreter) visitSendStmt(st Store, stmt *ast.SendStmt) []StmtExit {
 
 	st, valOwner, valDeps, err := i.moveOrCopy(stmt, st, val, chn.ElementPermission, valOwner, valDeps)
 	if err != nil {
-		i.Error(stmt, "Cannot send value: %v", err)
+		i.Errorf(CodeCannotMove, stmt, "Cannot send value: %v", err)
 	}
 
 	st = i.Release(stmt.Value, st, []Borrowed{Borrowed(valOwner)})
@@ -883,7 +1613,7 @@ func (i *Interpreter) defineOrAssignMany(st Store, stmt ast.Stmt, lhsExprs []ast
 			st = store
 
 			if err != nil {
-				i.Error(expr, "Could not move value: %s", err)
+				i.Errorf(CodeCannotMove, expr, "Could not move value: %s", err)
 			}
 
 			deps = append(deps, Borrowed(ownerThis))
@@ -895,8 +1625,7 @@ func (i *Interpreter) defineOrAssignMany(st Store, stmt ast.Stmt, lhsExprs []ast
 	for elem := len(rhs); elem < len(lhsExprs); elem++ {
 		var perm permission.Permission
 
-		perm = i.typeMapper.NewFromType(i.typesInfo.TypeOf(lhsExprs[elem]))
-		perm = permission.ConvertToBase(perm, perm.GetBasePermission()|permission.Owned) //FIXME
+		perm = i.typeMapper.NewFromTypeIn(i.typesInfo.TypeOf(lhsExprs[elem]), permission.LocalContext)
 
 		rhs = append(rhs, perm)
 
@@ -927,22 +1656,34 @@ func (i *Interpreter) defineOrAssign(st Store, stmt ast.Stmt, lhs ast.Expr, rhs
 		if isDefine {
 			log.Println("Defining", ident.Name)
 			if ann, ok := i.AnnotatedPermissions[ident]; ok {
-				if ann, err = permission.ConvertTo(rhs, ann); err != nil {
-					st, err = st.Define(ident.Name, ann)
+				perm, convErr := permission.ConvertTo(rhs, ann)
+				if convErr != nil {
+					// Report the annotation, and define the variable as if
+					// it was not annotated.
+					var at ast.Node = ident
+					if cmt := i.annotationComments[ident]; cmt != nil {
+						at = cmt
+					}
+					st, _ = i.recoverError(st, func() {
+						i.Errorf(CodeBadPermission, at, "Cannot use permission %s for variable %s: %s", ann, ident.Name, convErr)
+					})
+					perm = rhs
 				}
+				st, err = st.Define(i.objectOf(ident), perm)
 			} else {
-				st, err = st.Define(ident.Name, rhs)
+				st, err = st.Define(i.objectOf(ident), rhs)
 			}
 		} else {
-			if permission.CopyableTo(rhs, st.GetMaximum(ident.Name)) {
-				st, err = st.SetEffective(ident.Name, st.GetMaximum(ident.Name))
+			obj := i.objectOf(ident)
+			if permission.CopyableTo(rhs, st.GetMaximum(obj)) {
+				st, err = st.SetEffective(obj, st.GetMaximum(obj))
 			} else {
-				st, err = st.SetEffective(ident.Name, rhs)
+				st, err = st.SetEffective(obj, rhs)
 			}
 		}
 
 		if err != nil {
-			i.Error(lhs, "Could not assign or define: %s", err)
+			i.Errorf(CodeCannotMove, lhs, "Could not assign or define: %s", err)
 		}
 	} else if isDefine {
 		i.Error(lhs, "Cannot define: Left-hand side is not an identifier")
@@ -959,7 +1700,7 @@ func (i *Interpreter) defineOrAssign(st Store, stmt ast.Stmt, lhs ast.Expr, rhs
 	// Input deps are nil, so we can ignore them here.
 	st, owner, deps, err = i.moveOrCopy(lhs, st, rhs, perm, owner, deps)
 	if err != nil {
-		i.Error(lhs, "Could not assign or define: %s", err)
+		i.Errorf(CodeCannotMove, lhs, "Could not assign or define: %s", err)
 	}
 
 	log.Println("Assigned", lhs, "in", st)
@@ -968,7 +1709,7 @@ func (i *Interpreter) defineOrAssign(st Store, stmt ast.Stmt, lhs ast.Expr, rhs
 }
 
 func (i *Interpreter) visitRangeStmt(initStore Store, stmt *ast.RangeStmt) (rangeExits []StmtExit) {
-	var bm blockManager
+	bm := i.newBlockManager(stmt)
 	var canRelease = true
 
 	bm.addExit(StmtExit{initStore, nil})
@@ -985,52 +1726,19 @@ func (i *Interpreter) visitRangeStmt(initStore Store, stmt *ast.RangeStmt) (rang
 		}
 	}()
 	i.Assert(stmt.X, perm, permission.Read)
-	log.Printf("Borrowed container, a is now %s", initStore.GetEffective("a"))
+	log.Printf("Borrowed container, store is now %v", initStore)
 
-	var rkey permission.Permission
-	var rval permission.Permission
-
-	switch perm := perm.(type) {
-	case *permission.ArrayPermission:
-		rkey = permission.Mutable
-		rval = perm.ElementPermission
-	case *permission.SlicePermission:
-		rkey = permission.Mutable
-		rval = perm.ElementPermission
-	case *permission.MapPermission:
-		rkey = perm.KeyPermission
-		rval = perm.ValuePermission
-	}
+	rkey, rval := rangePermissions(perm)
 
 	bm.addWork(work{initStore, 0})
 
 	for bm.hasWork() {
 		_, st := bm.nextWork()
-		log.Printf("Iterating %s", st.GetEffective("a"))
+		log.Printf("Iterating %v", st)
 
 		st = st.BeginBlock()
-		if stmt.Key != nil {
-			st, _, _ = i.defineOrAssign(st, stmt, stmt.Key, rkey, NoOwner, nil, stmt.Tok == token.DEFINE, stmt.Tok == token.DEFINE)
-			if ident, ok := stmt.Key.(*ast.Ident); ok {
-				log.Printf("Defined %s to %s", ident.Name, st.GetEffective(ident.Name))
-				if ident.Name != "_" {
-					canRelease = canRelease && (st.GetEffective(ident.Name).GetBasePermission()&permission.Owned == 0)
-				}
-			} else {
-				canRelease = false
-			}
-		}
-		if stmt.Value != nil {
-			st, _, _ = i.defineOrAssign(st, stmt, stmt.Value, rval, NoOwner, nil, stmt.Tok == token.DEFINE, stmt.Tok == token.DEFINE)
-			if ident, ok := stmt.Value.(*ast.Ident); ok {
-				log.Printf("Defined %s to %s", ident.Name, st.GetEffective(ident.Name))
-				if ident.Name != "_" {
-					canRelease = canRelease && (st.GetEffective(ident.Name).GetBasePermission()&permission.Owned == 0)
-				}
-			} else {
-				canRelease = false
-			}
-		}
+		st, ok := i.defineRangeVars(st, stmt, rkey, rval)
+		canRelease = canRelease && ok
 
 		exits := i.visitStmt(st, stmt.Body)
 		i.endBlocks(exits)
@@ -1039,7 +1747,7 @@ func (i *Interpreter) visitRangeStmt(initStore Store, stmt *ast.RangeStmt) (rang
 		// Each next iteration is also possible work. This might generate duplicate exits, but we have
 		// to do it this way, as we might otherwise miss some exits
 		for _, iter := range nextIterations {
-			log.Printf("Appending output with a = %s", st.GetEffective("a"))
+			log.Printf("Appending output with store %v", st)
 			bm.addExit(StmtExit{iter.Store, nil})
 		}
 		bm.addWork(nextIterations...)
@@ -1050,6 +1758,50 @@ func (i *Interpreter) visitRangeStmt(initStore Store, stmt *ast.RangeStmt) (rang
 	return bm.exits
 }
 
+// rangePermissions returns the permissions of the keys and values when
+// ranging over a container with the given permission.
+func rangePermissions(perm permission.Permission) (rkey, rval permission.Permission) {
+	switch perm := perm.(type) {
+	case *permission.ArrayPermission:
+		rkey = permission.Mutable
+		rval = perm.ElementPermission
+	case *permission.SlicePermission:
+		rkey = permission.Mutable
+		rval = perm.ElementPermission
+	case *permission.MapPermission:
+		rkey = perm.KeyPermission
+		rval = perm.ValuePermission
+	}
+	return rkey, rval
+}
+
+// defineRangeVars defines or assigns the key and value of a range statement
+// for an iteration. It also returns whether the container can be released
+// after the loop, which is not the case if an owned key or value was taken
+// out of it.
+func (i *Interpreter) defineRangeVars(st Store, stmt *ast.RangeStmt, rkey, rval permission.Permission) (Store, bool) {
+	canRelease := true
+	vars := []struct {
+		expr ast.Expr
+		perm permission.Permission
+	}{{stmt.Key, rkey}, {stmt.Value, rval}}
+	for _, v := range vars {
+		if v.expr == nil {
+			continue
+		}
+		st, _, _ = i.defineOrAssign(st, stmt, v.expr, v.perm, NoOwner, nil, stmt.Tok == token.DEFINE, stmt.Tok == token.DEFINE)
+		if ident, ok := v.expr.(*ast.Ident); ok {
+			log.Printf("Defined %s to %s", ident.Name, st.GetEffective(i.objectOf(ident)))
+			if ident.Name != "_" {
+				canRelease = canRelease && (st.GetEffective(i.objectOf(ident)).GetBasePermission()&permission.Owned == 0)
+			}
+		} else {
+			canRelease = false
+		}
+	}
+	return st, canRelease
+}
+
 // collectLoopExits splits a given set of block exits into exits out of the current loop (breaks, returns, etc)
 // and further iterations of the loop.
 func (i *Interpreter) collectLoopExits(exits []StmtExit) ([]work, []StmtExit) {
@@ -1060,7 +1812,7 @@ func (i *Interpreter) collectLoopExits(exits []StmtExit) ([]work, []StmtExit) {
 		switch branch := exit.branch.(type) {
 		case nil:
 			nextIterations = append(nextIterations, work{exit.Store, 0})
-		case *ast.ReturnStmt:
+		case *ast.ReturnStmt, *ast.ExprStmt:
 			realExits = append(realExits, exit)
 		case *ast.BranchStmt:
 			branchingThis := branch.Label == nil || branch.Label.Name == "" /* | TODO current label */
@@ -1129,7 +1881,7 @@ func (i *Interpreter) visitCommClause(st Store, stmt *ast.CommClause) []StmtExit
 }
 
 func (i *Interpreter) visitForStmt(initStore Store, stmt *ast.ForStmt) (rangeExits []StmtExit) {
-	var bm blockManager
+	bm := i.newBlockManager(stmt)
 
 	initStore = initStore.BeginBlock()
 
@@ -1145,11 +1897,10 @@ func (i *Interpreter) visitForStmt(initStore Store, stmt *ast.ForStmt) (rangeExi
 		_, st := bm.nextWork()
 		log.Printf("for: Told to iterate %v", st)
 		// Check condition
-		perm, deps, st := i.visitExprOwnerToDeps(st, stmt.Cond)
-		i.Assert(stmt.Cond, perm, permission.Read)
-		st = i.Release(stmt.Cond, st, deps)
-		// There might be no more items, exit
-		bm.addExit(StmtExit{st, nil})
+		st = i.visitCondition(st, stmt.Cond)
+		// There might be no more items, exit. The exit leaves the block
+		// of the init statement, like the exits of the body do.
+		bm.addExit(StmtExit{st.EndBlock(), nil})
 
 		exits := i.visitStmt(st, stmt.Body)
 
@@ -1183,16 +1934,45 @@ func (i *Interpreter) visitDeferStmt(st Store, stmt *ast.DeferStmt) []StmtExit {
 	// All deps are gone, except for captured unowned variables, they can be released
 	// again, since they will by definition be available at the end of the function
 	// when the call is to be executed.
+	var released []Borrowed
 	_, _, deps, st := i.visitCallExpr(st, stmt.Call, true)
 	for _, dep := range deps {
 		if dep.perm.GetBasePermission()&permission.Owned == 0 {
 			st = i.Release(stmt.Call, st, []Borrowed{dep})
+			released = append(released, dep)
 		}
 	}
 
+	// Loops might visit the statement multiple times, but it only needs to
+	// be replayed once per exit.
+	st = st.addDeferred(deferredCall{stmt, released, i.callsRecover(stmt.Call)})
+
 	return []StmtExit{{st, nil}}
 }
 
+// runDeferred replays the pending deferred calls in LIFO order against the
+// store of a function exit. The unowned values a deferred call captured must
+// still be available at that point, otherwise they have been moved away while
+// the call was pending. The calls have run then, so none are pending in the
+// returned store.
+func (i *Interpreter) runDeferred(node ast.Node, st Store) Store {
+	var err error
+	for k := len(st.deferred) - 1; k >= 0; k-- {
+		call := st.deferred[k]
+		for _, dep := range call.released {
+			perm, owner, deps, store := i.borrow(node, st, dep.obj)
+			st, owner, deps, err = i.moveOrCopy(node, store, perm, dep.perm, owner, deps)
+			if err != nil {
+				i.errorRelated(CodeDeferredCall, node, []relatedNode{{call.stmt.Pos(), "deferred here"}}, "Deferred call cannot use %s anymore: %s", dep.obj.Name(), err)
+			}
+			// The deferred call has completed, so we can release it again.
+			st = i.Release(node, st, []Borrowed{Borrowed(owner)})
+			st = i.Release(node, st, deps)
+		}
+	}
+	return st.withoutDeferred()
+}
+
 func (i *Interpreter) visitDeclStmt(st Store, stmt *ast.DeclStmt) []StmtExit {
 	decl, ok := stmt.Decl.(*ast.GenDecl)
 	if !ok {
@@ -6,6 +6,7 @@ package capabilities
 import (
 	"fmt"
 	"go/ast"
+	"go/importer"
 	"go/parser"
 	"go/token"
 	"go/types"
@@ -72,10 +73,8 @@ func newPermission(input interface{}) permission.Permission {
 }
 
 func TestVisitIdent(t *testing.T) {
-	st := Store{
-		{"x", newPermission("om[]om"), newPermission("om"), 0},
-	}
 	i := &Interpreter{}
+	st := NewStore().push(storeEntry{obj: i.objectOf(ast.NewIdent("x")), eff: newPermission("om[]om"), max: newPermission("om")})
 	runFuncRecover(t, "Unknown variable", func() {
 		i.VisitExpr(st, ast.NewIdent("a"))
 	})
@@ -134,7 +133,7 @@ func TestVisitExpr(t *testing.T) {
 		{"a[b]", "notIndexable", "or", "ov", errorResult("Indexing unknown"), "", nil, "", ""},
 		{"a[b]", "keyNotReadable", "om[] om", "ow", errorResult("Required permission"), "", nil, "", ""},
 		{"a[b]", "indexableNotReadable", "on[] on", "or", errorResult("Required permission"), "", nil, "", ""},
-		{"a[b]", "mutableMapInvalidKey", "or map[om * om]ov", "ov * ov", errorResult("move or copy"), "", nil, "", ""},
+		{"a[b]", "mutableMapInvalidKey", "or map[om * om]ov", "ov * ov", errorResult("Cannot use index: Cannot copy or move: Needed om * om, received ov * ov"), "", nil, "", ""},
 		// ------------------- Star expressions ----------------------------
 		{"*b", "mutablePointer", "", "om * om", "om", "b", []string{}, "", "n * r"},
 		{"*b", "mutablePointerReadTarget", "", "om * or", "or", "b", []string{}, "", "n * r"},
@@ -153,7 +152,7 @@ func TestVisitExpr(t *testing.T) {
 		{"(b)", "parenPoint", nil, "om * om", "om * om", "b", []string{}, nil, "n * r"},
 		// Function calls
 		{"a(b)", "callMutableNoCopy", "om func(om * om) or", "om * om", "or", "", []string{}, "om func(om * om) or", "n * r"},
-		{"a(b, b)", "callMutableNoCopy", "om func(om * om, om * om) or", "om * om", errorResult("Cannot copy or move"), "", []string{}, "om func(om * om, om * om) or", "n * r"},
+		{"a(b, b)", "callMutableNoCopy", "om func(om * om, om * om) or", "om * om", errorResult("Cannot bind parameter 1: Cannot copy or move: Needed om * om, received n * r: value: n is not assignable to om: ownership"), "", []string{}, "om func(om * om, om * om) or", "n * r"},
 		{"a(b)", "callMutableNoCopyUnowned", "om func(m * m) or", "om * om", "or", "", []string{}, "om func(m * m) or", "om * om"},
 		{"a(b)", "callMutableNoCopyUnownedToUnownedReadable", "om func(r * r) or", "om * om", "or", "", []string{}, "om func(r * r) or", "om * om"},
 		{"a(b, b)", "callMutableNoCopyUnownedToUnownedReadable", "om func(r * r, r * r) or", "om * om", errorResult("Cannot copy or move"), "", []string{}, "om func(r * r, r * r) or", "om * om"},
@@ -266,10 +265,10 @@ func TestVisitExpr(t *testing.T) {
 			})
 
 			if lhs != nil && test.lhs != nil {
-				st, _ = st.Define(lhs.Name, newPermission(test.lhs))
+				st, _ = st.Define(i.objectOf(lhs), newPermission(test.lhs))
 			}
 			if rhs != nil && test.rhs != nil {
-				st, _ = st.Define(rhs.Name, newPermission(test.rhs))
+				st, _ = st.Define(i.objectOf(rhs), newPermission(test.rhs))
 			}
 
 			if eResult, ok := test.result.(errorResult); ok {
@@ -282,7 +281,7 @@ func TestVisitExpr(t *testing.T) {
 			perm, owner, deps, store := i.VisitExpr(st, e)
 			ownerName := ""
 			if owner != NoOwner {
-				ownerName = owner.id.Name
+				ownerName = owner.obj.Name()
 			}
 
 			if ownerName != test.owner {
@@ -296,18 +295,18 @@ func TestVisitExpr(t *testing.T) {
 			// Check dependencies
 			depsAsString := make([]string, len(deps))
 			for i := range deps {
-				depsAsString[i] = deps[i].id.Name
+				depsAsString[i] = deps[i].obj.Name()
 			}
 
 			if !reflect.DeepEqual(depsAsString, test.dependencies) {
 				t.Errorf("Found dependencies %v, expected %v", depsAsString, test.dependencies)
 			}
 
-			if lhs != nil && !reflect.DeepEqual(store.GetEffective(lhs.Name), newPermission(test.lhsAfter)) {
-				t.Error(spew.Errorf("Found lhs after = %v, expected %v", store.GetEffective(lhs.Name), newPermission(test.lhsAfter)))
+			if lhs != nil && !reflect.DeepEqual(store.GetEffective(i.objectOf(lhs)), newPermission(test.lhsAfter)) {
+				t.Error(spew.Errorf("Found lhs after = %v, expected %v", store.GetEffective(i.objectOf(lhs)), newPermission(test.lhsAfter)))
 			}
-			if rhs != nil && !reflect.DeepEqual(store.GetEffective(rhs.Name), newPermission(test.rhsAfter)) {
-				t.Error(spew.Errorf("Found rhs after = %v, expected %v", store.GetEffective(rhs.Name), newPermission(test.rhsAfter)))
+			if rhs != nil && !reflect.DeepEqual(store.GetEffective(i.objectOf(rhs)), newPermission(test.rhsAfter)) {
+				t.Error(spew.Errorf("Found rhs after = %v, expected %v", store.GetEffective(i.objectOf(rhs)), newPermission(test.rhsAfter)))
 			}
 		})
 
@@ -326,17 +325,101 @@ func TestRelease(t *testing.T) {
 	var i Interpreter
 	var st Store
 	runFuncRecover(t, "not release borrowed variable", func() {
-		st, _ = st.Define("a", newPermission("om"))
+		a := i.objectOf(ast.NewIdent("a"))
+		st, _ = st.Define(a, newPermission("om"))
 		i.Release(ast.NewIdent("a"), st, []Borrowed{
-			{ast.NewIdent("a"), newPermission("om * om")},
+			{a, newPermission("om * om")},
 		})
 	})
 }
 
+func TestRecoverError_poisoned(t *testing.T) {
+	var errors []*interpreterError
+	i := &Interpreter{
+		onError:  func(err *interpreterError) { errors = append(errors, err) },
+		reported: make(map[ast.Node]bool),
+		poisoned: make(map[types.Object]bool),
+	}
+	st := NewStore()
+	st, _ = st.Define(i.objectOf(ast.NewIdent("a")), newPermission("om * om"))
+	st, _ = st.Define(i.objectOf(ast.NewIdent("b")), newPermission("om * om"))
+	fail := func(node ast.Expr) {
+		st, _ = i.recoverError(st, func() { i.Error(node, "failed") })
+	}
+
+	fail(ast.NewIdent("a"))
+	// Follow-up errors about a are hidden.
+	fail(ast.NewIdent("a"))
+	fail(&ast.StarExpr{X: ast.NewIdent("a")})
+	fail(&ast.SelectorExpr{X: ast.NewIdent("a"), Sel: ast.NewIdent("x")})
+	// Errors about something else are not, even if they involve a.
+	fail(&ast.IndexExpr{X: ast.NewIdent("b"), Index: ast.NewIdent("a")})
+	fail(&ast.BinaryExpr{X: ast.NewIdent("a"), Op: token.ADD, Y: ast.NewIdent("b")})
+
+	if len(errors) != 3 {
+		t.Errorf("Expected 3 errors, received %v", errors)
+	}
+}
+
+func TestRunDeferred_once(t *testing.T) {
+	// After unwinding a recovered panic, the function returns normally,
+	// which must not replay the deferred calls again.
+	i := &Interpreter{}
+	st := NewStore().addDeferred(deferredCall{stmt: &ast.DeferStmt{}})
+	if st = i.runDeferred(&ast.BlockStmt{}, st); len(st.deferred) != 0 {
+		t.Errorf("Deferred calls still pending after running them: %v", st.deferred)
+	}
+}
+
+func TestUnwindPanics_merge(t *testing.T) {
+	panicIdent := ast.NewIdent("panic")
+	i := &Interpreter{typesInfo: &types.Info{Uses: map[*ast.Ident]types.Object{panicIdent: types.Universe.Lookup("panic")}}}
+	panicStmt := &ast.ExprStmt{X: &ast.CallExpr{Fun: panicIdent}}
+	returnStmt := &ast.ReturnStmt{}
+	a := newVar("a")
+	exit := func(perm string, branch ast.Stmt) StmtExit {
+		st, _ := NewStore().Define(a, newPermission(perm))
+		st = st.addDeferred(deferredCall{stmt: &ast.DeferStmt{}, recovers: true})
+		return StmtExit{st, branch}
+	}
+
+	// The recovered panics return as a single exit, with the union of
+	// their stores.
+	exits := i.unwindPanics(&ast.BlockStmt{}, []StmtExit{exit("om * om", panicStmt), exit("om * om", returnStmt), exit("or * or", panicStmt)})
+	if len(exits) != 2 || exits[0].branch != returnStmt || exits[1].branch != nil {
+		t.Fatalf("Expected the return and one recovered exit, received %v", exits)
+	}
+	if perm := exits[1].GetEffective(a); !permission.Equal(perm, newPermission("or * or")) {
+		t.Errorf("Expected or * or for a, received %v", perm)
+	}
+}
+
+func TestBlockManager_addWork(t *testing.T) {
+	a := newVar("a")
+	st, _ := NewStore().Define(a, newPermission("om * om"))
+	next, _ := st.SetEffective(a, newPermission("om * or"))
+	for _, test := range []struct {
+		visits int
+		expect string
+	}{
+		{mergeAfter - 1, "om * or"},
+		{mergeAfter, "om * or"},
+		{widenAfter, "n * n"},
+	} {
+		bm := (&Interpreter{}).newBlockManager(nil)
+		bm.visits[0] = test.visits
+		bm.last[0] = st
+		bm.addWork(work{next, 0})
+		if perm := bm.todo[0].GetEffective(a); !permission.Equal(perm, newPermission(test.expect)) {
+			t.Errorf("After %d visits, expected %s for a, received %v", test.visits, test.expect, perm)
+		}
+	}
+}
+
 func TestVisitSelectorExprOne_impossible(t *testing.T) {
 	i := &Interpreter{}
 	runFuncRecover(t, "nvalid kind", func() {
-		i.visitSelectorExprOne(nil, ast.NewIdent("error"), nil, -1, -42, NoOwner, nil)
+		i.visitSelectorExprOne(NewStore(), ast.NewIdent("error"), nil, -1, -42, NoOwner, nil)
 	})
 }
 
@@ -344,7 +427,7 @@ func TestVisitCompositeLit_errors(t *testing.T) {
 	i := &Interpreter{}
 	var st Store
 
-	st, _ = st.Define("T", newPermission("om struct {om}"))
+	st, _ = st.Define(i.objectOf(ast.NewIdent("T")), newPermission("om struct {om}"))
 	fset := token.NewFileSet()
 	file, err := parser.ParseFile(fset, "test", "package test\n\n type T struct { x int }\n\nvar x= T { x: 5 }", 0)
 	if err != nil {
@@ -531,7 +614,7 @@ func TestVisitStmt(t *testing.T) {
 			},
 			"func main(a int) int { a++; return a; }",
 			[]exitDesc{},
-			"Required permissions a",
+			"Required permissions rw",
 		},
 		{"sendStmt",
 			[]storeItemDesc{
@@ -1208,6 +1291,267 @@ func TestVisitStmt(t *testing.T) {
 			},
 			"",
 		},
+		{"deferMutexUnlock",
+			[]storeItemDesc{
+				{"mu", "om interface{ om (m) func () }"},
+				{"main", "om func (om) n"},
+			},
+			"func main(mu interface { Unlock() }) { defer mu.Unlock() }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"mu", permission.ConvertToBase(newPermission("om interface{ om (m) func () }"), 0)},
+				}, -1},
+			},
+			"",
+		},
+		{"deferFileCloseReturnOther",
+			[]storeItemDesc{
+				{"f", "om interface{ om (m) func () om }"},
+				{"main", "om func (om) om interface {}"},
+			},
+			"func main(f interface { Close() error }) error { defer f.Close(); return nil }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"f", permission.ConvertToBase(newPermission("om interface{ om (m) func () om }"), 0)},
+				}, 81},
+			},
+			"",
+		},
+		{"deferFileCloseReturnClosed",
+			[]storeItemDesc{
+				{"f", "om interface{ om (m) func () om }"},
+				{"main", "om func (om) om"},
+			},
+			"func main(f interface { Close() error }) error { defer f.Close(); return f.Close() }",
+			nil,
+			"Cannot bind receiver",
+		},
+		{"deferFuncLitReturnUnrelated",
+			[]storeItemDesc{
+				{"a", "m * m"},
+				{"f", "om func (m * m) n"},
+				{"main", "om func (om) m * m"},
+			},
+			"func main(a *int, f func(*int)) *int { defer func() { f(a) }(); return nil }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"a", "m * m"},
+					{"f", "n func (m * m) n"},
+				}, 79},
+			},
+			"",
+		},
+		{"deferFuncLitReturnMovesCaptured",
+			[]storeItemDesc{
+				{"a", "m * m"},
+				{"f", "om func (m * m) n"},
+				{"main", "om func (om) m * m"},
+			},
+			"func main(a *int, f func(*int)) *int { defer func() { f(a) }(); return a }",
+			nil,
+			"cannot use a anymore",
+		},
+		{"deferFuncLitEndOfFunctionLiteral",
+			[]storeItemDesc{
+				{"x", "m interface{ om (m) func () }"},
+				{"main", "om func (om) n"},
+			},
+			"func main(x interface { f() }) { func(b interface { f() }) { defer func() { b.f() }(); go b.f() }(x) }",
+			nil,
+			"cannot use b anymore",
+		},
+		{"deferInOtherBranch",
+			[]storeItemDesc{
+				{"a", "m * m"},
+				{"f", "om func (m * m) n"},
+				{"main", "om func (om) m * m"},
+			},
+			"func main(a *int, f func(*int)) *int { if a == nil { defer func() { f(a) }(); return nil }; return a }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"a", "m * m"},
+				}, 93},
+				{[]storeItemDesc{
+					{"a", "n * r"},
+				}, 107},
+			},
+			"",
+		},
+		{"deferInLoopBeforeReturn",
+			[]storeItemDesc{
+				{"a", "m * m"},
+				{"f", "om func (m * m) n"},
+				{"main", "om func (om) m * m"},
+			},
+			"func main(a *int, f func(*int)) *int { for i := 0; i < 2; i++ { if i == 1 { return a }; defer func() { f(a) }() }; return nil }",
+			nil,
+			"cannot use a anymore",
+		},
+		{"panicEndsPath",
+			[]storeItemDesc{
+				{"a", "om * om"},
+				{"main", "om func (om) om * om"},
+			},
+			"func main(a *int) *int { if a == nil { panic(\"nil\") }; return a }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"a", "om * om"},
+				}, 54},
+				{[]storeItemDesc{
+					{"a", "n * r"},
+				}, 70},
+			},
+			"",
+		},
+		{"panicCodeAfterIsUnreachable",
+			[]storeItemDesc{
+				{"a", "om * om"},
+				{"main", "om func (om) om * om"},
+			},
+			"func main(a *int) *int { panic(a); return a }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"a", "om * om"},
+				}, 40},
+			},
+			"",
+		},
+		{"noReturnCall",
+			[]storeItemDesc{
+				{"a", "om * om"},
+				{"main", "om func (om) om * om"},
+			},
+			"import \"log\"; func main(a *int) *int { if a == nil { log.Fatal(\"nil\") }; return a }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"a", "om * om"},
+				}, 68},
+				{[]storeItemDesc{
+					{"a", "n * r"},
+				}, 88},
+			},
+			"",
+		},
+		{"panicRecoverSeesPanicStore",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"func main(b interface { f() }) { func() { defer func() { recover(); b.f() }(); if b != nil { go b.f(); panic(1) } }() }",
+			nil,
+			"cannot use b anymore",
+		},
+		{"panicWithoutRecoverEndsFunction",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"func main(b interface { f() }) { func() { if b != nil { go b.f(); panic(1) } }() }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"b", "m interface{ om (m) func f () }"},
+				}, -1},
+			},
+			"",
+		},
+		{"panicRecoverReturnsNormally",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"func main(b interface { f() }) { func() { defer func() { recover() }(); if b != nil { go b.f(); panic(1) } }() }",
+			nil,
+			"changes permission of borrowed value b",
+		},
+		{"noReturnCallSkipsDeferred",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"import \"os\"; func main(b interface { f() }) { func() { defer func() { b.f() }(); if b != nil { go b.f(); os.Exit(1) } }() }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"b", "m interface{ om (m) func f () }"},
+				}, -1},
+			},
+			"",
+		},
+		{"panicRecoverOnOtherPath",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"func main(b interface { f() }) { func() { if b == nil { defer func() { recover() }() } else { go b.f(); panic(1) } }() }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"b", "m interface{ om (m) func f () }"},
+				}, -1},
+			},
+			"",
+		},
+		{"logPanicRecoverReturnsNormally",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"import \"log\"; func main(b interface { f() }) { func() { defer func() { recover() }(); if b != nil { go b.f(); log.Panic(1) } }() }",
+			nil,
+			"changes permission of borrowed value b",
+		},
+		{"goexitRunsDeferred",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"import \"runtime\"; func main(b interface { f() }) { func() { defer func() { b.f() }(); if b != nil { go b.f(); runtime.Goexit() } }() }",
+			nil,
+			"cannot use b anymore",
+		},
+		{"goexitCannotRecover",
+			[]storeItemDesc{
+				{"b", "m interface{ om (m) func f () }"},
+				{"main", "om func (om) n"},
+			},
+			"import \"runtime\"; func main(b interface { f() }) { func() { defer func() { recover() }(); if b != nil { go b.f(); runtime.Goexit() } }() }",
+			[]exitDesc{
+				{[]storeItemDesc{
+					{"b", "m interface{ om (m) func f () }"},
+				}, -1},
+			},
+			"",
+		},
+		{"callTooManyArguments",
+			[]storeItemDesc{
+				{"a", "om * om"},
+				{"f", "om func (om * om) n"},
+				{"main", "om func (om) n"},
+			},
+			"func main(a *int, f func(*int, *int)) { f(a, a) }",
+			nil,
+			"Too many arguments in call, expected 1",
+		},
+		{"callVariadicNotSlice",
+			[]storeItemDesc{
+				{"a", "om * om"},
+				{"f", "om func (om * om) n"},
+				{"main", "om func (om) n"},
+			},
+			"func main(a *int, f func(...*int)) { f(a, a) }",
+			nil,
+			"Expected a slice permission for the variadic parameter",
+		},
+		{"shadowedVariableIsDistinct",
+			[]storeItemDesc{
+				{"a", "om * om"},
+				{"main", "om func (om * om) om * om"},
+			},
+			"func main(a *int) *int { if a != nil { a := new(int); return a }; return nil }",
+			[]exitDesc{
+				{[]storeItemDesc{{"a", "om * om"}}, 69},
+				{[]storeItemDesc{{"a", "om * om"}}, 81},
+			},
+			"",
+		},
 		{"genDeclTwo",
 			[]storeItemDesc{
 				{"a", "om * om"},
@@ -1250,71 +1594,142 @@ func TestVisitStmt(t *testing.T) {
 		},
 	}
 
-	for _, cs := range testCases {
-		t.Run(cs.name, func(t *testing.T) {
-			if cs.error != "" {
-				defer recoverErrorOrFail(t, cs.error)
-			}
+	run := func(t *testing.T, cs testCase, visit func(i *Interpreter, st Store, body *ast.BlockStmt) []StmtExit, outputs []exitDesc, byPos bool) {
+		if cs.error != "" {
+			defer recoverErrorOrFail(t, cs.error)
+		}
 
-			i := &Interpreter{}
-			var st Store
-			fset := token.NewFileSet()
-			file, err := parser.ParseFile(fset, "test", "package test\n\n"+cs.code, 0)
-			if err != nil {
-				t.Fatalf("Could not parse setup: %s", err)
+		i := &Interpreter{}
+		var st Store
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "test", "package test\n\n"+cs.code, 0)
+		if err != nil {
+			t.Fatalf("Could not parse setup: %s", err)
+		}
+		info := types.Info{
+			Defs:       make(map[*ast.Ident]types.Object),
+			Uses:       make(map[*ast.Ident]types.Object),
+			Selections: make(map[*ast.SelectorExpr]*types.Selection),
+			Types:      make(map[ast.Expr]types.TypeAndValue),
+		}
+		config := &types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+		_, err = config.Check("test", fset, []*ast.File{file}, &info)
+		i.typesInfo = &info
+		i.fset = fset
+		if err != nil {
+			t.Fatalf("Could not parse setup: %s", err)
+		}
+
+		// The inputs are the objects declared first with their name.
+		objects := make(map[string]types.Object)
+		for ident, obj := range info.Defs {
+			if prev, ok := objects[ident.Name]; obj != nil && (!ok || obj.Pos() < prev.Pos()) {
+				objects[ident.Name] = obj
 			}
-			info := types.Info{
-				Defs:       make(map[*ast.Ident]types.Object),
-				Selections: make(map[*ast.SelectorExpr]*types.Selection),
-				Types:      make(map[ast.Expr]types.TypeAndValue),
+		}
+		objectOf := func(name string) types.Object {
+			if obj, ok := objects[name]; ok {
+				return obj
 			}
-			config := &types.Config{}
-			_, err = config.Check("test", fset, []*ast.File{file}, &info)
-			i.typesInfo = &info
-			i.fset = fset
+			return i.objectOf(ast.NewIdent(name))
+		}
+
+		for _, input := range cs.input {
+			st, err = st.Define(objectOf(input.key), newPermission(input.value))
 			if err != nil {
-				t.Fatalf("Could not parse setup: %s", err)
+				t.Fatalf("Could not define input %s: %s", input.key, err)
 			}
+		}
 
-			for _, input := range cs.input {
-				st, err = st.Define(input.key, newPermission(input.value))
-				if err != nil {
-					t.Fatalf("Could not define input %s: %s", input.key, err)
+		i.curFunc = st.GetEffective(objectOf("main")).(*permission.FuncPermission)
+		exits := visit(i, st, file.Decls[len(file.Decls)-1].(*ast.FuncDecl).Body)
+
+		if len(exits) != len(outputs) {
+			t.Fatalf("Expected %d result, got %d => %v", len(outputs), len(exits), exits)
+		}
+
+		for k, output := range outputs {
+			exit := exits[k]
+			if byPos {
+				exit = exitAt(exits, output.pos)
+			}
+			for _, item := range output.items {
+				act := exit.GetEffective(objectOf(item.key))
+				exp := newPermission(item.value)
+				if !reflect.DeepEqual(act, exp) {
+					t.Error(spew.Errorf("exit %d: key %s: Expected %v, received %v", k, item.key, exp, act))
 				}
 			}
 
-			i.curFunc = st.GetEffective("main").(*permission.FuncPermission)
-			exits := i.visitStmt(st, file.Decls[len(file.Decls)-1].(*ast.FuncDecl).Body)
-
-			if len(exits) != len(cs.output) {
-				t.Fatalf("Expected %d result, got %d => %v", len(cs.output), len(exits), exits)
+			if (output.pos >= 0) != (exit.branch != nil) {
+				t.Errorf("Expected branch statement = %v, Got branch statement = %v", output.pos >= 0, exit.branch != nil)
+			} else if output.pos > 0 && int(exit.branch.Pos()) != output.pos {
+				t.Error(spew.Errorf("exit %d: Expected %v, received %v", k, output.pos, exit.branch.Pos()))
 			}
+		}
+	}
 
-			for k, output := range cs.output {
-				exit := exits[k]
-				for _, item := range output.items {
-					act := exit.GetEffective(item.key)
-					exp := newPermission(item.value)
-					if !reflect.DeepEqual(act, exp) {
-						t.Error(spew.Errorf("exit %d: key %s: Expected %v, received %v", k, item.key, exp, act))
-					}
+	// The control-flow graph engine merges exits at the same statement, so
+	// it is expected to produce the intersection of the exits there.
+	mergeExits := func(exits []exitDesc) []exitDesc {
+		var merged []exitDesc
+	nextExit:
+		for _, exit := range exits {
+			for k := range merged {
+				if merged[k].pos != exit.pos {
+					continue
 				}
-
-				if (output.pos >= 0) != (exit.branch != nil) {
-					t.Errorf("Expected branch statement = %v, Got branch statement = %v", output.pos >= 0, exit.branch != nil)
-				} else if output.pos > 0 && int(exit.branch.Pos()) != output.pos {
-					t.Error(spew.Errorf("exit %d: Expected %v, received %v", k, output.pos, exit.branch.Pos()))
+				for j, item := range merged[k].items {
+					perm := newPermission(item.value)
+					for _, other := range exit.items {
+						if other.key == item.key && perm != nil {
+							perm, _ = permission.Intersect(perm, newPermission(other.value))
+						}
+					}
+					merged[k].items[j].value = perm
 				}
+				continue nextExit
 			}
-		})
+			merged = append(merged, exitDesc{append([]storeItemDesc(nil), exit.items...), exit.pos})
+		}
+		return merged
+	}
+
+	engines := []struct {
+		prefix string
+		visit  func(i *Interpreter, st Store, body *ast.BlockStmt) []StmtExit
+		exits  func(exits []exitDesc) []exitDesc
+		byPos  bool // Exits are not in the order of the table
+	}{
+		{"", func(i *Interpreter, st Store, body *ast.BlockStmt) []StmtExit { return i.visitStmt(st, body) }, func(exits []exitDesc) []exitDesc { return exits }, false},
+		{"cfg/", func(i *Interpreter, st Store, body *ast.BlockStmt) []StmtExit { return i.visitStmtCFG(st, body) }, mergeExits, true},
+	}
+
+	for _, engine := range engines {
+		for _, cs := range testCases {
+			t.Run(engine.prefix+cs.name, func(t *testing.T) {
+				run(t, cs, engine.visit, engine.exits(cs.output), engine.byPos)
+			})
+		}
 	}
+}
 
+// exitAt returns the exit at the branch statement at pos, or the exit that is
+// not a branch if pos is negative.
+func exitAt(exits []StmtExit, pos int) StmtExit {
+	for _, exit := range exits {
+		if (exit.branch == nil && pos < 0) || (exit.branch != nil && int(exit.branch.Pos()) == pos) {
+			return exit
+		}
+	}
+	return StmtExit{}
 }
+
 func TestVisitDeclStmt(t *testing.T) {
 	var badDecl = &ast.BadDecl{token.NoPos, token.NoPos}
 	var declStmt = &ast.DeclStmt{badDecl}
 	var i = &Interpreter{}
 	runFuncRecover(t, "xpected general declaration", func() {
-		i.visitDeclStmt(nil, declStmt)
+		i.visitDeclStmt(NewStore(), declStmt)
 	})
 }
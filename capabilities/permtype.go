@@ -0,0 +1,113 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"github.com/julian-klode/lingolang/permission"
+)
+
+// permType is a permission declared by a "@permtype Name = ..." comment at
+// package level. Declarations may refer to each other, so they are parsed
+// on demand, when their name is first looked up.
+type permType struct {
+	text     string    // The declaration after "@permtype"
+	pos      token.Pos // Position of text
+	resolved bool      // Whether the declaration was parsed already
+}
+
+// annotationText returns the text after an annotation keyword such as
+// "@perm" in a comment, and its offset in the comment. The closing "*/" of
+// a block comment is not part of the text.
+func annotationText(cmt *ast.Comment, keyword string) (text string, offset int, ok bool) {
+	text = cmt.Text[2:]
+	if strings.HasPrefix(cmt.Text, "/*") {
+		text = strings.TrimSuffix(text, "*/")
+	}
+	if !strings.HasPrefix(strings.TrimSpace(text), keyword) {
+		return "", 0, false
+	}
+	offset = strings.Index(text, keyword) + len(keyword)
+	// "@permtype" is not "@perm".
+	if rest := text[offset:]; rest != "" && !strings.ContainsAny(rest[:1], " \t\n") {
+		return "", 0, false
+	}
+	return text[offset:], 2 + offset, true
+}
+
+// declarePermTypes collects the permission types declared in the files,
+// and parses them, reporting any errors.
+func (c *Checker) declarePermTypes(files []*ast.File) {
+	var decls []*permType
+	for _, f := range files {
+		for _, cmtGrp := range f.Comments {
+			for _, cmt := range cmtGrp.List {
+				text, offset, ok := annotationText(cmt, "@permtype")
+				if !ok {
+					continue
+				}
+				if inFunction(f, cmt.Pos()) {
+					c.errorf(cmt.Slash, CodeBadAnnotation, "Permission types can only be declared at package level")
+					continue
+				}
+				decl := &permType{text: text, pos: cmt.Slash + token.Pos(offset)}
+				name := permission.NewScanner(text).Scan()
+				if first, ok := c.permTypes[name.Value]; ok && name.Type == permission.TokenWord {
+					c.report(Diagnostic{
+						Pos:     c.fset.Position(decl.pos + token.Pos(name.Start)),
+						Code:    CodeBadAnnotation,
+						Message: "Permission type " + name.Value + " declared twice",
+						Related: []Related{{c.fset.Position(first.pos), "first declared here"}},
+					})
+					continue
+				}
+				if name.Type == permission.TokenWord {
+					c.permTypes[name.Value] = decl
+				}
+				decls = append(decls, decl)
+			}
+		}
+	}
+	for _, decl := range decls {
+		c.resolvePermType(decl)
+	}
+}
+
+// resolvePermType parses a permission type declaration, unless it was
+// parsed already, or is being parsed.
+func (c *Checker) resolvePermType(decl *permType) {
+	if decl.resolved {
+		return
+	}
+	decl.resolved = true
+	parser := permission.NewScopedParser(decl.text, c.scope)
+	_, _, err := parser.ParseDeclaration()
+	c.reportParser(parser, err, decl.pos)
+}
+
+// reportParser reports the errors and warnings of a parser whose input
+// starts at pos.
+func (c *Checker) reportParser(parser *permission.Parser, err error, pos token.Pos) {
+	// Report each error where it is in the comment.
+	errs, _ := err.(permission.SyntaxErrors)
+	for _, err := range errs {
+		c.errorf(pos+token.Pos(err.Start), CodeBadAnnotation, "Cannot parse permission: %s", err.Err)
+	}
+	for _, w := range parser.Warnings {
+		c.warnf(pos+token.Pos(w.Start), pos+token.Pos(w.End), w.Suggestion, CodeNonCanonical, "%s", w.Message)
+	}
+}
+
+// inFunction checks whether pos is inside the body of a function in f.
+func inFunction(f *ast.File, pos token.Pos) bool {
+	for _, decl := range f.Decls {
+		if fun, ok := decl.(*ast.FuncDecl); ok && fun.Body != nil && fun.Body.Pos() <= pos && pos < fun.Body.End() {
+			return true
+		}
+	}
+	return false
+}
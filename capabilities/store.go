@@ -4,189 +4,547 @@
 package capabilities
 
 import (
+	"bytes"
 	"fmt"
-	"reflect"
+	"go/token"
+	"go/types"
 
 	"github.com/julian-klode/lingolang/permission"
 )
 
 // Store associates variables with permissions for the abstract interpreter.
 //
-// Store essentially maps identifiers in the program to permissions; an
-// effective, and a maximum one. As a special case, if ident is nil, the
-// item acts marks the beginning of a new frame.
-type Store []struct {
-	name string
+// Store essentially maps objects in the program to permissions; an
+// effective, and a maximum one. As a special case, if obj is nil, the
+// item acts marks the beginning of a new frame. Names of objects are only
+// used for diagnostics, so shadowed variables are distinct entries.
+//
+// A Store is persistent: Its entries are stored in a trie indexed by their
+// position, outermost first, and a hash trie maps objects to the position of
+// their entries. Changing an entry copies the path to it in both tries, so
+// it takes logarithmic time, and the rest is shared with the original store.
+// The store keeps a hash of its entries up to date as well, so comparing
+// stores is cheap in the common case.
+//
+// A Store also records the calls deferred on the path leading to it, which
+// are still pending, so they can be replayed at the exits of the function.
+type Store struct {
+	entries  *entryNode // Entries by position; entries after length are stale
+	levels   uint       // Number of levels of entries
+	length   int
+	hash     uint64     // Sum of the hashes of the entries, see entryHash()
+	index    *indexNode // Innermost position of each object
+	frames   *storeFrame
+	deferred []deferredCall // Pending deferred calls, oldest first; never modified in place
+}
+
+// storeEntry is an entry in a Store, see there.
+type storeEntry struct {
+	obj  types.Object
 	eff  permission.Permission
 	max  permission.Permission
 	uses int
+	why  provenance // Why eff was last lowered, for diagnostics only
+
+	shadowed int    // Position of the entry of obj this one shadows, or -1
+	ownHash  uint64 // Hash of obj, eff, and max, or 0 if not computed yet
+}
+
+// storeFrame is the position of a frame marker in a Store, and the frame
+// around it.
+type storeFrame struct {
+	pos  int
+	next *storeFrame
+}
+
+// provenance records where and why the effective permission of a variable
+// was lowered, like "borrowed" or "moved into a call". It is not part of the
+// hash of an entry, and does not affect equality: It only explains errors.
+type provenance struct {
+	pos    token.Pos
+	reason string
 }
 
 // NewStore returns a new, empty Store
 func NewStore() Store {
-	return nil
+	return Store{}
+}
+
+// entryHash returns the hash of the entry e at position k, which is part
+// of the hash of the store.
+func entryHash(k int, e *storeEntry) uint64 {
+	return mixHash(e.ownHash, uint64(k)+1)
+}
+
+// at returns the entry at position k.
+func (st Store) at(k int) *storeEntry {
+	return st.entries.get(st.levels, k)
+}
+
+// set returns a new store where the entry at position k is e, keeping the
+// hash up to date. The index is not changed.
+func (st Store) set(k int, e *storeEntry) Store {
+	if e.ownHash == 0 {
+		e.ownHash = mixHash(mixHash(hashObject(e.obj), hashPermission(e.eff, hashDepth)), hashPermission(e.max, hashDepth))
+	}
+	if k < st.length {
+		st.hash -= entryHash(k, st.at(k))
+	}
+	for k >= entryCapacity(st.levels) {
+		st = st.grow()
+	}
+	st.entries = st.entries.set(st.levels, k, e)
+	st.hash += entryHash(k, e)
+	return st
+}
+
+// push returns a new store with an entry in front of st. The entry is
+// copied.
+func (st Store) push(e storeEntry) Store {
+	k := st.length
+	e.shadowed = -1
+	if e.obj == nil {
+		st.frames = &storeFrame{k, st.frames}
+	} else {
+		hash := hashObject(e.obj)
+		if pos, ok := st.index.get(e.obj, hash); ok {
+			e.shadowed = pos
+		}
+		st.index = st.index.put(0, indexItem{hash, e.obj, k})
+	}
+	st = st.set(k, &e)
+	st.length++
+	return st
+}
+
+// truncate returns the store with only the first n entries.
+func (st Store) truncate(n int) Store {
+	for k := st.length - 1; k >= n; k-- {
+		e := st.at(k)
+		st.hash -= entryHash(k, e)
+		switch {
+		case e.obj == nil:
+			st.frames = st.frames.next
+		case e.shadowed >= 0:
+			st.index = st.index.put(0, indexItem{hashObject(e.obj), e.obj, e.shadowed})
+		default:
+			st.index = st.index.remove(0, e.obj, hashObject(e.obj))
+		}
+	}
+	st.length = n
+	return st
+}
+
+// innermost returns the innermost entry, or nil if the store is empty.
+func (st Store) innermost() *storeEntry {
+	if st.length == 0 {
+		return nil
+	}
+	return st.at(st.length - 1)
+}
+
+// Len returns the number of entries in the store, including frame markers.
+func (st Store) Len() int {
+	return st.length
+}
+
+// Hash returns a hash of the store. Equal stores have equal hashes.
+func (st Store) Hash() uint64 {
+	h := mixHash(hashSeed, st.hash)
+	for _, call := range st.deferred {
+		h = mixHash(h, uint64(call.stmt.Pos()))
+	}
+	return h
+}
+
+// String returns a string representation of the store, innermost first.
+func (st Store) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for k := st.length - 1; k >= 0; k-- {
+		e := st.at(k)
+		if k != st.length-1 {
+			buf.WriteString(", ")
+		}
+		if e.obj == nil {
+			buf.WriteString("|")
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %v (max %v)", e.obj.Name(), e.eff, e.max)
+	}
+	buf.WriteString("]")
+	return buf.String()
 }
 
 // Equal checks if two Stores are equal
 func (st Store) Equal(ot Store) bool {
-	if st == nil {
-		return ot == nil || len(ot) == 0
+	if st.Len() != ot.Len() || st.Hash() != ot.Hash() || !equalDeferred(st.deferred, ot.deferred) {
+		return false
 	}
-	if ot == nil {
-		return st == nil || len(st) == 0
+	return st.changedEntries(ot, func(k int, e, o *storeEntry) bool {
+		return e.obj == o.obj && permission.Equal(e.eff, o.eff) && permission.Equal(e.max, o.max)
+	})
+}
+
+// changedEntries calls f for each entry of st that is not shared with the
+// entry at the same position in ot, which must have the same length, until
+// f returns false. It returns false if f did.
+func (st Store) changedEntries(ot Store, f func(k int, e, o *storeEntry) bool) bool {
+	// Entries are only shared at the same depth.
+	for st.levels < ot.levels {
+		st = st.grow()
 	}
-	if len(st) != len(ot) {
-		return false
+	for ot.levels < st.levels {
+		ot = ot.grow()
 	}
-	for i := range st {
-		if st[i].name != ot[i].name || !reflect.DeepEqual(st[i].eff, ot[i].eff) || !reflect.DeepEqual(st[i].max, ot[i].max) {
-			return false
-		}
+	return walkChanged(st.entries, ot.entries, st.levels, 0, st.length, f)
+}
+
+// grow returns the store with one more level of entries.
+func (st Store) grow() Store {
+	if st.levels > 0 {
+		root := &entryNode{}
+		root.children[0] = st.entries
+		st.entries = root
 	}
-	return true
+	st.levels++
+	return st
 }
 
-// BeginBlock copies the Store, prepending a frame marker at the beginning.
+// BeginBlock returns a new Store, with a frame marker at the beginning.
 func (st Store) BeginBlock() Store {
-	var st2 = make(Store, len(st)+1)
-	for i, v := range st {
-		st2[i+1] = v
-	}
-	return st2
+	return st.push(storeEntry{})
 }
 
-// EndBlock returns a slice of the input describing the parent block.
+// EndBlock returns the store describing the parent block.
 func (st Store) EndBlock() Store {
-	for i, v := range st {
-		if v.name == "" {
-			return st[i+1:]
-		}
+	if st.frames == nil {
+		panic("Program error: Not inside a block, so cannot end one")
 	}
-	panic("Program error: Not inside a block, so cannot end one")
+	return st.truncate(st.frames.pos)
 }
 
 // Merge merges two Stores describing two different branches in the code. The
 // Stores must be defined in the same order.
 func (st Store) Merge(st2 Store) (Store, error) {
 	var err error
-	st3 := make(Store, len(st))
 
 	switch {
-	case st == nil:
+	case st.length == 0 && st.deferred == nil:
 		return st2, nil
-	case st2 == nil:
+	case st2.length == 0 && st2.deferred == nil:
 		return st, nil
+	case st.Len() != st2.Len():
+		return Store{}, fmt.Errorf("Invalid merge: Different number of identifiers %d vs %d", st.Len(), st2.Len())
 	}
 
-	for i, v := range st {
-		if st[i].name != st2[i].name {
-			return nil, fmt.Errorf("Invalid merge: Different identifiers %s vs %s at position %d", st[i].name, st2[i].name, i)
+	// Merge the entries that are not shared. Both stores have the same
+	// objects at the same positions, so they have the same index.
+	st3 := st
+	st.changedEntries(st2, func(k int, e, e2 *storeEntry) bool {
+		if e.obj != e2.obj {
+			err = fmt.Errorf("Invalid merge: Different identifiers %s vs %s at position %d", objectName(e.obj), objectName(e2.obj), st.length-1-k)
+			return false
 		}
-		st3[i].name = st[i].name
-		st3[i].eff, err = permission.Intersect(st[i].eff, st2[i].eff)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot merge effective permissions %s and %s of %s: %s", st[i].eff, st2[i].eff, v.name, err)
+		e3 := storeEntry{obj: e.obj, uses: e.uses, shadowed: e.shadowed}
+		if e.obj == nil {
+			st3 = st3.set(k, &e3)
+			return true
 		}
-		st3[i].max, err = permission.Intersect(st[i].max, st2[i].max)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot merge maximum permissions %s and %s of %s: %s", st[i].max, st2[i].max, v.name, err)
+		if e3.eff, err = permission.Intersect(e.eff, e2.eff); err != nil {
+			err = fmt.Errorf("Cannot merge effective permissions %s and %s of %s: %s", e.eff, e2.eff, objectName(e.obj), err)
+			return false
 		}
-		st3[i].uses = st[i].uses
-		if st2[i].uses > st3[i].uses {
-			st3[i].uses = st2[i].uses
+		if e3.max, err = permission.Intersect(e.max, e2.max); err != nil {
+			err = fmt.Errorf("Cannot merge maximum permissions %s and %s of %s: %s", e.max, e2.max, objectName(e.obj), err)
+			return false
 		}
+		if e2.uses > e3.uses {
+			e3.uses = e2.uses
+		}
+		// Explain the weaker of the two permissions.
+		e3.why = e.why
+		if e2.why.pos != token.NoPos && (e3.why.pos == token.NoPos || !permission.Equal(e3.eff, e.eff)) {
+			e3.why = e2.why
+		}
+		st3 = st3.set(k, &e3)
+		return true
+	})
+	if err != nil {
+		return Store{}, err
+	}
+
+	// A call deferred on either path may be pending after the join.
+	for _, call := range st2.deferred {
+		st3 = st3.addDeferred(call)
 	}
 	return st3, nil
 }
 
-// Define defines an identifier in the current block. If the current block already contains
-// a variable of the same name, no new variable is created, but the existing one is assigned
+// Widen returns a store for a loop head that has been reached with the
+// store st before, and now with next. It is the intersection of both, except
+// that the variables whose effective permissions still changed jump to the
+// least permission of their shape. Widening a store again then only changes
+// the variables that had not changed before, so the stores at a loop head
+// stabilize at an invariant of the loop after a bounded number of steps.
+func (st Store) Widen(next Store) (Store, error) {
+	merged, err := st.Merge(next)
+	if err != nil || merged.Len() != st.Len() {
+		return merged, err
+	}
+	widened := merged
+	merged.changedEntries(st, func(k int, e, o *storeEntry) bool {
+		if e.obj != nil && !permission.Equal(e.eff, o.eff) {
+			bottom := *e
+			bottom.eff = permission.BottomOf(e.eff)
+			bottom.ownHash = 0
+			widened = widened.set(k, &bottom)
+		}
+		return true
+	})
+	return widened, nil
+}
+
+// Define defines an object in the current block. If the current block already contains
+// the object, no new variable is created, but the existing one is assigned
 // by calling SetEffective().
-func (st Store) Define(name string, perm permission.Permission) (Store, error) {
+func (st Store) Define(obj types.Object, perm permission.Permission) (Store, error) {
 	// Do not allow a redefinition in the same block, make that an assignment instead. This matches
 	// gos define operator.
-	for _, item := range st {
-		if item.name == name {
-			return st.SetEffective(name, perm)
-		}
-		if item.name == "" {
-			break
-		}
+	if pos, ok := st.index.get(obj, hashObject(obj)); ok && (st.frames == nil || pos > st.frames.pos) {
+		return st.SetEffective(obj, perm)
 	}
-	var st2 = make(Store, len(st)+1)
-	st2[0].name = name
-	st2[0].max = perm
-	st2[0].eff = perm
-	for i, v := range st {
-		st2[i+1] = v
+	return st.push(storeEntry{obj: obj, eff: perm, max: perm}), nil
+}
+
+// update returns a new store where the entry for obj is replaced by the
+// result of calling f on a copy of it. The path to the entry is copied, the
+// rest is shared.
+func (st Store) update(obj types.Object, f func(e *storeEntry) error) (Store, error) {
+	pos, ok := st.index.get(obj, hashObject(obj))
+	if !ok {
+		panic("Program error: Setting a nonexisting variable")
+	}
+	updated := *st.at(pos)
+	if err := f(&updated); err != nil {
+		return Store{}, err
 	}
-	return st2, nil
+	updated.ownHash = 0
+	return st.set(pos, &updated), nil
 }
 
 // SetEffective changes the permissions associated with an ident.
 //
 // The effective permission is limited to the maximum permission that the
-// variable can have.
-func (st Store) SetEffective(name string, perm permission.Permission) (Store, error) {
-	st1 := make(Store, len(st))
-	copy(st1, st)
-	st = st1
-	for i, v := range st {
-		if v.name == name {
-			eff, err := permission.Intersect(st[i].max, perm)
-			if err != nil {
-				return nil, fmt.Errorf("Cannot restrict effective permission of %s to new max: %s", v.name, err.Error())
-			}
-			st[i].eff = eff
-			st[i].uses += 1
-			return st, nil
+// variable can have. The variable gets a new value, so the reason of any
+// previous change is forgotten.
+func (st Store) SetEffective(obj types.Object, perm permission.Permission) (Store, error) {
+	return st.SetEffectiveAt(obj, perm, token.NoPos, "")
+}
+
+// SetEffectiveAt is like SetEffective, but records the position and the
+// reason of the change, see Provenance().
+func (st Store) SetEffectiveAt(obj types.Object, perm permission.Permission, pos token.Pos, reason string) (Store, error) {
+	return st.update(obj, func(e *storeEntry) error {
+		eff, err := permission.Intersect(e.max, perm)
+		if err != nil {
+			return fmt.Errorf("Cannot restrict effective permission of %s to new max: %s", e.obj.Name(), err.Error())
 		}
-	}
-	panic("Program error: Setting a nonexisting variable")
+		e.eff = eff
+		e.uses++
+		e.why = provenance{pos, reason}
+		return nil
+	})
 }
 
 // SetMaximum changes the maximum permissions associated with an ident.
 //
 // Lowering the maximum permission also lowers the effective permission if
 // they would otherwise exceed the maximum.
-//
-func (st Store) SetMaximum(name string, perm permission.Permission) (Store, error) {
-	st1 := make(Store, len(st))
-	copy(st1, st)
-	st = st1
-	for i, v := range st {
-		if v.name == name {
-			eff, err := permission.Intersect(st[i].eff, perm)
-			if err != nil {
-				return nil, fmt.Errorf("Cannot restrict effective permission of %s to new max: %s", v.name, err.Error())
+func (st Store) SetMaximum(obj types.Object, perm permission.Permission) (Store, error) {
+	return st.update(obj, func(e *storeEntry) error {
+		eff, err := permission.Intersect(e.eff, perm)
+		if err != nil {
+			return fmt.Errorf("Cannot restrict effective permission of %s to new max: %s", e.obj.Name(), err.Error())
+		}
+		e.eff = eff
+		e.max = perm
+		e.uses++
+		return nil
+	})
+}
+
+// addDeferred returns a new store with call pending. If the statement of the call
+// is already pending, for example because it is in a loop, the call is only
+// recorded once, but with the values released by both.
+func (st Store) addDeferred(call deferredCall) Store {
+	deferred := make([]deferredCall, len(st.deferred), len(st.deferred)+1)
+	copy(deferred, st.deferred)
+	for k := range deferred {
+		if deferred[k].stmt != call.stmt {
+			continue
+		}
+		released := deferred[k].released
+	nextDep:
+		for _, dep := range call.released {
+			for _, old := range released {
+				if old.obj == dep.obj && permission.Equal(old.perm, dep.perm) {
+					continue nextDep
+				}
 			}
-			st[i].eff = eff
-			st[i].max = perm
-			st[i].uses += 1
-			return st, nil
+			released = append(released[:len(released):len(released)], dep)
 		}
+		deferred[k].released = released
+		st.deferred = deferred
+		return st
 	}
-	panic("Program error: Setting a nonexisting variable")
+	st.deferred = append(deferred, call)
+	return st
+}
+
+// withoutDeferred returns the store without pending deferred calls, for
+// entering a new function.
+func (st Store) withoutDeferred() Store {
+	st.deferred = nil
+	return st
 }
 
-// GetEffective returns the effective permission for the identifier
-func (st Store) GetEffective(name string) permission.Permission {
-	for i, v := range st {
-		if v.name == name {
-			st[i].uses += 1
-			return v.eff
+// equalDeferred checks whether two lists of deferred calls are equal.
+func equalDeferred(a, b []deferredCall) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k].stmt != b[k].stmt || len(a[k].released) != len(b[k].released) {
+			return false
+		}
+		for j := range a[k].released {
+			if a[k].released[j].obj != b[k].released[j].obj || !permission.Equal(a[k].released[j].perm, b[k].released[j].perm) {
+				return false
+			}
 		}
 	}
+	return true
+}
+
+// find returns the entry for obj, or nil.
+func (st Store) find(obj types.Object) *storeEntry {
+	if pos, ok := st.index.get(obj, hashObject(obj)); ok {
+		return st.at(pos)
+	}
 	return nil
 }
 
-// GetMaximum returns the maximum permission for the identifier
-func (st Store) GetMaximum(name string) permission.Permission {
-	for i, v := range st {
-		if v.name == name {
-			st[i].uses += 1
-			return v.max
-		}
+// GetEffective returns the effective permission for the object
+func (st Store) GetEffective(obj types.Object) permission.Permission {
+	if e := st.find(obj); e != nil {
+		return e.eff
 	}
 	return nil
 }
+
+// Provenance returns the position and the reason of the last change of the
+// effective permission of obj, or token.NoPos if it has not been changed
+// since it was defined, assigned, or released.
+func (st Store) Provenance(obj types.Object) (token.Pos, string) {
+	if e := st.find(obj); e != nil {
+		return e.why.pos, e.why.reason
+	}
+	return token.NoPos, ""
+}
+
+// GetMaximum returns the maximum permission for the object
+func (st Store) GetMaximum(obj types.Object) permission.Permission {
+	if e := st.find(obj); e != nil {
+		return e.max
+	}
+	return nil
+}
+
+// objectName returns the name of an object for diagnostics. Frame markers
+// have no name.
+func objectName(obj types.Object) string {
+	if obj == nil {
+		return ""
+	}
+	return obj.Name()
+}
+
+// hashSeed is the hash of an empty store.
+const hashSeed uint64 = 14695981039346656037
+
+// hashDepth is the depth up to which permissions are hashed. Permissions
+// can be cyclic, and deeper levels rarely tell stores apart anyway.
+const hashDepth = 3
+
+// mixHash combines a hash with a value, like FNV-1a does with bytes.
+func mixHash(h, v uint64) uint64 {
+	return (h ^ v) * 1099511628211
+}
+
+// hashObject hashes an object by name and position, so it is stable for the
+// same object. Frame markers have a hash of 0.
+func hashObject(obj types.Object) uint64 {
+	if obj == nil {
+		return 0
+	}
+	h := hashSeed
+	for _, c := range []byte(obj.Name()) {
+		h = mixHash(h, uint64(c))
+	}
+	return mixHash(h, uint64(obj.Pos()))
+}
+
+// hashPermission computes a structural hash of the first depth levels of a
+// permission. Permissions that are Equal have equal hashes, as it only looks at
+// the shape of the permission, not at the identity of its nodes.
+func hashPermission(perm permission.Permission, depth int) uint64 {
+	switch perm.(type) {
+	case nil:
+		return 0
+	case *permission.WildcardPermission:
+		return 1
+	}
+	h := mixHash(hashSeed, uint64(perm.GetBasePermission()))
+	if depth == 0 {
+		return h
+	}
+	hashAll := func(kind uint64, perms ...permission.Permission) uint64 {
+		h := mixHash(h, kind)
+		for _, p := range perms {
+			h = mixHash(h, hashPermission(p, depth-1))
+		}
+		return h
+	}
+	switch perm := perm.(type) {
+	case permission.BasePermission:
+		return hashAll(1)
+	case *permission.PointerPermission:
+		return hashAll(2, perm.Target)
+	case *permission.ChanPermission:
+		return hashAll(3, perm.ElementPermission)
+	case *permission.ArrayPermission:
+		return hashAll(4, perm.ElementPermission)
+	case *permission.SlicePermission:
+		return hashAll(5, perm.ElementPermission)
+	case *permission.MapPermission:
+		return hashAll(6, perm.KeyPermission, perm.ValuePermission)
+	case *permission.StructPermission:
+		return hashAll(7, perm.Fields...)
+	case *permission.FuncPermission:
+		h := hashAll(8, perm.Receivers...)
+		h = mixHash(h, hashAll(9, perm.Params...))
+		return mixHash(h, hashAll(10, perm.Results...))
+	case *permission.InterfacePermission:
+		methods := make([]permission.Permission, len(perm.Methods))
+		for i, m := range perm.Methods {
+			methods[i] = m
+		}
+		return hashAll(11, methods...)
+	case *permission.TuplePermission:
+		return hashAll(12, perm.Elements...)
+	case *permission.NilPermission:
+		return hashAll(13)
+	}
+	return h
+}
@@ -4,18 +4,31 @@
 package capabilities
 
 import (
+	"bytes"
 	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/julian-klode/lingolang/permission"
 )
 
+// newVar creates a new variable object with the given name.
+func newVar(name string) types.Object {
+	return types.NewVar(token.NoPos, nil, name, nil)
+}
+
 func TestStore_equal(t *testing.T) {
 	var equalStores = []struct{ A, B Store }{
-		{nil, nil},
-		{nil, NewStore()},
-		{nil, NewStore().BeginBlock().EndBlock()},
+		{Store{}, Store{}},
+		{Store{}, NewStore()},
+		{Store{}, NewStore().BeginBlock().EndBlock()},
 		{NewStore(), NewStore()},
 		{NewStore().BeginBlock(), NewStore().BeginBlock()},
 		{NewStore().BeginBlock().EndBlock(), NewStore().BeginBlock().EndBlock()},
@@ -31,9 +44,109 @@ func TestStore_equal(t *testing.T) {
 	}
 }
 
+func TestStore_Hash(t *testing.T) {
+	a := newVar("a")
+	st1, _ := NewStore().Define(a, &permission.PointerPermission{BasePermission: permission.Mutable, Target: permission.Mutable})
+	st2, _ := NewStore().Define(a, &permission.PointerPermission{BasePermission: permission.Mutable, Target: permission.Mutable})
+	if !st1.Equal(st2) || st1.Hash() != st2.Hash() {
+		t.Errorf("Equal stores %v and %v have hashes %x and %x", st1, st2, st1.Hash(), st2.Hash())
+	}
+	st3, _ := st2.SetEffective(a, &permission.PointerPermission{BasePermission: permission.ReadOnly, Target: permission.Mutable})
+	if st1.Equal(st3) || st1.Hash() == st3.Hash() {
+		t.Errorf("Different stores %v and %v have hashes %x and %x", st1, st3, st1.Hash(), st3.Hash())
+	}
+}
+
+func TestStore_sharing(t *testing.T) {
+	a := newVar("a")
+	b := newVar("b")
+	st, _ := NewStore().Define(a, permission.Mutable)
+	st, _ = st.BeginBlock().Define(b, permission.Mutable)
+	st2, _ := st.SetEffective(b, permission.ReadOnly)
+	if st2.find(a) != st.find(a) {
+		t.Errorf("Changing b copied the entries of the outer block")
+	}
+	if st.GetEffective(b) != permission.Mutable {
+		t.Errorf("Changing b changed the original store: %v", st)
+	}
+}
+
+func TestStore_deep(t *testing.T) {
+	st, objs := newBenchmarkStore(100)
+	ro := permission.ConvertToBase(benchmarkPerm, permission.ReadOnly)
+	inner, _ := st.BeginBlock().Define(objs[3], ro)
+	inner, _ = inner.SetEffective(objs[5], ro)
+	if inner.Len() != 103 || !permission.Equal(inner.GetEffective(objs[3]), ro) || !permission.Equal(inner.GetEffective(objs[5]), ro) {
+		t.Fatalf("Unexpected inner store %v", inner)
+	}
+
+	// Ending the block restores the shadowed variable, but keeps changes
+	// to the outer one.
+	outer := inner.EndBlock()
+	if outer.Len() != 101 || !permission.Equal(outer.GetEffective(objs[3]), benchmarkPerm) || !permission.Equal(outer.GetEffective(objs[5]), ro) {
+		t.Errorf("Unexpected outer store %v", outer)
+	}
+	if expected, _ := st.SetEffective(objs[5], ro); !outer.Equal(expected) || outer.Hash() != expected.Hash() {
+		t.Errorf("Expected %v, received %v", expected, outer)
+	}
+	if st.Equal(outer) || !permission.Equal(st.GetEffective(objs[5]), benchmarkPerm) {
+		t.Errorf("Changing the inner store changed the original one: %v", st)
+	}
+
+	// Stores are equal even if one of them had more entries before.
+	short := NewStore().BeginBlock()
+	long := st.EndBlock().BeginBlock()
+	for _, obj := range objs[:10] {
+		short, _ = short.Define(obj, benchmarkPerm)
+		long, _ = long.Define(obj, benchmarkPerm)
+	}
+	if !short.Equal(long) || !long.Equal(short) || short.Hash() != long.Hash() {
+		t.Errorf("Stores %v and %v are not equal", short, long)
+	}
+	if changed, _ := long.SetEffective(objs[9], ro); short.Equal(changed) || changed.Equal(short) {
+		t.Errorf("Stores %v and %v are equal", short, changed)
+	}
+}
+
+func TestStore_Widen(t *testing.T) {
+	a := newVar("a")
+	st, _ := NewStore().Define(a, permission.Mutable)
+	st = st.BeginBlock()
+	next, _ := st.SetEffective(a, permission.ReadOnly)
+	widened, err := st.Widen(next)
+	if err != nil {
+		t.Fatalf("Cannot widen %v with %v: %s", st, next, err)
+	}
+	// a changed, so it has no permissions left.
+	if widened.GetEffective(a) != permission.None || widened.Len() != st.Len() {
+		t.Errorf("Expected a to have no permissions, received %v", widened)
+	}
+	again, _ := widened.Widen(next)
+	if !again.Equal(widened) {
+		t.Errorf("Widening is not stable: %v vs %v", again, widened)
+	}
+	// Variables that did not change keep their permissions.
+	b := newVar("b")
+	st, _ = st.Define(b, newPermission("om * om"))
+	next, _ = st.SetEffective(a, permission.ReadOnly)
+	widened, _ = st.Widen(next)
+	if !permission.Equal(widened.GetEffective(b), newPermission("om * om")) {
+		t.Errorf("Expected b to keep om * om, received %v", widened)
+	}
+	// Structured permissions keep their shape.
+	st, _ = st.SetEffective(b, newPermission("om * om"))
+	next, _ = st.SetEffective(b, newPermission("om * or"))
+	if widened, _ = st.Widen(next); !permission.Equal(widened.GetEffective(b), newPermission("n * n")) {
+		t.Errorf("Expected n * n for b, received %v", widened)
+	}
+	if _, err := st.Widen(st.BeginBlock()); err == nil {
+		t.Errorf("Widened stores of different length")
+	}
+}
+
 func TestStore_BeginEndBlock(t *testing.T) {
 	st := NewStore()
-	if len(st) != 0 {
+	if st.Len() != 0 {
 		t.Fatalf("Store is not empty: %v", st)
 	}
 
@@ -45,11 +158,11 @@ func TestStore_BeginEndBlock(t *testing.T) {
 	if block2.Equal(block) {
 		t.Fatalf("block2 is same as block")
 	}
-	if len(block) != 1 {
-		t.Fatalf("block has %d markers, expected %d", len(block), 1)
+	if block.Len() != 1 {
+		t.Fatalf("block has %d markers, expected %d", block.Len(), 1)
 	}
-	if len(block2) != 2 {
-		t.Fatalf("block2 has %d markers, expected %d", len(block2), 2)
+	if block2.Len() != 2 {
+		t.Fatalf("block2 has %d markers, expected %d", block2.Len(), 2)
 	}
 	unblock2 := block2.EndBlock()
 	if !unblock2.Equal(block) {
@@ -65,8 +178,8 @@ func TestStore_getset(t *testing.T) {
 	st := NewStore()
 	block := st.BeginBlock()
 	unblock := block.EndBlock()
-	a := "a"
-	b := "b"
+	a := newVar("a")
+	b := newVar("b")
 
 	block, _ = block.Define(a, permission.Mutable)
 	if !unblock.Equal(st) {
@@ -99,25 +212,44 @@ func TestStore_getset(t *testing.T) {
 
 func TestStore_Define(t *testing.T) {
 	store := NewStore()
-	store, _ = store.Define("a", permission.Mutable)
-	if len(store) != 1 {
-		t.Fatalf("Length is %d should be %d", len(store), 1)
+	a := newVar("a")
+	store, _ = store.Define(a, permission.Mutable)
+	if store.Len() != 1 {
+		t.Fatalf("Length is %d should be %d", store.Len(), 1)
+	}
+	if store.GetEffective(a) != permission.Mutable {
+		t.Errorf("Should be mutable, is %v", store.GetEffective(a))
+	}
+	store, _ = store.Define(a, permission.Read)
+	if store.Len() != 1 {
+		t.Errorf("Length is %d should be %d", store.Len(), 1)
 	}
-	if store.GetEffective("a") != permission.Mutable {
-		t.Errorf("Should be mutable, is %v", store.GetEffective("a"))
+	if store.GetEffective(a) != permission.Read {
+		t.Errorf("Should be read-only, is %v", store.GetEffective(a))
 	}
-	store, _ = store.Define("a", permission.Read)
-	if len(store) != 1 {
-		t.Errorf("Length is %d should be %d", len(store), 1)
+}
+
+func TestStore_DefineShadowed(t *testing.T) {
+	outer := newVar("a")
+	inner := newVar("a")
+	store, _ := NewStore().Define(outer, permission.Mutable)
+	store, _ = store.BeginBlock().Define(inner, permission.Read)
+	if store.GetEffective(outer) != permission.Mutable {
+		t.Errorf("Outer a should be mutable, is %v", store.GetEffective(outer))
+	}
+	if store.GetEffective(inner) != permission.Read {
+		t.Errorf("Inner a should be read-only, is %v", store.GetEffective(inner))
 	}
-	if store.GetEffective("a") != permission.Read {
-		t.Errorf("Should be read-only, is %v", store.GetEffective("a"))
+	store, _ = store.SetEffective(inner, permission.None)
+	if store.EndBlock().GetEffective(outer) != permission.Mutable {
+		t.Errorf("Outer a should still be mutable, is %v", store.EndBlock().GetEffective(outer))
 	}
 }
+
 func TestStore_SetEffectiveSetMaximum(t *testing.T) {
 	block := NewStore()
-	a := "a"
-	b := "b"
+	a := newVar("a")
+	b := newVar("b")
 	block, _ = block.Define(a, permission.Mutable)
 	block, _ = block.Define(b, permission.ReadOnly)
 
@@ -144,7 +276,7 @@ func TestStore_SetEffectiveSetMaximum(t *testing.T) {
 
 	// Check that setting an invalid maximum does not change value
 	block1, err := block.SetMaximum(b, &permission.InterfacePermission{BasePermission: permission.ReadOnly})
-	if block1 != nil {
+	if block1.Len() != 0 {
 		t.Errorf("setting max produced a block")
 	}
 	if err == nil {
@@ -168,9 +300,12 @@ func TestStore_SetEffectiveSetMaximum(t *testing.T) {
 	// Check that setting effective with a different type of max does not change
 	// anything
 	complexPerm := &permission.InterfacePermission{BasePermission: permission.ReadOnly}
-	block[0].max = complexPerm
+	block, _ = block.update(b, func(e *storeEntry) error {
+		e.max = complexPerm
+		return nil
+	})
 	block1, err = block.SetEffective(b, permission.Mutable)
-	if block1 != nil {
+	if block1.Len() != 0 {
 		t.Errorf("setting effective produced a result despite max being other shape")
 	}
 	if err == nil {
@@ -187,6 +322,76 @@ func TestStore_SetEffectiveSetMaximum(t *testing.T) {
 
 }
 
+func TestStore_Provenance(t *testing.T) {
+	a := newVar("a")
+	st, _ := NewStore().Define(a, permission.Mutable)
+	if pos, _ := st.Provenance(a); pos != token.NoPos {
+		t.Errorf("Defined variable has provenance %v", pos)
+	}
+
+	moved, _ := st.SetEffectiveAt(a, permission.None, 42, "moved")
+	if pos, reason := moved.Provenance(a); pos != 42 || reason != "moved" {
+		t.Errorf("Expected provenance 42 moved, received %v %s", pos, reason)
+	}
+	if dead, _ := st.SetEffective(a, permission.None); !moved.Equal(dead) {
+		t.Errorf("Provenance should not affect equality")
+	}
+
+	// Merging keeps the reason for the weaker permission, from either side.
+	for _, pair := range [][2]Store{{st, moved}, {moved, st}} {
+		st3, err := pair[0].Merge(pair[1])
+		if err != nil {
+			t.Fatalf("Cannot merge: %s", err)
+		}
+		if pos, _ := st3.Provenance(a); pos != 42 {
+			t.Errorf("Expected merged provenance 42, received %v", pos)
+		}
+	}
+
+	released, _ := moved.SetEffective(a, permission.Mutable)
+	if pos, _ := released.Provenance(a); pos != token.NoPos {
+		t.Errorf("Released variable has provenance %v", pos)
+	}
+	if pos, _ := released.Provenance(newVar("b")); pos != token.NoPos {
+		t.Errorf("Unknown variable has provenance %v", pos)
+	}
+}
+
+func TestStore_deferred(t *testing.T) {
+	a := newVar("a")
+	b := newVar("b")
+	st, _ := NewStore().BeginBlock().Define(a, permission.Mutable)
+	st, _ = st.Define(b, permission.Mutable)
+	stmt1 := &ast.DeferStmt{Defer: 1}
+	stmt2 := &ast.DeferStmt{Defer: 2}
+
+	deferred := st.addDeferred(deferredCall{stmt: stmt1, released: []Borrowed{{a, permission.Mutable}}})
+	if deferred.Equal(st) || deferred.Hash() == st.Hash() {
+		t.Errorf("Pending deferred calls should affect equality")
+	}
+	if moved, _ := deferred.SetEffective(a, permission.None); len(moved.deferred) != 1 || len(moved.EndBlock().deferred) != 1 {
+		t.Errorf("Pending deferred calls lost in %v", moved)
+	}
+
+	// A join has the calls pending on either path, and the values released
+	// by a call on both.
+	other := st.addDeferred(deferredCall{stmt: stmt1, released: []Borrowed{{b, permission.Mutable}}})
+	other = other.addDeferred(deferredCall{stmt: stmt2})
+	merged, err := deferred.Merge(other)
+	if err != nil {
+		t.Fatalf("Cannot merge: %s", err)
+	}
+	if len(merged.deferred) != 2 || merged.deferred[0].stmt != stmt1 || merged.deferred[1].stmt != stmt2 {
+		t.Errorf("Expected both calls to be pending, received %v", merged.deferred)
+	}
+	if len(merged.deferred[0].released) != 2 || len(deferred.deferred[0].released) != 1 {
+		t.Errorf("Expected a and b to be released in merged store only, received %v", merged.deferred[0].released)
+	}
+	if again, _ := merged.Merge(other); !again.Equal(merged) {
+		t.Errorf("Merging pending deferred calls is not idempotent: %v vs %v", again.deferred, merged.deferred)
+	}
+}
+
 func TestStore_panic(t *testing.T) {
 	shouldPanic := func(name string, exp string, fun func()) {
 		defer func() {
@@ -198,29 +403,28 @@ func TestStore_panic(t *testing.T) {
 		fun()
 	}
 	st := NewStore()
-	shouldPanic("setMaximum", "nonexisting", func() { st.SetMaximum("a", permission.Mutable) })
-	shouldPanic("setEffective", "nonexisting", func() { st.SetEffective("a", permission.Mutable) })
+	shouldPanic("setMaximum", "nonexisting", func() { st.SetMaximum(newVar("a"), permission.Mutable) })
+	shouldPanic("setEffective", "nonexisting", func() { st.SetEffective(newVar("a"), permission.Mutable) })
 	shouldPanic("EndBlock without block", "Not inside a block", func() { NewStore().EndBlock() })
 }
 
 func TestStore_Merge(t *testing.T) {
 	// Test case 0: nils
-	st := make(Store, 1)
-	if merged, err := st.Merge(nil); !merged.Equal(st) || err != nil {
+	st := NewStore().BeginBlock()
+	if merged, err := st.Merge(Store{}); !merged.Equal(st) || err != nil {
 		t.Errorf("Merge with rhs = nil is != lhs, merged=%v, error=%s", merged, err)
 	}
-	if merged, err := Store(nil).Merge(st); !merged.Equal(st) || err != nil {
+	if merged, err := (Store{}).Merge(st); !merged.Equal(st) || err != nil {
 		t.Errorf("Merge with lhs = nil is != rhs, merged=%v, error=%s", merged, err)
 	}
-	if merged, err := Store(nil).Merge(nil); merged != nil || err != nil {
+	if merged, err := (Store{}).Merge(Store{}); merged.Len() != 0 || err != nil {
 		t.Errorf("Merge(nil, nil)=%v, expected=nil, error=%s", merged, err)
 	}
 
 	// Test case 1: Succesful merge
-	st1 := make(Store, 1)
-	st1[0].name = "a"
-	st1[0].eff = &permission.InterfacePermission{BasePermission: permission.ReadOnly}
-	st1[0].max = &permission.InterfacePermission{BasePermission: permission.Mutable}
+	a := newVar("a")
+	aEff := &permission.InterfacePermission{BasePermission: permission.ReadOnly}
+	st1 := NewStore().push(storeEntry{obj: a, eff: aEff, max: &permission.InterfacePermission{BasePermission: permission.Mutable}})
 	st11, err := st1.Merge(st1)
 	if err != nil {
 		t.Errorf("Could not merge %v with itself: %s", st1, err)
@@ -228,10 +432,7 @@ func TestStore_Merge(t *testing.T) {
 		t.Errorf("st11 = %v does not equal st1 = %v", st11, st1)
 	}
 	// Test case 2 a) Incompatible effective permissions
-	st2a := make(Store, 1)
-	st2a[0].name = st1[0].name
-	st2a[0].eff = permission.ReadOnly
-	st2a[0].max = permission.Mutable
+	st2a := NewStore().push(storeEntry{obj: a, eff: permission.ReadOnly, max: permission.Mutable})
 	st12a, err := st1.Merge(st2a)
 	if err == nil {
 		t.Errorf("Could merge st1=%v with st2a=%v: %v", st1, st2a, st12a)
@@ -240,10 +441,7 @@ func TestStore_Merge(t *testing.T) {
 	}
 
 	// Test case 2 b) Incompatible effective permissions
-	st2b := make(Store, 1)
-	st2b[0].name = st1[0].name
-	st2b[0].eff = st1[0].eff
-	st2b[0].max = permission.Mutable
+	st2b := NewStore().push(storeEntry{obj: a, eff: aEff, max: permission.Mutable})
 	st12b, err := st1.Merge(st2b)
 	if err == nil {
 		t.Errorf("Could merge st1=%v with st2b=%v: %v", st1, st2b, st12b)
@@ -252,10 +450,7 @@ func TestStore_Merge(t *testing.T) {
 	}
 
 	// Test case 3: Different identifiers
-	st3 := make(Store, 1)
-	st3[0].name = "b"
-	st3[0].eff = permission.ReadOnly
-	st3[0].max = permission.Mutable
+	st3 := NewStore().push(storeEntry{obj: newVar("b"), eff: permission.ReadOnly, max: permission.Mutable})
 	st13, err := st1.Merge(st3)
 	if err == nil {
 		t.Errorf("Could merge st1=%v with st3=%v: %v", st1, st3, st13)
@@ -263,3 +458,91 @@ func TestStore_Merge(t *testing.T) {
 		t.Errorf("Unexpected error for st13: %s, expected Different ident", err)
 	}
 }
+
+// generateFunction returns a package opted in to checking with a function of
+// n statements. Each statement defines a new variable, except for every
+// tenth, which branches.
+func generateFunction(n int) string {
+	var buf bytes.Buffer
+	buf.WriteString("//lingo:check\npackage main\n\nfunc long(p *int) *int {\n\tv0 := 0\n")
+	for k := 1; k < n; k++ {
+		if k%10 == 0 {
+			fmt.Fprintf(&buf, "\tif v%d > v%d {\n\t\tv%d = v%d\n\t} else {\n\t\tv%d = v%d\n\t}\n", k-1, k-2, k-3, k-1, k-3, k-2)
+		}
+		fmt.Fprintf(&buf, "\tv%d := v%d + 1\n", k, k-1)
+	}
+	fmt.Fprintf(&buf, "\tprintln(v%d)\n\treturn p\n}\n", n-1)
+	return buf.String()
+}
+
+func BenchmarkStore_longFunction(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "long.go", generateFunction(2000), goparser.ParseComments)
+	if err != nil {
+		b.Fatalf("Parse error: %s", err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		config := Config{}
+		info := Info{}
+		if err := config.Check("long", fset, []*ast.File{f}, &info); err != nil {
+			b.Fatalf("Check failed: %s", err)
+		}
+		if info.Skipped != 0 {
+			b.Fatalf("Function was not checked")
+		}
+	}
+}
+
+// benchmarkPerm is the permission of variables in benchmark stores.
+var benchmarkPerm = &permission.PointerPermission{BasePermission: permission.Mutable, Target: permission.Mutable}
+
+// newBenchmarkStore returns a store with n variables in a block.
+func newBenchmarkStore(n int) (Store, []types.Object) {
+	var objs []types.Object
+	st := NewStore().BeginBlock()
+	for k := 0; k < n; k++ {
+		obj := newVar(fmt.Sprintf("v%d", k))
+		objs = append(objs, obj)
+		st, _ = st.Define(obj, benchmarkPerm)
+	}
+	return st, objs
+}
+
+func BenchmarkStore_SetEffective(b *testing.B) {
+	// Variables are updated at different depths of the store.
+	for _, test := range []struct {
+		name  string
+		index func(n, length int) int
+	}{
+		{"newest", func(n, length int) int { return length - 1 - n%10 }},
+		{"oldest", func(n, length int) int { return n % 10 }},
+		{"all", func(n, length int) int { return n * 7919 % length }},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			st, objs := newBenchmarkStore(2000)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				var err error
+				if st, err = st.SetEffective(objs[test.index(n, len(objs))], benchmarkPerm); err != nil {
+					b.Fatalf("Cannot set effective permission: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStore_Equal(b *testing.B) {
+	st, objs := newBenchmarkStore(2000)
+	st1, _ := st.SetEffective(objs[len(objs)-1], benchmarkPerm)
+	st2, _ := st.SetEffective(objs[len(objs)-1], benchmarkPerm)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !st1.Equal(st2) {
+			b.Fatalf("Stores are not equal")
+		}
+	}
+}
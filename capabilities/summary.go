@@ -0,0 +1,480 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"runtime"
+	"strings"
+
+	"github.com/julian-klode/lingolang/permission"
+)
+
+// maxSummaryRounds bounds the number of times the functions in a recursive
+// component of the call graph are interpreted to infer their summaries. It
+// is a variable for testing.
+var maxSummaryRounds = 10
+
+// callGraph is the call graph of the functions declared in a package.
+type callGraph struct {
+	funcs []*types.Func // In order of declaration
+	decls map[*types.Func]*ast.FuncDecl
+	calls map[*types.Func][]*types.Func
+}
+
+// newCallGraph builds the call graph of the functions declared in files. Any
+// use of a function counts as a call, as function values can be called later.
+func (c *Checker) newCallGraph(files []*ast.File) *callGraph {
+	g := &callGraph{
+		decls: make(map[*types.Func]*ast.FuncDecl),
+		calls: make(map[*types.Func][]*types.Func),
+	}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			decl, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			if fn, ok := c.info.Types.Defs[decl.Name].(*types.Func); ok {
+				g.funcs = append(g.funcs, fn)
+				g.decls[fn] = decl
+			}
+		}
+	}
+	for _, fn := range g.funcs {
+		seen := make(map[*types.Func]bool)
+		ast.Inspect(g.decls[fn], func(node ast.Node) bool {
+			ident, ok := node.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			callee, ok := c.info.Types.Uses[ident].(*types.Func)
+			if ok && g.decls[callee] != nil && !seen[callee] {
+				seen[callee] = true
+				g.calls[fn] = append(g.calls[fn], callee)
+			}
+			return true
+		})
+	}
+	return g
+}
+
+// components returns the strongly connected components of the call graph,
+// using Tarjan's algorithm. Callees come before their callers.
+func (g *callGraph) components() [][]*types.Func {
+	var components [][]*types.Func
+	var stack []*types.Func
+	index := make(map[*types.Func]int)
+	lowlink := make(map[*types.Func]int)
+	onStack := make(map[*types.Func]bool)
+
+	var visit func(fn *types.Func)
+	visit = func(fn *types.Func) {
+		index[fn] = len(index)
+		lowlink[fn] = index[fn]
+		stack = append(stack, fn)
+		onStack[fn] = true
+
+		for _, callee := range g.calls[fn] {
+			if _, visited := index[callee]; !visited {
+				visit(callee)
+				if lowlink[callee] < lowlink[fn] {
+					lowlink[fn] = lowlink[callee]
+				}
+			} else if onStack[callee] && index[callee] < lowlink[fn] {
+				lowlink[fn] = index[callee]
+			}
+		}
+
+		if lowlink[fn] != index[fn] {
+			return
+		}
+		var component []*types.Func
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == fn {
+				break
+			}
+		}
+		components = append(components, component)
+	}
+
+	for _, fn := range g.funcs {
+		if _, visited := index[fn]; !visited {
+			visit(fn)
+		}
+	}
+	return components
+}
+
+// isRecursive checks whether the functions in component call each other.
+func (g *callGraph) isRecursive(component []*types.Func) bool {
+	if len(component) > 1 {
+		return true
+	}
+	for _, callee := range g.calls[component[0]] {
+		if callee == component[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFunctions computes summaries for all functions declared in the
+// package and then checks the function bodies against them. Errors in a
+// statement do not stop checking the function, see recoverError().
+//
+// Only the functions opted in by a "//lingo:check" directive, on the function
+// or on the package clause, are checked; the others are counted in Skipped.
+//
+// A function annotated with a permission uses that as its summary. For other
+// functions, the parameters get the permissions of their types, and the
+// results are inferred from the return statements: They start out as the
+// owned permissions of their types and are intersected with the returned
+// permissions until they do not change anymore. Components are summarized
+// callees first, so each function only sees summaries of callees in the
+// same component that are not final yet. Unchecked functions are not
+// interpreted, so their summaries are the permissions the default policy
+// chooses for their parameters and results.
+func (c *Checker) checkFunctions(files []*ast.File) {
+	for _, f := range files {
+		if hasCheckDirective(f.Comments, f.Package) {
+			c.checkPackage = true
+		}
+	}
+	c.annotateGlobals(files)
+	g := c.newCallGraph(files)
+	for _, component := range g.components() {
+		c.summarize(g, component)
+	}
+	for _, fn := range g.funcs {
+		decl := g.decls[fn]
+		if decl.Body == nil {
+			continue
+		}
+		if !c.isChecked(decl) {
+			c.Skipped++
+			c.skipSuppressions(decl)
+			continue
+		}
+		i := c.newInterpreter()
+		i.onError = func(err *interpreterError) {
+			c.report(c.interpreterDiagnostic(err))
+		}
+		err := catchInterpreterError(func() {
+			i.visitFuncDecl(c.globalStore(), decl, c.summaries[fn])
+		})
+		if err, ok := err.(*interpreterError); ok {
+			c.report(c.interpreterDiagnostic(err))
+		} else if err != nil {
+			c.errorf(decl.Name.Pos(), CodeInterpreter, "%s", err)
+		}
+	}
+}
+
+// checkDirective is the directive opting functions in to be checked.
+const checkDirective = "//lingo:check"
+
+// isChecked checks whether the function declared by decl was opted in to
+// be checked.
+func (c *Checker) isChecked(decl *ast.FuncDecl) bool {
+	return c.checkPackage || hasCheckDirective([]*ast.CommentGroup{decl.Doc}, decl.Pos())
+}
+
+// hasCheckDirective checks whether a comment in the groups before pos is a
+// "//lingo:check" directive.
+func hasCheckDirective(groups []*ast.CommentGroup, pos token.Pos) bool {
+	for _, cmtGrp := range groups {
+		if cmtGrp == nil {
+			continue
+		}
+		for _, cmt := range cmtGrp.List {
+			if cmt.Pos() < pos && strings.TrimSpace(cmt.Text) == checkDirective {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// summarize infers the summaries of a component of the call graph. If the
+// summaries of a recursive component do not stabilize, they are not sound,
+// so their results lose all permissions, and an error is reported.
+func (c *Checker) summarize(g *callGraph, component []*types.Func) {
+	var inferred []*types.Func
+	for _, fn := range component {
+		perm, annotated := c.initialSummary(fn, g.decls[fn])
+		c.summaries[fn] = perm
+		if !annotated && g.decls[fn].Body != nil && c.isChecked(g.decls[fn]) {
+			inferred = append(inferred, fn)
+		}
+	}
+
+	rounds := 1
+	recursive := g.isRecursive(component)
+	if recursive {
+		rounds = maxSummaryRounds
+	}
+	changed := false
+	for round := 0; round < rounds; round++ {
+		changed = false
+		for _, fn := range inferred {
+			perm := c.inferSummary(g.decls[fn], c.summaries[fn])
+			if !permission.Equal(perm, c.summaries[fn]) {
+				c.summaries[fn] = perm
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	if !changed || !recursive {
+		return
+	}
+	for _, fn := range inferred {
+		perm := *c.summaries[fn]
+		perm.Results = make([]permission.Permission, len(c.summaries[fn].Results))
+		for k, result := range c.summaries[fn].Results {
+			perm.Results[k] = permission.ConvertToBase(result, permission.None)
+		}
+		c.summaries[fn] = &perm
+		c.errorf(g.decls[fn].Name.Pos(), CodeNoConvergence, "Summary of %s did not stabilize after %d rounds, its results have no permissions", fn.Name(), rounds)
+	}
+}
+
+// initialSummary returns the annotated permission of a function, or the
+// permission inference of its results starts with.
+func (c *Checker) initialSummary(fn *types.Func, decl *ast.FuncDecl) (*permission.FuncPermission, bool) {
+	typPerm := c.typeMapper.NewFromType(fn.Type()).(*permission.FuncPermission)
+	if ann, ok := c.pmap[decl]; ok && ann != nil {
+		ann = c.resolveNames(ann, fn.Type(), decl.Name.Pos(), decl)
+		perm, err := permission.ConvertTo(typPerm, ann)
+		if err == nil {
+			if perm, ok := perm.(*permission.FuncPermission); ok {
+				return perm, true
+			}
+		}
+		d := c.diagnostic(decl.Name.Pos(), CodeBadPermission, "Cannot use permission %s for function %s: %v", ann, fn.Name(), err)
+		d.Related = c.annotatedHere(decl)
+		c.report(d)
+	}
+
+	return c.defaultSummary(fn.Type().(*types.Signature)), false
+}
+
+// defaultSummary creates the permission of a declared function without
+// annotation, whose receiver, parameters, and results get the permissions
+// the default policy chooses for them.
+func (c *Checker) defaultSummary(sig *types.Signature) *permission.FuncPermission {
+	perm := &permission.FuncPermission{
+		BasePermission: c.conf.defaults()(sig, permission.GlobalContext),
+	}
+	if recv := sig.Recv(); recv != nil {
+		perm.Receivers = append(perm.Receivers, c.typeMapper.NewFromTypeIn(recv.Type(), permission.ParamContext))
+	}
+	for k := 0; k < sig.Params().Len(); k++ {
+		perm.Params = append(perm.Params, c.typeMapper.NewFromTypeIn(sig.Params().At(k).Type(), permission.ParamContext))
+	}
+	for k := 0; k < sig.Results().Len(); k++ {
+		perm.Results = append(perm.Results, c.typeMapper.NewFromTypeIn(sig.Results().At(k).Type(), permission.ResultContext))
+	}
+	return perm
+}
+
+// inferSummary interprets the body of decl with the summary perm, and returns
+// a new summary whose results are intersected with the returned permissions.
+// Errors are ignored here, they are reported when checking the function.
+func (c *Checker) inferSummary(decl *ast.FuncDecl, perm *permission.FuncPermission) *permission.FuncPermission {
+	i := c.newInterpreter()
+	i.inferring = true
+	i.inferred = make([]permission.Permission, len(perm.Results))
+	catchInterpreterError(func() {
+		i.visitFuncDecl(c.globalStore(), decl, perm)
+	})
+
+	next := *perm
+	next.Results = make([]permission.Permission, len(perm.Results))
+	for k, result := range perm.Results {
+		next.Results[k] = result
+		if i.inferred[k] == nil {
+			continue
+		}
+		if result, err := permission.Intersect(result, i.inferred[k]); err == nil {
+			next.Results[k] = result
+		}
+	}
+	return &next
+}
+
+// newInterpreter creates an interpreter for the functions of the package.
+func (c *Checker) newInterpreter() *Interpreter {
+	return &Interpreter{
+		typesInfo:  &c.info.Types,
+		fset:       c.fset,
+		typeMapper: c.typeMapper,
+		summaries:  c.summaries,
+		noReturn:   c.noReturn,
+
+		AnnotatedPermissions: c.locals,
+		annotationComments:   c.localComments,
+
+		MaxIterations: c.conf.MaxIterations,
+		UseCFG:        c.conf.UseCFG,
+		reported:      make(map[ast.Node]bool),
+		poisoned:      make(map[types.Object]bool),
+	}
+}
+
+// globalStore returns a store defining the package-level variables. They
+// are owned, unless annotated otherwise.
+func (c *Checker) globalStore() Store {
+	st := NewStore()
+	scope := c.pkg.Scope()
+	for _, name := range scope.Names() {
+		v, ok := scope.Lookup(name).(*types.Var)
+		if !ok {
+			continue
+		}
+		perm := c.typeMapper.NewFromTypeIn(v.Type(), permission.GlobalContext)
+		if ann, ok := c.globals[v]; ok {
+			perm = ann
+		}
+		st, _ = st.Define(v, perm)
+	}
+	return st
+}
+
+// annotateGlobals converts the annotations of package-level variables to
+// permissions for their types.
+func (c *Checker) annotateGlobals(files []*ast.File) {
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.ValueSpec)
+				var annotated ast.Node = spec
+				if c.pmap[spec] == nil && len(gen.Specs) == 1 {
+					annotated = gen
+				}
+				ann := c.pmap[annotated]
+				if ann == nil {
+					continue
+				}
+				for _, name := range spec.Names {
+					v, ok := c.info.Types.Defs[name].(*types.Var)
+					if !ok {
+						continue
+					}
+					ann := c.resolveNames(ann, v.Type(), name.Pos(), annotated)
+					perm, err := permission.ConvertTo(c.typeMapper.NewFromType(v.Type()), ann)
+					if err != nil {
+						d := c.diagnostic(name.Pos(), CodeBadPermission, "Cannot use permission %s for variable %s: %s", ann, name, err)
+						d.Related = c.annotatedHere(annotated)
+						c.report(d)
+						continue
+					}
+					c.globals[v] = perm
+				}
+			}
+		}
+	}
+}
+
+// annotateLocals collects the annotations of variables defined in function
+// bodies, by short variable declarations or var declarations. They are
+// converted to the permissions of the values when the variables are
+// defined, see Interpreter.defineOrAssign().
+func (c *Checker) annotateLocals(files []*ast.File) {
+	c.locals = make(map[ast.Expr]permission.Permission)
+	c.localComments = make(map[ast.Expr]*ast.Comment)
+	annotate := func(annotated ast.Node, names []ast.Expr) {
+		ann := c.pmap[annotated]
+		if ann == nil {
+			return
+		}
+		for _, name := range names {
+			ident, ok := name.(*ast.Ident)
+			if !ok || ident.Name == "_" {
+				continue
+			}
+			if typ := c.info.Types.TypeOf(ident); typ != nil {
+				c.locals[ident] = c.resolveNames(ann, typ, ident.Pos(), annotated)
+				c.localComments[ident] = c.comments[annotated]
+			}
+		}
+	}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			ast.Inspect(fn.Body, func(node ast.Node) bool {
+				switch node := node.(type) {
+				case *ast.AssignStmt:
+					if node.Tok == token.DEFINE {
+						annotate(node, node.Lhs)
+					}
+				case *ast.DeclStmt:
+					gen, ok := node.Decl.(*ast.GenDecl)
+					if !ok || gen.Tok != token.VAR {
+						break
+					}
+					for _, spec := range gen.Specs {
+						spec := spec.(*ast.ValueSpec)
+						var annotated ast.Node = spec
+						if c.pmap[spec] == nil && len(gen.Specs) == 1 {
+							annotated = node
+						}
+						names := make([]ast.Expr, len(spec.Names))
+						for k, name := range spec.Names {
+							names[k] = name
+						}
+						annotate(annotated, names)
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+// resolveNames resolves the names of fields and parameters in the annotation
+// of node against typ, reporting mismatches at pos.
+func (c *Checker) resolveNames(ann permission.Permission, typ types.Type, pos token.Pos, node ast.Node) permission.Permission {
+	ann, errs := permission.ResolveNames(ann, typ)
+	for _, err := range errs {
+		d := c.diagnostic(pos, CodeBadPermission, "Cannot use permission %s: %s", ann, err)
+		d.Related = c.annotatedHere(node)
+		c.report(d)
+	}
+	return ann
+}
+
+// catchInterpreterError runs f and returns the error the interpreter
+// reported, if any. Other panics are passed on.
+func catchInterpreterError(f func()) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		e, ok := r.(error)
+		if _, isRuntime := r.(runtime.Error); !ok || isRuntime {
+			panic(r)
+		}
+		err = e
+	}()
+	f()
+	return nil
+}
@@ -0,0 +1,357 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	goparser "go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/julian-klode/lingolang/permission"
+)
+
+// checkSummaries checks the source of a package, and returns the checker.
+func checkSummaries(t *testing.T, src string) *Checker {
+	return checkSummariesWith(t, Config{}, src)
+}
+
+// checkSummariesWith checks the source of a package with the given config.
+func checkSummariesWith(t *testing.T, config Config, src string) *Checker {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "summary.go", src, goparser.ParseComments)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+	info := Info{}
+	checker := NewChecker(&config, &info, "summary", fset)
+	checker.Files([]*ast.File{f})
+	return checker
+}
+
+// summaryOf returns the summary of the function with the given name.
+func summaryOf(t *testing.T, c *Checker, name string) *permission.FuncPermission {
+	for fn, perm := range c.summaries {
+		if fn.Name() == name {
+			return perm
+		}
+	}
+	t.Fatalf("No function %s", name)
+	return nil
+}
+
+func TestSummaries(t *testing.T) {
+	testCases := []struct {
+		name    string
+		src     string
+		results map[string]string
+		err     string
+	}{
+		{"recursive",
+			`//lingo:check
+			package main
+			func count(p *int, n int) int {
+				if n == 0 {
+					return 0
+				}
+				return count(p, n-1) + 1
+			}`,
+			map[string]string{"count": "om"},
+			"",
+		},
+		{"mutuallyRecursive",
+			`//lingo:check
+			package main
+			func even(p *int, n int) *int {
+				if n == 0 {
+					return p
+				}
+				return odd(p, n-1)
+			}
+			func odd(p *int, n int) *int {
+				if n == 0 {
+					return nil
+				}
+				return even(p, n-1)
+			}`,
+			map[string]string{"even": "m * m", "odd": "m * m"},
+			"",
+		},
+		{"recursiveOwnedResult",
+			`//lingo:check
+			package main
+			func alloc(n int) *int {
+				if n == 0 {
+					return new(int)
+				}
+				return alloc(n - 1)
+			}`,
+			map[string]string{"alloc": "om * om"},
+			"",
+		},
+		{"annotatedCallee",
+			`//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {
+			}
+			// @perm func (om * om)
+			func once(p *int) {
+				consume(p)
+			}`,
+			nil,
+			"",
+		},
+		{"annotatedCalleeTwice",
+			`//lingo:check
+			package main
+			// @perm func (om * om)
+			func consume(p *int) {
+			}
+			// @perm func (om * om)
+			func twice(p *int) {
+				consume(p)
+				consume(p)
+			}`,
+			nil,
+			"Cannot bind parameter 0: Cannot copy or move",
+		},
+		{"builtinWithoutResult",
+			`//lingo:check
+			package main
+			func show(n int) {
+				println(n)
+			}`,
+			nil,
+			"",
+		},
+		{"method",
+			`//lingo:check
+			package main
+			type T struct {
+				x *int
+			}
+			func (t *T) get() *int {
+				return t.x
+			}
+			func use(t *T) *int {
+				return t.get()
+			}`,
+			map[string]string{"get": "m * m", "use": "m * m"},
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		for _, config := range []Config{{}, {UseCFG: true}} {
+			t.Run(fmt.Sprintf("%s/cfg=%v", test.name, config.UseCFG), func(t *testing.T) {
+				c := checkSummariesWith(t, config, test.src)
+				if test.err == "" && len(c.Errors) > 0 {
+					t.Fatalf("Unexpected errors %v", c.Errors)
+				}
+				if test.err != "" && (len(c.Errors) == 0 || !strings.Contains(c.Errors[0].Error(), test.err)) {
+					t.Fatalf("Expected error %s, received %v", test.err, c.Errors)
+				}
+				for name, result := range test.results {
+					expected, err := permission.NewParser(result).Parse()
+					if err != nil {
+						t.Fatalf("Cannot parse %s: %s", result, err)
+					}
+					perm := summaryOf(t, c, name)
+					if len(perm.Results) != 1 || !reflect.DeepEqual(perm.Results[0], expected) {
+						t.Errorf("Expected %s to return %v, received %v", name, expected, perm.Results)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCheckFunctions_maxIterations(t *testing.T) {
+	src := `//lingo:check
+	package main
+	func loop() {
+		n := 0
+		for i := 0; i < 10; i++ {
+			n = n + i
+		}
+		println(n)
+	}`
+	c := checkSummariesWith(t, Config{MaxIterations: 1}, src)
+	if len(c.Errors) == 0 || !strings.Contains(c.Errors[0].Error(), "did not stabilize after 1 iterations") {
+		t.Errorf("Expected iteration limit error, received %v", c.Errors)
+	}
+	c = checkSummaries(t, src)
+	if len(c.Errors) != 0 {
+		t.Errorf("Unexpected errors %v", c.Errors)
+	}
+}
+
+func TestCheckFunctions_recoveredPanic(t *testing.T) {
+	// The deferred calls run once when unwinding the panic, and not again
+	// when the function returns after recovering.
+	src := `//lingo:check
+	package main
+	// @perm func (om * om)
+	func consume(p *int) {}
+	func f() {
+		a := new(int)
+		defer func() { recover() }()
+		defer consume(a)
+		panic(1)
+	}`
+	for _, config := range []Config{{}, {UseCFG: true}} {
+		c := checkSummariesWith(t, config, src)
+		if len(c.Errors) != 0 {
+			t.Errorf("UseCFG=%v: Unexpected errors %v", config.UseCFG, c.Errors)
+		}
+	}
+}
+
+func TestCheckFunctions_noReturn(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"annotatedFunction", `
+			// @noreturn
+			func die() { panic(1) }
+			func f(n int) {
+				a := new(int)
+				if n > 0 {
+					consume(a)
+					die()
+				}
+				consume(a)
+			}`, ""},
+		{"annotatedExitSkipsDeferred", `
+			// @noreturn exit
+			func die() { panic(1) }
+			func f(b interface{ f() }, n int) {
+				defer func() { b.f() }()
+				if n > 0 {
+					go b.f()
+					die()
+				}
+			}`, ""},
+		{"annotatedPanicRunsDeferred", `
+			// @noreturn panic
+			func die() { panic(1) }
+			func f(b interface{ f() }, n int) {
+				defer func() { b.f() }()
+				if n > 0 {
+					go b.f()
+					die()
+				}
+			}`, "cannot use b anymore"},
+		{"notAnnotated", `
+			func die() { panic(1) }
+			func f(n int) {
+				a := new(int)
+				if n > 0 {
+					consume(a)
+					die()
+				}
+				consume(a)
+			}`, "Cannot copy or move"},
+		{"loggerMethod", `
+			import "log"
+			func f(l *log.Logger, n int) {
+				a := new(int)
+				if n > 0 {
+					consume(a)
+					l.Fatal(n)
+				}
+				consume(a)
+			}`, ""},
+		{"testingMethod", `
+			import "testing"
+			func f(t *testing.T, n int) {
+				a := new(int)
+				if n > 0 {
+					consume(a)
+					t.FailNow()
+				}
+				consume(a)
+			}`, ""},
+		{"unknownKind", `
+			// @noreturn later
+			func die() { panic(1) }`, "Unknown kind of exit"},
+		{"notAFunction", `
+			// @noreturn
+			var x int`, "Only functions"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			src := "//lingo:check\npackage main\n" + test.src + "\n// @perm func (om * om)\nfunc consume(p *int) {}"
+			config := Config{}
+			config.Types.Importer = importer.ForCompiler(token.NewFileSet(), "source", nil)
+			c := checkSummariesWith(t, config, src)
+			if test.err == "" && len(c.Errors) > 0 {
+				t.Fatalf("Unexpected errors %v", c.Errors)
+			}
+			if test.err != "" && (len(c.Errors) == 0 || !strings.Contains(c.Errors[0].Error(), test.err)) {
+				t.Fatalf("Expected error %s, received %v", test.err, c.Errors)
+			}
+		})
+	}
+}
+
+func TestSummaries_maxRounds(t *testing.T) {
+	src := `//lingo:check
+	package main
+	func even(p *int, n int) *int {
+		if n == 0 {
+			return p
+		}
+		return odd(p, n-1)
+	}
+	func odd(p *int, n int) *int {
+		if n == 0 {
+			return nil
+		}
+		return even(p, n-1)
+	}`
+	defer func(rounds int) { maxSummaryRounds = rounds }(maxSummaryRounds)
+	maxSummaryRounds = 1
+	c := checkSummaries(t, src)
+	if len(c.Errors) != 2 || c.Errors[0].Code != CodeNoConvergence || !strings.Contains(c.Errors[0].Message, "did not stabilize after 1 rounds") {
+		t.Errorf("Expected errors about both functions, received %v", c.Errors)
+	}
+	if perm := summaryOf(t, c, "even"); fmt.Sprint(perm.Results) != "[n * r]" {
+		t.Errorf("Expected results without permissions, received %v", perm.Results)
+	}
+}
+
+func TestCheckFunctions_optIn(t *testing.T) {
+	c := checkSummaries(t, `package main
+	// @perm func (om * om)
+	func consume(p *int) {}
+	func unchecked(p *int) *int {
+		consume(p)
+		consume(p)
+		return p
+	}
+	//lingo:check
+	func checked() {
+		a := new(int)
+		b := unchecked(a)
+		println(*a, *b)
+	}`)
+	if len(c.Errors) != 0 {
+		t.Errorf("Unexpected errors %v", c.Errors)
+	}
+	if c.Skipped != 2 {
+		t.Errorf("Expected 2 skipped functions, received %d", c.Skipped)
+	}
+	// Unchecked functions are not inferred, but use the default policy.
+	if perm := summaryOf(t, c, "unchecked"); fmt.Sprint(perm) != "om func (m * m) om * om" {
+		t.Errorf("Unexpected summary %v", perm)
+	}
+}
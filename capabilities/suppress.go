@@ -0,0 +1,120 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+// ignoreDirective is the directive suppressing diagnostics in a statement.
+const ignoreDirective = "//lingo:ignore"
+
+// suppression is a "//lingo:ignore CODE reason" comment, which suppresses
+// the diagnostics with the code in the statement it belongs to: the
+// statement ending on the line of the comment, or else the statement
+// starting on the line after it.
+type suppression struct {
+	cmt        *ast.Comment
+	code       Code
+	start, end token.Position // Range of the statement
+	used       bool           // Whether a diagnostic was suppressed
+}
+
+// collectSuppressions collects the suppressions in the files, reporting
+// malformed ones.
+func (c *Checker) collectSuppressions(files []*ast.File) {
+	for _, f := range files {
+		for _, cmtGrp := range f.Comments {
+			for _, cmt := range cmtGrp.List {
+				if !strings.HasPrefix(cmt.Text, ignoreDirective) {
+					continue
+				}
+				rest := cmt.Text[len(ignoreDirective):]
+				if rest != "" && !strings.ContainsAny(rest[:1], " \t") {
+					continue
+				}
+				args := strings.Fields(rest)
+				switch {
+				case len(args) == 0:
+					c.errorf(cmt.Slash, CodeBadAnnotation, "Missing diagnostic code to ignore")
+					continue
+				case len(args) == 1:
+					c.errorf(cmt.Slash, CodeBadAnnotation, "Missing reason for ignoring %s", args[0])
+					continue
+				}
+				s := &suppression{cmt: cmt, code: Code(args[0])}
+				if stmt := c.suppressedStmt(f, cmt); stmt != nil {
+					s.start = c.fset.Position(stmt.Pos())
+					s.end = c.fset.Position(stmt.End())
+				}
+				c.suppressions = append(c.suppressions, s)
+			}
+		}
+	}
+}
+
+// suppressedStmt finds the statement a suppression comment belongs to, or
+// returns nil if there is none.
+func (c *Checker) suppressedStmt(f *ast.File, cmt *ast.Comment) ast.Stmt {
+	line := c.fset.Position(cmt.Pos()).Line
+	var before, after ast.Stmt
+	ast.Inspect(f, func(node ast.Node) bool {
+		stmt, ok := node.(ast.Stmt)
+		// Blocks start on the line of their function or statement.
+		if _, isBlock := node.(*ast.BlockStmt); !ok || isBlock {
+			return true
+		}
+		// Outer statements are visited first, and are preferred.
+		if before == nil && stmt.End() <= cmt.Pos() && c.fset.Position(stmt.End()).Line == line {
+			before = stmt
+		}
+		if after == nil && c.fset.Position(stmt.Pos()).Line == line+1 {
+			after = stmt
+		}
+		return true
+	})
+	if before != nil {
+		return before
+	}
+	return after
+}
+
+// suppressed checks whether a diagnostic is suppressed, and marks the
+// suppression as used.
+func (c *Checker) suppressed(d Diagnostic) bool {
+	for _, s := range c.suppressions {
+		if s.code == d.Code && s.contains(d.Pos) {
+			s.used = true
+			return true
+		}
+	}
+	return false
+}
+
+// contains checks whether pos is in the statement of the suppression.
+func (s *suppression) contains(pos token.Position) bool {
+	return s.start.IsValid() && pos.Filename == s.start.Filename && s.start.Offset <= pos.Offset && pos.Offset < s.end.Offset
+}
+
+// skipSuppressions marks the suppressions in a function that is not checked
+// as used, as they may be needed once it is checked.
+func (c *Checker) skipSuppressions(decl *ast.FuncDecl) {
+	for _, s := range c.suppressions {
+		if decl.Pos() <= s.cmt.Pos() && s.cmt.End() <= decl.End() {
+			s.used = true
+		}
+	}
+}
+
+// warnUnusedSuppressions warns about suppressions that did not suppress any
+// diagnostic, suggesting to remove them.
+func (c *Checker) warnUnusedSuppressions() {
+	for _, s := range c.suppressions {
+		if !s.used {
+			c.warnf(s.cmt.Slash, s.cmt.End(), "", CodeUnusedSuppression, "Suppression of %s is not used", s.code)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import (
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestSuppressions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		src      string
+		errors   []Code
+		warnings []Code
+	}{
+		{"lineBefore", `
+			//lingo:check
+			func f() {
+				a := new(int)
+				consume(a)
+				//lingo:ignore LINGO012 reviewed, the value is not used afterwards
+				consume(a)
+			}`, nil, nil},
+		{"endOfLine", `
+			//lingo:check
+			func f() {
+				a := new(int)
+				consume(a)
+				consume(a) //lingo:ignore LINGO012 reviewed
+			}`, nil, nil},
+		{"otherCode", `
+			//lingo:check
+			func f() {
+				a := new(int)
+				consume(a)
+				consume(a) //lingo:ignore LINGO011 wrong code
+			}`, []Code{CodeCannotMove}, []Code{CodeUnusedSuppression}},
+		{"otherStatement", `
+			//lingo:check
+			func f() {
+				a := new(int)
+				//lingo:ignore LINGO012 wrong statement
+				consume(a)
+				consume(a)
+			}`, []Code{CodeCannotMove}, []Code{CodeUnusedSuppression}},
+		{"missingReason", `
+			//lingo:check
+			func f() {
+				a := new(int)
+				consume(a) //lingo:ignore LINGO012
+			}`, []Code{CodeBadAnnotation}, nil},
+		{"uncheckedFunction", `
+			func g() {
+				a := new(int)
+				consume(a) //lingo:ignore LINGO012 once g is checked
+			}`, nil, nil},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			src := "package main\n// @perm func (om * om)\nfunc consume(p *int) {}\n" + test.src
+			f, err := goparser.ParseFile(fset, "suppress.go", src, goparser.ParseComments)
+			if err != nil {
+				t.Fatalf("Parse error: %s", err) // parse error
+			}
+			config := Config{}
+			info := Info{}
+			config.Check("hello", fset, []*ast.File{f}, &info)
+			if len(info.Errors) != len(test.errors) {
+				t.Fatalf("Expected errors %v, received %v", test.errors, info.Errors)
+			}
+			for k, code := range test.errors {
+				if info.Errors[k].Code != code {
+					t.Errorf("Expected error %s, received %v", code, info.Errors[k])
+				}
+			}
+			if len(info.Warnings) != len(test.warnings) {
+				t.Fatalf("Expected warnings %v, received %v", test.warnings, info.Warnings)
+			}
+			for k, code := range test.warnings {
+				if info.Warnings[k].Code != code || info.Warnings[k].Fix == nil || info.Warnings[k].Fix.NewText != "" {
+					t.Errorf("Expected warning %s removing the comment, received %v", code, info.Warnings[k])
+				}
+			}
+		})
+	}
+}
+
+func TestSuppressions_bailout(t *testing.T) {
+	fset := token.NewFileSet()
+	src := `package main
+		// @perm func (om * om)
+		func consume(p *int) {}
+
+		//lingo:check
+		func f() {
+			a := new(int)
+			consume(a)
+			consume(a) //lingo:ignore LINGO011 wrong code
+		}`
+	f, err := goparser.ParseFile(fset, "suppress.go", src, goparser.ParseComments)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err) // parse error
+	}
+	config := Config{MaxErrors: 1}
+	info := Info{}
+	config.Check("hello", fset, []*ast.File{f}, &info)
+	if len(info.Errors) != 1 || info.Errors[0].Code != CodeCannotMove {
+		t.Fatalf("Expected one error %s, received %v", CodeCannotMove, info.Errors)
+	}
+	if len(info.Warnings) != 1 || info.Warnings[0].Code != CodeUnusedSuppression {
+		t.Errorf("Expected warning %s after bailing out, received %v", CodeUnusedSuppression, info.Warnings)
+	}
+}
@@ -0,0 +1,171 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package capabilities
+
+import "go/types"
+
+// trieBits is the number of bits of a position or hash consumed by each
+// level of a trie, and trieWidth the resulting number of children of a node.
+const (
+	trieBits  = 4
+	trieWidth = 1 << trieBits
+)
+
+// entryNode is a node of a persistent vector of store entries, indexed by
+// position. Inner nodes have children, leaves have entries. Changing an
+// entry copies the nodes on the path to it, and shares all other nodes.
+type entryNode struct {
+	children [trieWidth]*entryNode
+	entries  [trieWidth]*storeEntry
+}
+
+// entryCapacity returns the number of entries a vector with the given number
+// of levels can hold.
+func entryCapacity(levels uint) int {
+	if levels == 0 {
+		return 0
+	}
+	return 1 << (trieBits * levels)
+}
+
+// get returns the entry at position k of the vector rooted at n.
+func (n *entryNode) get(levels uint, k int) *storeEntry {
+	for l := levels - 1; l > 0; l-- {
+		n = n.children[(k>>(trieBits*l))%trieWidth]
+	}
+	return n.entries[k%trieWidth]
+}
+
+// set returns a vector in which the entry at position k is e. Missing nodes
+// on the path are created.
+func (n *entryNode) set(levels uint, k int, e *storeEntry) *entryNode {
+	var c entryNode
+	if n != nil {
+		c = *n
+	}
+	if levels == 1 {
+		c.entries[k%trieWidth] = e
+		return &c
+	}
+	slot := (k >> (trieBits * (levels - 1))) % trieWidth
+	c.children[slot] = c.children[slot].set(levels-1, k, e)
+	return &c
+}
+
+// walkChanged calls f for the entries at the positions below length that
+// differ between the vectors a and b rooted at position base, skipping
+// shared nodes and entries. It stops when f returns false, and returns
+// whether it did not stop.
+func walkChanged(a, b *entryNode, levels uint, base, length int, f func(k int, a, b *storeEntry) bool) bool {
+	if a == b || base >= length {
+		return true
+	}
+	if levels == 1 {
+		for k := 0; k < trieWidth && base+k < length; k++ {
+			if a.entries[k] != b.entries[k] && !f(base+k, a.entries[k], b.entries[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	size := entryCapacity(levels - 1)
+	for k := 0; k < trieWidth; k++ {
+		if !walkChanged(a.children[k], b.children[k], levels-1, base+k*size, length, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexNode is a node of a persistent hash trie mapping objects to the
+// position of their innermost entry in a store. Leaves have items, all with
+// the same hash; inner nodes have children.
+type indexNode struct {
+	children [trieWidth]*indexNode
+	items    []indexItem
+}
+
+// indexItem is an object and its position in the store.
+type indexItem struct {
+	hash uint64
+	obj  types.Object
+	pos  int
+}
+
+// indexSlot returns the child of an inner node at the given depth that the
+// hash belongs to.
+func indexSlot(hash uint64, depth uint) int {
+	return int((hash >> (trieBits * depth)) % trieWidth)
+}
+
+// get returns the position of obj, if it is in the trie rooted at n.
+func (n *indexNode) get(obj types.Object, hash uint64) (int, bool) {
+	for depth := uint(0); n != nil; depth++ {
+		if n.items == nil {
+			n = n.children[indexSlot(hash, depth)]
+			continue
+		}
+		for _, it := range n.items {
+			if it.obj == obj {
+				return it.pos, true
+			}
+		}
+		break
+	}
+	return 0, false
+}
+
+// put returns a trie in which it.obj is at the position it.pos.
+func (n *indexNode) put(depth uint, it indexItem) *indexNode {
+	switch {
+	case n == nil:
+		return &indexNode{items: []indexItem{it}}
+	case n.items != nil && n.items[0].hash == it.hash:
+		items := make([]indexItem, 0, len(n.items)+1)
+		for _, old := range n.items {
+			if old.obj != it.obj {
+				items = append(items, old)
+			}
+		}
+		return &indexNode{items: append(items, it)}
+	case n.items != nil:
+		// Split the leaf. The hashes differ, so they end up in
+		// different leaves at some depth.
+		inner := &indexNode{}
+		inner.children[indexSlot(n.items[0].hash, depth)] = n
+		return inner.put(depth, it)
+	}
+	c := *n
+	slot := indexSlot(it.hash, depth)
+	c.children[slot] = c.children[slot].put(depth+1, it)
+	return &c
+}
+
+// remove returns a trie without obj.
+func (n *indexNode) remove(depth uint, obj types.Object, hash uint64) *indexNode {
+	switch {
+	case n == nil:
+		return nil
+	case n.items != nil:
+		var items []indexItem
+		for _, old := range n.items {
+			if old.obj != obj {
+				items = append(items, old)
+			}
+		}
+		if items == nil {
+			return nil
+		}
+		return &indexNode{items: items}
+	}
+	c := *n
+	slot := indexSlot(hash, depth)
+	c.children[slot] = c.children[slot].remove(depth+1, obj, hash)
+	for _, child := range c.children {
+		if child != nil {
+			return &c
+		}
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	goparser "go/parser"
 	"go/token"
 	"log"
+	"os"
 
 	"github.com/julian-klode/lingolang/capabilities"
 	"github.com/julian-klode/lingolang/permission"
@@ -48,8 +49,17 @@ func main() {
 	config := capabilities.Config{}
 	info := capabilities.Info{}
 	err = config.Check("hello", fset, []*ast.File{f}, &info)
+	for _, d := range append(info.Errors, info.Warnings...) {
+		fmt.Println(d)
+		for _, r := range d.Related {
+			fmt.Printf("\t%s: %s\n", r.Pos, r.Message)
+		}
+	}
+	if info.Skipped > 0 {
+		fmt.Printf("%d functions not checked, add //lingo:check to check them\n", info.Skipped)
+	}
 	if err != nil {
-		panic(err)
+		os.Exit(1)
 	}
 
 }
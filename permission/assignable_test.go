@@ -223,11 +223,11 @@ func TestAssignableToBase_InvalidMode(t *testing.T) {
 
 func TestAssignableTo_InterfaceSubset(t *testing.T) {
 	a := &InterfacePermission{Owned | Mutable, []*FuncPermission{
-		&FuncPermission{Owned | Mutable, "func1", nil, nil, nil},
-		&FuncPermission{Owned | Mutable, "func2", nil, nil, nil},
+		&FuncPermission{BasePermission: Owned | Mutable, Name: "func1"},
+		&FuncPermission{BasePermission: Owned | Mutable, Name: "func2"},
 	}}
 	b := &InterfacePermission{Owned | Mutable, []*FuncPermission{
-		&FuncPermission{Owned | Mutable, "func2", nil, nil, nil},
+		&FuncPermission{BasePermission: Owned | Mutable, Name: "func2"},
 	}}
 	if !MovableTo(a, b) {
 		t.Fatalf("Cannot move a to b")
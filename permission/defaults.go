@@ -0,0 +1,56 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import "go/types"
+
+// Context describes where a value is used, so a default permission can be
+// chosen for it.
+type Context int
+
+// The contexts of values.
+const (
+	// A local variable, or a temporary value.
+	LocalContext Context = iota
+	// A parameter or receiver of a function.
+	ParamContext
+	// A result of a function.
+	ResultContext
+	// A part of another value: A struct field, an element of an array,
+	// slice, map, or channel, or the target of a pointer.
+	FieldContext
+	// A package-level variable, constant, or function.
+	GlobalContext
+)
+
+// DefaultPolicy chooses the base permission of a value of type t in the
+// context ctx, if the value has no annotated or declared permission.
+type DefaultPolicy func(t types.Type, ctx Context) BasePermission
+
+// MutableDefaults is the standard policy: Values are mutable, and only
+// variables and results of functions are owned.
+func MutableDefaults(t types.Type, ctx Context) BasePermission {
+	switch ctx {
+	case LocalContext, ResultContext, GlobalContext:
+		return Owned | Mutable
+	default:
+		return Mutable
+	}
+}
+
+// LegacyDefaults is a permissive policy for code without annotations, the
+// same as for external Go functions: Parameters need no permissions, and
+// all other values have any non-linear permission.
+func LegacyDefaults(t types.Type, ctx Context) BasePermission {
+	if ctx == ParamContext {
+		return None
+	}
+	return Any
+}
+
+// StrictDefaults is a strict policy making all values owned and linear, so
+// passing a value to a function moves it.
+func StrictDefaults(t types.Type, ctx Context) BasePermission {
+	return Owned | Mutable
+}
@@ -0,0 +1,52 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"fmt"
+	"go/types"
+	"testing"
+)
+
+func TestDefaultPolicies(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   DefaultPolicy
+		ctx      Context
+		expected string
+	}{
+		{"mutableLocal", MutableDefaults, LocalContext, "om * om"},
+		{"mutableParam", MutableDefaults, ParamContext, "m * m"},
+		{"mutableResult", MutableDefaults, ResultContext, "om * om"},
+		{"legacyParam", LegacyDefaults, ParamContext, "n * rw"},
+		{"legacyGlobal", LegacyDefaults, GlobalContext, "a * a"},
+		{"strictParam", StrictDefaults, ParamContext, "om * om"},
+	}
+	typ := types.NewPointer(types.Typ[types.Int])
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			perm := NewTypeMapperWithDefaults(test.policy).NewFromTypeIn(typ, test.ctx)
+			if fmt.Sprint(perm) != test.expected {
+				t.Errorf("Expected %s, received %s", test.expected, perm)
+			}
+		})
+	}
+}
+
+func TestNewFromTypeIn_annotatedType(t *testing.T) {
+	typ, err := Parsed("*int")
+	if err != nil {
+		t.Fatalf("Invalid test input: %s", err)
+	}
+	mapper := NewTypeMapper()
+	mapper.AnnotateType(typ.(*types.Named).Obj(), Value)
+
+	// The declared permission stays, the policy decides ownership.
+	if perm := mapper.NewFromTypeIn(typ, LocalContext); fmt.Sprint(perm) != "ov * or" {
+		t.Errorf("Expected ov * or, received %s", perm)
+	}
+	if perm := mapper.NewFromTypeIn(typ, ParamContext); fmt.Sprint(perm) != "v * r" {
+		t.Errorf("Expected v * r, received %s", perm)
+	}
+}
@@ -0,0 +1,270 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode"
+)
+
+// This file serializes permissions, so they can be cached, or exchanged
+// between the checks of different packages. Permissions are graphs, so
+// the JSON encoding is a list of nodes referring to each other by their
+// index. The text encoding is the syntax of the parser, without spaces.
+
+// jsonGraph is the JSON encoding of a permission.
+type jsonGraph struct {
+	Root  int        `json:"root"`  // Index of the permission in Nodes
+	Nodes []jsonNode `json:"nodes"` // Nodes of the permission graph
+}
+
+// jsonNode is the JSON encoding of a node in a permission graph. Children
+// are given as indices into the list of nodes, or -1 for nil.
+type jsonNode struct {
+	Kind      string `json:"kind"`
+	Base      string `json:"base,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Children  []int  `json:"children,omitempty"`
+	Receivers []int  `json:"receivers,omitempty"`
+	Params    []int  `json:"params,omitempty"`
+	Results   []int  `json:"results,omitempty"`
+	// Names of the children of structs, and of the receivers, parameters,
+	// and results of functions, if given.
+	Names         []string `json:"names,omitempty"`
+	ReceiverNames []string `json:"receiverNames,omitempty"`
+	ParamNames    []string `json:"paramNames,omitempty"`
+	ResultNames   []string `json:"resultNames,omitempty"`
+}
+
+// EncodeJSON encodes a permission as JSON. Nodes are numbered in the order
+// they are first reached, so minimized permissions that are equal have the
+// same encoding.
+func EncodeJSON(perm Permission) ([]byte, error) {
+	var graph jsonGraph
+	index := make(map[Permission]int)
+	var encode func(perm Permission) int
+	encode = func(perm Permission) int {
+		if perm == nil {
+			return -1
+		}
+		if k, ok := index[perm]; ok {
+			return k
+		}
+		k := len(graph.Nodes)
+		index[perm] = k
+		graph.Nodes = append(graph.Nodes, jsonNode{})
+		node := jsonNode{Kind: jsonKind(perm)}
+		switch p := perm.(type) {
+		case *WildcardPermission, *NilPermission:
+		case *FuncPermission:
+			node.Base = p.BasePermission.String()
+			node.Name = p.Name
+			node.Receivers = encodeAll(encode, p.Receivers)
+			node.Params = encodeAll(encode, p.Params)
+			node.Results = encodeAll(encode, p.Results)
+			node.ReceiverNames = p.ReceiverNames
+			node.ParamNames = p.ParamNames
+			node.ResultNames = p.ResultNames
+		case *StructPermission:
+			node.Base = p.BasePermission.String()
+			node.Children = encodeAll(encode, p.Fields)
+			node.Names = p.FieldNames
+		default:
+			node.Base = perm.GetBasePermission().String()
+			node.Children = encodeAll(encode, childrenOf(perm))
+		}
+		graph.Nodes[k] = node
+		return k
+	}
+	graph.Root = encode(perm)
+	return json.Marshal(graph)
+}
+
+// encodeAll encodes a list of permissions, returning their indices.
+func encodeAll(encode func(Permission) int, perms []Permission) []int {
+	indices := make([]int, len(perms))
+	for k, perm := range perms {
+		indices[k] = encode(perm)
+	}
+	return indices
+}
+
+// jsonKind returns the kind of a permission in the JSON encoding.
+func jsonKind(perm Permission) string {
+	switch perm.(type) {
+	case BasePermission:
+		return "base"
+	case *PointerPermission:
+		return "pointer"
+	case *ChanPermission:
+		return "chan"
+	case *ArrayPermission:
+		return "array"
+	case *SlicePermission:
+		return "slice"
+	case *MapPermission:
+		return "map"
+	case *StructPermission:
+		return "struct"
+	case *FuncPermission:
+		return "func"
+	case *InterfacePermission:
+		return "interface"
+	case *WildcardPermission:
+		return "wildcard"
+	case *TuplePermission:
+		return "tuple"
+	case *NilPermission:
+		return "nil"
+	}
+	panic(fmt.Errorf("Cannot encode permission %v of unknown kind", perm))
+}
+
+// DecodeJSON decodes a permission encoded by EncodeJSON().
+func DecodeJSON(data []byte) (Permission, error) {
+	var graph jsonGraph
+	if err := json.Unmarshal(data, &graph); err != nil {
+		return nil, err
+	}
+
+	// Create the nodes first, so children can refer to any of them.
+	perms := make([]Permission, len(graph.Nodes))
+	for k, node := range graph.Nodes {
+		var base BasePermission
+		if node.Base != "" {
+			perm, err := NewParser(node.Base).Parse()
+			var ok bool
+			if base, ok = perm.(BasePermission); err != nil || !ok {
+				return nil, fmt.Errorf("Node %d: Invalid base permission %q", k, node.Base)
+			}
+		}
+		if perms[k] = newNode(base, node); perms[k] == nil {
+			return nil, fmt.Errorf("Node %d: Unknown kind %q", k, node.Kind)
+		}
+	}
+
+	child := func(k int) (Permission, error) {
+		switch {
+		case k == -1:
+			return nil, nil
+		case k < 0 || k >= len(perms):
+			return nil, fmt.Errorf("Reference to node %d out of range", k)
+		}
+		return perms[k], nil
+	}
+	for k, node := range graph.Nodes {
+		var children []Permission
+		for _, c := range [][]int{node.Children, node.Receivers, node.Params, node.Results} {
+			for _, c := range c {
+				perm, err := child(c)
+				if err != nil {
+					return nil, fmt.Errorf("Node %d: %s", k, err)
+				}
+				children = append(children, perm)
+			}
+		}
+		if len(children) != len(childrenOf(perms[k])) {
+			return nil, fmt.Errorf("Node %d: A %s cannot have %d children", k, node.Kind, len(children))
+		}
+		for _, c := range children {
+			if _, isFunc := c.(*FuncPermission); node.Kind == "interface" && !isFunc {
+				return nil, fmt.Errorf("Node %d: Only methods can be part of interfaces", k)
+			}
+		}
+		for _, names := range [][2]int{{len(node.Names), len(node.Children)}, {len(node.ReceiverNames), len(node.Receivers)}, {len(node.ParamNames), len(node.Params)}, {len(node.ResultNames), len(node.Results)}} {
+			if names[0] != 0 && names[0] != names[1] {
+				return nil, fmt.Errorf("Node %d: %d names given for %d children", k, names[0], names[1])
+			}
+		}
+		setChildren(perms[k], children)
+	}
+	if graph.Root < 0 || graph.Root >= len(perms) {
+		return nil, fmt.Errorf("Root node %d out of range", graph.Root)
+	}
+	return perms[graph.Root], nil
+}
+
+// newNode creates a permission for a node, with room for its children. It
+// returns nil if the node is of an unknown kind.
+func newNode(base BasePermission, node jsonNode) Permission {
+	switch node.Kind {
+	case "base":
+		return base
+	case "pointer":
+		return &PointerPermission{BasePermission: base}
+	case "chan":
+		return &ChanPermission{BasePermission: base}
+	case "array":
+		return &ArrayPermission{BasePermission: base}
+	case "slice":
+		return &SlicePermission{BasePermission: base}
+	case "map":
+		return &MapPermission{BasePermission: base}
+	case "struct":
+		return &StructPermission{BasePermission: base, Fields: make([]Permission, len(node.Children)), FieldNames: node.Names}
+	case "func":
+		return &FuncPermission{
+			BasePermission: base,
+			Name:           node.Name,
+			Receivers:      make([]Permission, len(node.Receivers)),
+			Params:         make([]Permission, len(node.Params)),
+			Results:        make([]Permission, len(node.Results)),
+			ReceiverNames:  node.ReceiverNames,
+			ParamNames:     node.ParamNames,
+			ResultNames:    node.ResultNames,
+		}
+	case "interface":
+		return &InterfacePermission{BasePermission: base, Methods: make([]*FuncPermission, len(node.Children))}
+	case "wildcard":
+		return &WildcardPermission{}
+	case "tuple":
+		return &TuplePermission{BasePermission: base, Elements: make([]Permission, len(node.Children))}
+	case "nil":
+		return &NilPermission{}
+	}
+	return nil
+}
+
+// EncodeText encodes a permission in the syntax of the parser, minimized,
+// and without any optional spaces. Tuples and nil have no syntax, so they
+// cannot be encoded.
+func EncodeText(perm Permission) (string, error) {
+	var err error
+	visited := make(map[Permission]bool)
+	var check func(perm Permission)
+	check = func(perm Permission) {
+		switch perm.(type) {
+		case nil, *TuplePermission, *NilPermission:
+			err = fmt.Errorf("Cannot encode %v as text", perm)
+		}
+		if visited[perm] || err != nil {
+			return
+		}
+		visited[perm] = true
+		for _, child := range childrenOf(perm) {
+			check(child)
+		}
+	}
+	check(perm)
+	if err != nil {
+		return "", err
+	}
+
+	text := []rune(permissionString(perm))
+	var compact []rune
+	for k, r := range text {
+		// Spaces are only needed to separate words.
+		if r == ' ' && (k == 0 || k == len(text)-1 || !unicode.IsLetter(text[k-1]) || !unicode.IsLetter(text[k+1])) {
+			continue
+		}
+		compact = append(compact, r)
+	}
+	return string(compact), nil
+}
+
+// DecodeText decodes a permission encoded by EncodeText().
+func DecodeText(text string) (Permission, error) {
+	return NewParser(text).Parse()
+}
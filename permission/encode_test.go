@@ -0,0 +1,144 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"reflect"
+	"testing"
+)
+
+// encodingCorpus returns permissions to check the encodings with: All
+// permissions from the other tests, and some that cannot be parsed.
+func encodingCorpus(t *testing.T) []Permission {
+	var inputs []interface{}
+	for _, test := range testcasesString {
+		inputs = append(inputs, test.input)
+	}
+	for _, test := range testcasesEqual {
+		inputs = append(inputs, test.A, test.B)
+	}
+	for _, test := range testcasesAssignableTo {
+		inputs = append(inputs, test.from, test.to)
+	}
+	var corpus []Permission
+	for _, input := range inputs {
+		perm, err := MakePermission(input)
+		if err != nil {
+			t.Fatalf("Invalid permission %v: %s", input, err)
+		}
+		corpus = append(corpus, perm)
+	}
+	for base := BasePermission(0); base <= Owned|Mutable; base++ {
+		corpus = append(corpus, base)
+	}
+	return append(corpus, &NilPermission{}, MakeRecursivePointer(true), MakeRecursiveStruct(false))
+}
+
+func TestEncodeJSON(t *testing.T) {
+	// Only JSON can encode missing children.
+	for _, perm := range append(encodingCorpus(t), &PointerPermission{BasePermission: Mutable}) {
+		perm := Minimize(perm)
+		data, err := EncodeJSON(perm)
+		if err != nil {
+			t.Fatalf("Cannot encode %v: %s", perm, err)
+		}
+		decoded, err := DecodeJSON(data)
+		if err != nil {
+			t.Fatalf("Cannot decode %s: %s", data, err)
+		}
+		if !reflect.DeepEqual(perm, decoded) {
+			t.Errorf("%s decoded to %v, expected %v", data, decoded, perm)
+		}
+		if again, _ := EncodeJSON(decoded); string(again) != string(data) {
+			t.Errorf("%v encoded to %s and then %s", perm, data, again)
+		}
+	}
+}
+
+func TestEncodeText(t *testing.T) {
+	for _, perm := range encodingCorpus(t) {
+		perm := Minimize(perm)
+		text, err := EncodeText(perm)
+		switch perm.(type) {
+		case *TuplePermission, *NilPermission:
+			if err == nil {
+				t.Errorf("Encoded %v as %s", perm, text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot encode %v: %s", perm, err)
+		}
+		decoded, err := DecodeText(text)
+		if err != nil {
+			t.Fatalf("Cannot decode %s: %s", text, err)
+		}
+		if !reflect.DeepEqual(perm, Minimize(decoded)) {
+			t.Errorf("%s decoded to %v, expected %v", text, decoded, perm)
+		}
+	}
+}
+
+func TestEncodeText_compact(t *testing.T) {
+	for input, expected := range map[string]string{
+		"A = om * om struct {v; l; A}": "A=om*om struct{v;l;A}",
+		"om func (om) m chan ov":       "om func(om)m chan ov",
+		"om map[_] [_] ov":             "om map[_]om[_]ov",
+	} {
+		perm, _ := NewParser(input).Parse()
+		if text, _ := EncodeText(perm); text != expected {
+			t.Errorf("Expected %s to be encoded as %s, received %s", input, expected, text)
+		}
+	}
+}
+
+// TestEncode_merge checks that intersections and unions of decoded
+// permissions are the same as the ones of the originals.
+func TestEncode_merge(t *testing.T) {
+	corpus := encodingCorpus(t)
+	decoded := make([]Permission, len(corpus))
+	for k, perm := range corpus {
+		corpus[k] = Minimize(perm)
+		data, _ := EncodeJSON(corpus[k])
+		decoded[k], _ = DecodeJSON(data)
+	}
+	for k := range corpus {
+		for l := k; l < len(corpus); l++ {
+			if kindOf(corpus[k]) != kindOf(corpus[l]) {
+				continue
+			}
+			for _, merge := range []func(A, B Permission) (Permission, error){Intersect, Union} {
+				expected, expectedErr := merge(corpus[k], corpus[l])
+				result, err := merge(decoded[k], decoded[l])
+				if (err == nil) != (expectedErr == nil) || !reflect.DeepEqual(result, expected) {
+					t.Errorf("Merging %v and %v: Expected %v (%v), received %v (%v)", corpus[k], corpus[l], expected, expectedErr, result, err)
+				}
+			}
+		}
+	}
+}
+
+func TestEncode_invalid(t *testing.T) {
+	for _, data := range []string{
+		`{`,
+		`{"root": 0, "nodes": []}`,
+		`{"root": 0, "nodes": [{"kind": "unknown"}]}`,
+		`{"root": 0, "nodes": [{"kind": "base", "base": "x"}]}`,
+		`{"root": 0, "nodes": [{"kind": "base", "base": "om * om"}]}`,
+		`{"root": 0, "nodes": [{"kind": "pointer", "base": "om"}]}`,
+		`{"root": 0, "nodes": [{"kind": "pointer", "base": "om", "children": [1]}]}`,
+		`{"root": 0, "nodes": [{"kind": "pointer", "base": "om", "children": [-2]}]}`,
+		`{"root": 0, "nodes": [{"kind": "interface", "base": "om", "children": [1]}, {"kind": "base", "base": "om"}]}`,
+	} {
+		if perm, err := DecodeJSON([]byte(data)); err == nil {
+			t.Errorf("Decoded invalid %s to %v", data, perm)
+		}
+	}
+
+	for _, perm := range []Permission{nil, &PointerPermission{BasePermission: Mutable}} {
+		if text, err := EncodeText(perm); err == nil {
+			t.Errorf("Encoded %v as %s", perm, text)
+		}
+	}
+}
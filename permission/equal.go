@@ -0,0 +1,209 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import "fmt"
+
+// This file compares permissions structurally, and computes canonical forms
+// of them. Permissions are graphs that may contain cycles, so the same
+// permission can be written in several ways: "A = om * A" and
+// "A = om * om * A" both describe an infinite chain of owned mutable
+// pointers.
+
+// Equal checks whether two permissions are equivalent, that is, whether
+// they describe the same infinite tree when their cycles are unrolled.
+//
+// Two permissions are assumed equal while their components are compared,
+// so comparing cyclic permissions terminates (the check is a bisimulation).
+func Equal(A, B Permission) bool {
+	return equal(A, B, make(map[[2]Permission]bool))
+}
+
+func equal(A, B Permission, assumed map[[2]Permission]bool) bool {
+	if A == B {
+		return true
+	}
+	if A == nil || B == nil || nodeSignature(A) != nodeSignature(B) {
+		return false
+	}
+	key := [2]Permission{A, B}
+	if assumed[key] {
+		return true
+	}
+	assumed[key] = true
+	childrenA, childrenB := childrenOf(A), childrenOf(B)
+	for i := range childrenA {
+		if !equal(childrenA[i], childrenB[i], assumed) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSignature describes a permission without its children, but with the
+// names of fields and parameters. Equal permissions have equal signatures,
+// and the same number of children.
+func nodeSignature(perm Permission) string {
+	switch perm := perm.(type) {
+	case nil:
+		return "nil"
+	case *StructPermission:
+		return fmt.Sprintf("struct %d %d %q", perm.BasePermission, len(perm.Fields), perm.FieldNames)
+	case *FuncPermission:
+		return fmt.Sprintf("func %d %s %d %d %d %q %q %q", perm.BasePermission, perm.Name, len(perm.Receivers), len(perm.Params), len(perm.Results),
+			perm.ReceiverNames, perm.ParamNames, perm.ResultNames)
+	}
+	return fmt.Sprintf("%s %d %d", kindOf(perm), baseOf(perm), len(childrenOf(perm)))
+}
+
+// Minimize returns the canonical form of a permission: The smallest graph
+// in which no two nodes are equivalent, see Equal(). Equal permissions have
+// minimized forms that only differ in the identity of their nodes.
+//
+// This partitions the nodes of the permission into blocks of nodes that
+// look the same, and splits blocks until all nodes in a block have children
+// in the same blocks. Each block then becomes one node of the result.
+func Minimize(perm Permission) Permission {
+	var nodes []Permission
+	block := make(map[Permission]int)
+	var collect func(perm Permission)
+	collect = func(perm Permission) {
+		if _, ok := block[perm]; ok || perm == nil {
+			return
+		}
+		block[perm] = -1
+		nodes = append(nodes, perm)
+		for _, child := range childrenOf(perm) {
+			collect(child)
+		}
+	}
+	collect(perm)
+	if len(nodes) == 0 {
+		return perm
+	}
+
+	// Split the blocks until they are stable. The number of blocks only
+	// grows, so it stops changing once the partition is stable.
+	for numBlocks := -1; ; {
+		ids := make(map[string]int)
+		next := make(map[Permission]int, len(nodes))
+		for _, node := range nodes {
+			key := nodeSignature(node)
+			if numBlocks >= 0 {
+				key = fmt.Sprint(block[node])
+				for _, child := range childrenOf(node) {
+					key += fmt.Sprintf(" %d", blockOf(block, child))
+				}
+			}
+			id, ok := ids[key]
+			if !ok {
+				id = len(ids)
+				ids[key] = id
+			}
+			next[node] = id
+		}
+		block = next
+		if len(ids) == numBlocks {
+			break
+		}
+		numBlocks = len(ids)
+	}
+
+	// Build one node per block, and then link the nodes.
+	representatives := make(map[int]Permission)
+	for _, node := range nodes {
+		if _, ok := representatives[block[node]]; !ok {
+			representatives[block[node]] = shallowCopy(node)
+		}
+	}
+	for _, node := range nodes {
+		result := representatives[block[node]]
+		children := childrenOf(node)
+		for i := range children {
+			if children[i] != nil {
+				children[i] = representatives[blockOf(block, children[i])]
+			}
+		}
+		setChildren(result, children)
+	}
+	return representatives[block[perm]]
+}
+
+// blockOf returns the block of a node, or -1 for nil.
+func blockOf(block map[Permission]int, perm Permission) int {
+	if perm == nil {
+		return -1
+	}
+	return block[perm]
+}
+
+// shallowCopy copies a permission node, sharing its children until they
+// are replaced by setChildren(). Base permissions are values already.
+func shallowCopy(perm Permission) Permission {
+	switch perm := perm.(type) {
+	case *PointerPermission:
+		c := *perm
+		return &c
+	case *ChanPermission:
+		c := *perm
+		return &c
+	case *ArrayPermission:
+		c := *perm
+		return &c
+	case *SlicePermission:
+		c := *perm
+		return &c
+	case *MapPermission:
+		c := *perm
+		return &c
+	case *StructPermission:
+		c := *perm
+		c.Fields = make([]Permission, len(perm.Fields))
+		return &c
+	case *FuncPermission:
+		c := *perm
+		c.Receivers = make([]Permission, len(perm.Receivers))
+		c.Params = make([]Permission, len(perm.Params))
+		c.Results = make([]Permission, len(perm.Results))
+		return &c
+	case *InterfacePermission:
+		c := *perm
+		c.Methods = make([]*FuncPermission, len(perm.Methods))
+		return &c
+	case *TuplePermission:
+		c := *perm
+		c.Elements = make([]Permission, len(perm.Elements))
+		return &c
+	}
+	return perm
+}
+
+// setChildren replaces the children of a node copied by shallowCopy(), in
+// the order childrenOf() returns them.
+func setChildren(perm Permission, children []Permission) {
+	switch perm := perm.(type) {
+	case *PointerPermission:
+		perm.Target = children[0]
+	case *ChanPermission:
+		perm.ElementPermission = children[0]
+	case *ArrayPermission:
+		perm.ElementPermission = children[0]
+	case *SlicePermission:
+		perm.ElementPermission = children[0]
+	case *MapPermission:
+		perm.KeyPermission, perm.ValuePermission = children[0], children[1]
+	case *StructPermission:
+		copy(perm.Fields, children)
+	case *FuncPermission:
+		children = children[copy(perm.Receivers, children):]
+		children = children[copy(perm.Params, children):]
+		copy(perm.Results, children)
+	case *InterfacePermission:
+		for i, method := range children {
+			perm.Methods[i] = method.(*FuncPermission)
+		}
+	case *TuplePermission:
+		copy(perm.Elements, children)
+	}
+}
@@ -0,0 +1,95 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"testing"
+)
+
+var testcasesEqual = []struct {
+	A, B  string
+	equal bool
+}{
+	{"om", "om", true},
+	{"om", "ov", false},
+	{"om * om", "om * om", true},
+	{"om * om", "om * ov", false},
+	{"om * om", "om chan om", false},
+	{"A = om * A", "A = om * A", true},
+	{"A = om * A", "A = om * om * A", true},
+	{"A = om * A", "om * A = om * A", true},
+	{"A = om * A", "A = om * ov * A", false},
+	{"A = om * A", "om * om * om", false},
+	{"A = om struct {om * A; ov}", "A = om struct {om * om struct {om * A; ov}; ov}", true},
+	{"A = om struct {om * A; ov}", "A = om struct {om * om struct {om * A; om}; ov}", false},
+	{"om func foo(om) ov", "om func foo(om) ov", true},
+	{"om func foo(om) ov", "om func bar(om) ov", false},
+	{"om (om) func ()", "om func (om)", false},
+	{"om func (om, om)", "om func (om) om", false},
+	{"om map[om] ov", "om map[om] ov", true},
+	{"om map[om] ov", "om map[ov] om", false},
+	{"om interface {om func a()}", "om interface {om func a()}", true},
+	{"om struct {om; ov}", "om struct {om}", false},
+	{"om struct {a om; b ov}", "om struct {a om; b ov}", true},
+	{"om struct {a om; b ov}", "om struct {a om; c ov}", false},
+	{"om struct {a om; b ov}", "om struct {om; ov}", false},
+	{"om func (buf om) (n ov)", "om func (buf om) (n ov)", true},
+	{"om func (buf om) (n ov)", "om func (data om) (n ov)", false},
+	{"om func (buf om) (n ov)", "om func (buf om) (err ov)", false},
+	{"om (r om) func ()", "om (s om) func ()", false},
+	{"_", "_", true},
+	{"_", "om", false},
+}
+
+func TestEqual(t *testing.T) {
+	for _, test := range testcasesEqual {
+		test := test
+		t.Run(test.A+" == "+test.B, func(t *testing.T) {
+			A, err := NewParser(test.A).Parse()
+			if err != nil {
+				t.Fatalf("Cannot parse %s: %s", test.A, err)
+			}
+			B, err := NewParser(test.B).Parse()
+			if err != nil {
+				t.Fatalf("Cannot parse %s: %s", test.B, err)
+			}
+			if Equal(A, B) != test.equal || Equal(B, A) != test.equal {
+				t.Errorf("Expected Equal() to be %v", test.equal)
+			}
+			minA, minB := Minimize(A), Minimize(B)
+			if !Equal(A, minA) || !Equal(B, minB) {
+				t.Errorf("Minimized permissions %s, %s are not equal to the originals", minA, minB)
+			}
+			if (minA.(interface{ String() string }).String() == minB.(interface{ String() string }).String()) != test.equal {
+				t.Errorf("Expected minimized forms %s and %s to be the same: %v", minA, minB, test.equal)
+			}
+		})
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	perm, _ := NewParser("A = om * om * om * A").Parse()
+	min := Minimize(perm).(*PointerPermission)
+	if min.Target != min {
+		t.Errorf("Expected a single pointer node, received %#v", min)
+	}
+
+	perm, _ = NewParser("om struct {om * ov; om * ov; om func (om * ov) om * ov}").Parse()
+	strct := Minimize(perm).(*StructPermission)
+	fn := strct.Fields[2].(*FuncPermission)
+	if strct.Fields[0] != strct.Fields[1] || strct.Fields[0] != fn.Params[0] || strct.Fields[0] != fn.Results[0] {
+		t.Errorf("Expected equal fields to be shared, received %v", strct)
+	}
+
+	if Minimize(nil) != nil || Minimize(Mutable) != Mutable {
+		t.Errorf("Minimizing leaves should not change them")
+	}
+	tuple := &TuplePermission{BasePermission: Mutable, Elements: []Permission{&PointerPermission{BasePermission: Mutable, Target: nil}}}
+	if min := Minimize(tuple); !Equal(min, tuple) {
+		t.Errorf("Minimized %v to %v", tuple, min)
+	}
+	if Equal(tuple, nil) || Equal(nil, tuple) {
+		t.Errorf("nil is equal to %v", tuple)
+	}
+}
@@ -0,0 +1,260 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import "fmt"
+
+// This file explains why a permission is not assignable to another one, by
+// following the checks in assignable.go down to the first component that
+// does not fit.
+
+// Mismatch describes the first component of a permission that cannot be
+// assigned to the corresponding component of another permission.
+type Mismatch struct {
+	Path   string         // Path to the component, like ".Fields[3].Target"; empty for the value itself
+	From   BasePermission // Base permission of the component in the source
+	To     BasePermission // Base permission of the component in the target
+	Reason string         // The rule that failed, like "ownership" or "linearity"
+}
+
+// Error formats the mismatch, so it can be used as an error.
+func (m *Mismatch) Error() string {
+	path := m.Path
+	if path == "" {
+		path = "value"
+	}
+	return fmt.Sprintf("%s: %s is not assignable to %s: %s", path, m.From, m.To, m.Reason)
+}
+
+// ExplainMove explains why A is not movable to B, see MovableTo(). It
+// returns nil if A is movable to B.
+func ExplainMove(A, B Permission) *Mismatch {
+	return explainAssignable(A, B, newAssignableState(assignMove))
+}
+
+// ExplainRefcopy explains why A is not refcopyable to B, see RefcopyableTo().
+// It returns nil if A is refcopyable to B.
+func ExplainRefcopy(A, B Permission) *Mismatch {
+	return explainAssignable(A, B, newAssignableState(assignReference))
+}
+
+// ExplainCopy explains why A is not copyable to B, see CopyableTo(). It
+// returns nil if A is copyable to B.
+func ExplainCopy(A, B Permission) *Mismatch {
+	return explainAssignable(A, B, newAssignableState(assignCopy))
+}
+
+func explainAssignable(A, B Permission, state assignableState) *Mismatch {
+	if assignableTo(A, B, state) {
+		return nil
+	}
+	return explain(A, B, state, "", make(map[assignableStateKey]bool))
+}
+
+// assignableChild is a pair of components that have to be assignable for
+// a permission to be assignable, along with the path to them.
+type assignableChild struct {
+	path  string
+	A, B  Permission
+	state assignableState
+}
+
+// explain finds the reason why A is not assignable to B. Components that are
+// already being explained are skipped, as cycles cannot be the reason.
+func explain(A, B Permission, state assignableState, path string, active map[assignableStateKey]bool) *Mismatch {
+	key := assignableStateKey{A, B, state.mode}
+	active[key] = true
+	defer delete(active, key)
+
+	children, reason := assignableChildren(A, B, state)
+	if reason != "" {
+		return &Mismatch{path, baseOf(A), baseOf(B), reason}
+	}
+	for _, child := range children {
+		if active[assignableStateKey{child.A, child.B, child.state.mode}] {
+			continue
+		}
+		if !assignableTo(child.A, child.B, child.state) {
+			return explain(child.A, child.B, child.state, path+child.path, active)
+		}
+	}
+	return &Mismatch{path, baseOf(A), baseOf(B), "unknown reason"}
+}
+
+// baseOf returns the base permission of perm, or None for the wildcard.
+func baseOf(perm Permission) BasePermission {
+	if _, ok := perm.(*WildcardPermission); ok {
+		return None
+	}
+	return perm.GetBasePermission()
+}
+
+// assignableChildren returns the components that have to be assignable for
+// A to be assignable to B, like the isAssignableTo() methods check them, or
+// the reason why A is not assignable to B itself.
+func assignableChildren(A, B Permission, state assignableState) ([]assignableChild, string) {
+	if _, ok := A.(*NilPermission); ok {
+		return nil, "nil cannot be assigned to " + kindOf(B)
+	}
+	if kindOf(A) != kindOf(B) {
+		return nil, fmt.Sprintf("%s cannot be assigned to %s", kindOf(A), kindOf(B))
+	}
+	switch A := A.(type) {
+	case BasePermission:
+		return nil, explainBase(A, B.(BasePermission), state.mode)
+	case *PointerPermission:
+		B := B.(*PointerPermission)
+		return []assignableChild{
+			{"", A.BasePermission, B.BasePermission, state},
+			{".Target", A.Target, B.Target, copyAsReference(state)},
+		}, ""
+	case *ChanPermission:
+		B := B.(*ChanPermission)
+		state = copyAsReference(state)
+		return []assignableChild{
+			{"", A.BasePermission, B.BasePermission, state},
+			{".ElementPermission", A.ElementPermission, B.ElementPermission, state},
+		}, ""
+	case *ArrayPermission:
+		B := B.(*ArrayPermission)
+		return []assignableChild{
+			{"", A.BasePermission, B.BasePermission, state},
+			{".ElementPermission", A.ElementPermission, B.ElementPermission, state},
+		}, ""
+	case *SlicePermission:
+		B := B.(*SlicePermission)
+		state = copyAsReference(state)
+		return []assignableChild{
+			{"", A.BasePermission, B.BasePermission, state},
+			{".ElementPermission", A.ElementPermission, B.ElementPermission, state},
+		}, ""
+	case *MapPermission:
+		B := B.(*MapPermission)
+		state = copyAsReference(state)
+		return []assignableChild{
+			{"", A.BasePermission, B.BasePermission, state},
+			{".KeyPermission", A.KeyPermission, B.KeyPermission, state},
+			{".ValuePermission", A.ValuePermission, B.ValuePermission, state},
+		}, ""
+	case *StructPermission:
+		B := B.(*StructPermission)
+		children := []assignableChild{{"", A.BasePermission, B.BasePermission, state}}
+		for i := range A.Fields {
+			children = append(children, assignableChild{".Fields" + elementIndex(i, A.FieldNames, B.FieldNames), A.Fields[i], B.Fields[i], state})
+		}
+		return children, ""
+	case *FuncPermission:
+		return funcChildren(A, B.(*FuncPermission), copyAsReference(state))
+	case *InterfacePermission:
+		B := B.(*InterfacePermission)
+		state = copyAsReference(state)
+		children := []assignableChild{{"", A.BasePermission, B.BasePermission, state}}
+		for i, r := range B.Methods {
+			var l *FuncPermission
+			for _, m := range A.Methods {
+				if m.Name == r.Name {
+					l = m
+					break
+				}
+			}
+			if l == nil {
+				return nil, fmt.Sprintf("method %s is missing", r.Name)
+			}
+			children = append(children, assignableChild{fmt.Sprintf(".Methods[%d]", i), l, r, state})
+		}
+		return children, ""
+	case *TuplePermission:
+		B := B.(*TuplePermission)
+		if len(A.Elements) != len(B.Elements) {
+			return nil, fmt.Sprintf("%d elements cannot be assigned to %d elements", len(A.Elements), len(B.Elements))
+		}
+		children := []assignableChild{{"", A.BasePermission, B.BasePermission, state}}
+		for i := range A.Elements {
+			children = append(children, assignableChild{fmt.Sprintf(".Elements[%d]", i), A.Elements[i], B.Elements[i], state})
+		}
+		return children, ""
+	}
+	return nil, kindOf(A) + " cannot be assigned"
+}
+
+// elementIndex renders the index of the i-th field or parameter for a path,
+// like "[1]", or "[1 next]" if one of the permissions names it.
+func elementIndex(i int, names, names2 []string) string {
+	for _, names := range [][]string{names, names2} {
+		if i < len(names) && names[i] != "" {
+			return fmt.Sprintf("[%d %s]", i, names[i])
+		}
+	}
+	return fmt.Sprintf("[%d]", i)
+}
+
+// funcChildren is assignableChildren() for functions. Receivers and
+// parameters are contravariant, so they are compared the other way around.
+func funcChildren(A, B *FuncPermission, state assignableState) ([]assignableChild, string) {
+	if A.BasePermission&Owned == 0 && B.BasePermission&Owned != 0 {
+		return nil, "ownership: an unowned function cannot become owned"
+	}
+	move := assignableState{state.values, assignMove}
+	children := []assignableChild{{"", B.BasePermission &^ Owned, A.BasePermission &^ Owned, state}}
+	for i := range A.Receivers {
+		children = append(children, assignableChild{".Receivers" + elementIndex(i, A.ReceiverNames, B.ReceiverNames), B.Receivers[i], A.Receivers[i], move})
+	}
+	for i := range A.Params {
+		children = append(children, assignableChild{".Params" + elementIndex(i, A.ParamNames, B.ParamNames), B.Params[i], A.Params[i], move})
+	}
+	for i := range A.Results {
+		children = append(children, assignableChild{".Results" + elementIndex(i, A.ResultNames, B.ResultNames), A.Results[i], B.Results[i], move})
+	}
+	return children, ""
+}
+
+// explainBase explains why the base permission perm is not assignable to
+// perm2 in the given mode, see BasePermission.isAssignableTo().
+func explainBase(perm, perm2 BasePermission, mode assignableMode) string {
+	missing := perm2 &^ perm
+	switch {
+	case mode != assignCopy && missing&Owned != 0:
+		return "ownership: an unowned value cannot become owned"
+	case mode != assignCopy && missing&(ExclRead|ExclWrite) != 0:
+		return fmt.Sprintf("exclusive bits: %s is missing", missing&(ExclRead|ExclWrite))
+	case mode != assignCopy && missing != 0:
+		return fmt.Sprintf("permission bits: %s is missing", missing)
+	case mode == assignReference && (perm.isLinear() || perm2.isLinear()):
+		return "linearity: a linear value cannot be referenced"
+	case mode != assignReference && perm&Read == 0:
+		return "readability: the value cannot be read"
+	}
+	return "unknown reason"
+}
+
+// kindOf names the kind of a permission.
+func kindOf(perm Permission) string {
+	switch perm.(type) {
+	case BasePermission:
+		return "base permission"
+	case *PointerPermission:
+		return "pointer"
+	case *ChanPermission:
+		return "channel"
+	case *ArrayPermission:
+		return "array"
+	case *SlicePermission:
+		return "slice"
+	case *MapPermission:
+		return "map"
+	case *StructPermission:
+		return "struct"
+	case *FuncPermission:
+		return "function"
+	case *InterfacePermission:
+		return "interface"
+	case *WildcardPermission:
+		return "wildcard"
+	case *TuplePermission:
+		return "tuple"
+	case *NilPermission:
+		return "nil"
+	}
+	return fmt.Sprintf("%T", perm)
+}
@@ -0,0 +1,101 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestExplain_consistent checks that there is an explanation for every
+// permission that is not assignable, and none for the others.
+func TestExplain_consistent(t *testing.T) {
+	for _, testCase := range testcasesAssignableTo {
+		testCase := testCase
+		t.Run(fmt.Sprint(testCase.from)+"=> "+fmt.Sprint(testCase.to), func(t *testing.T) {
+			p1, _ := MakePermission(testCase.from)
+			p2, _ := MakePermission(testCase.to)
+			if m := ExplainMove(p1, p2); (m == nil) != testCase.assignable {
+				t.Errorf("Unexpected move explanation %v", m)
+			}
+			if m := ExplainRefcopy(p1, p2); (m == nil) != testCase.refcopyable {
+				t.Errorf("Unexpected refcopy explanation %v", m)
+			}
+			if m := ExplainCopy(p1, p2); (m == nil) != testCase.copyable {
+				t.Errorf("Unexpected copy explanation %v", m)
+			}
+		})
+	}
+}
+
+var testcasesExplain = []struct {
+	explain func(A, B Permission) *Mismatch
+	from    string
+	to      string
+	path    string
+	reason  string
+}{
+	{ExplainMove, "m", "om", "", "ownership"},
+	{ExplainMove, "ov", "om", "", "exclusive bits: R"},
+	{ExplainMove, "orR", "orwR", "", "permission bits: w"},
+	{ExplainMove, "on", "or", "", "permission bits: r"},
+	{ExplainMove, "ow", "ow", "", "readability"},
+	{ExplainCopy, "ow", "ow", "", "readability"},
+	{ExplainRefcopy, "om", "om", "", "linearity"},
+	{ExplainMove, "om", "om * om", "", "base permission cannot be assigned to pointer"},
+	{ExplainMove, "_", "om", "", "wildcard cannot be assigned to base permission"},
+	{ExplainMove, "om struct {ov; ov; ov; om * om}", "om struct {ov; ov; ov; om * om}", "", ""},
+	{ExplainMove, "om struct {ov; ov; ov; om * ov}", "om struct {ov; ov; ov; om * om}", ".Fields[3].Target", "exclusive bits"},
+	{ExplainMove, "om struct {ov; ov; ov; om * om func (om)}", "om struct {ov; ov; ov; om * om func (ov)}", ".Fields[3].Target.Params[0]", "exclusive bits"},
+	{ExplainMove, "om func () ov", "om func () om", ".Results[0]", "exclusive bits"},
+	{ExplainMove, "om struct {data ov; next om * ov}", "om struct {ov; om * om}", ".Fields[1 next].Target", "exclusive bits"},
+	{ExplainMove, "om func (buf om)", "om func (ov)", ".Params[0 buf]", "exclusive bits"},
+	{ExplainMove, "m func ()", "om func ()", "", "ownership: an unowned function"},
+	{ExplainMove, "om map[ov] ov", "om map[ov] om", ".ValuePermission", "exclusive bits"},
+	{ExplainMove, "om chan ov", "om chan om", ".ElementPermission", "exclusive bits"},
+	{ExplainMove, "om interface {om func a()}", "om interface {ov func a()}", ".Methods[0]", "exclusive bits"},
+	{ExplainMove, "A = om * A", "om * om * ov", ".Target.Target", "pointer cannot be assigned to base permission"},
+}
+
+func TestExplain(t *testing.T) {
+	for _, test := range testcasesExplain {
+		test := test
+		t.Run(test.from+" => "+test.to, func(t *testing.T) {
+			from, _ := NewParser(test.from).Parse()
+			to, _ := NewParser(test.to).Parse()
+			m := test.explain(from, to)
+			if test.reason == "" {
+				if m != nil {
+					t.Errorf("Unexpected explanation %v", m)
+				}
+				return
+			}
+			if m == nil {
+				t.Fatalf("Expected explanation %s", test.reason)
+			}
+			if m.Path != test.path || !strings.Contains(m.Reason, test.reason) {
+				t.Errorf("Expected %s: %s, received %v", test.path, test.reason, m)
+			}
+			if !strings.HasPrefix(m.Error(), test.path) {
+				t.Errorf("Badly formatted explanation %s", m.Error())
+			}
+		})
+	}
+}
+
+func TestExplain_others(t *testing.T) {
+	tuple := &TuplePermission{BasePermission: Owned | Mutable, Elements: []Permission{Mutable}}
+	m := ExplainMove(tuple, &TuplePermission{BasePermission: Owned | Mutable})
+	if m == nil || m.Reason != "1 elements cannot be assigned to 0 elements" {
+		t.Errorf("Unexpected tuple explanation %v", m)
+	}
+	m = ExplainMove(&NilPermission{}, Mutable)
+	if m == nil || m.Reason != "nil cannot be assigned to base permission" {
+		t.Errorf("Unexpected nil explanation %v", m)
+	}
+	if m := (&Mismatch{"", Mutable, Owned, "ownership"}); m.Error() != "value: m is not assignable to on: ownership" {
+		t.Errorf("Unexpected format %s", m)
+	}
+}
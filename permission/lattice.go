@@ -0,0 +1,98 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import "go/types"
+
+// This file provides queries on the lattice formed by the permissions of
+// a type: Intersect() is the meet of two permissions, and Union() is their
+// join. Functions are contravariant in their receivers and parameters, and
+// merge their own base permissions the other way around as well, so they
+// are flipped here too.
+
+// LessOrEqual checks whether perm is at most goal in the lattice, that is,
+// whether intersecting them yields perm. Permissions that cannot be merged
+// are not ordered.
+func LessOrEqual(perm, goal Permission) bool {
+	meet, err := Intersect(perm, goal)
+	return err == nil && Equal(meet, perm)
+}
+
+// TopFor returns the greatest permission for a type: Intersecting it with
+// another permission of the type yields that permission.
+func TopFor(t types.Type) Permission {
+	return extremeFor(t, true)
+}
+
+// BottomFor returns the least permission for a type: Uniting it with
+// another permission of the type yields that permission.
+func BottomFor(t types.Type) Permission {
+	return extremeFor(t, false)
+}
+
+// BottomOf returns the least permission of the same shape as perm, with all
+// base permissions replaced, like BottomFor() does for types.
+func BottomOf(perm Permission) Permission {
+	return extreme(perm, false, make(map[extremeKey]Permission))
+}
+
+// extremeKey identifies a copy of a node made by extreme().
+type extremeKey struct {
+	perm Permission
+	top  bool
+}
+
+// extremeFor builds the top (or bottom) permission of a type, by copying
+// the permission of the type with all base permissions replaced. A node
+// may be reached in both directions, so there is a copy for each.
+func extremeFor(t types.Type, top bool) Permission {
+	return extreme(NewTypeMapper().NewFromType(t), top, make(map[extremeKey]Permission))
+}
+
+func extreme(perm Permission, top bool, copies map[extremeKey]Permission) Permission {
+	if _, ok := perm.(BasePermission); ok {
+		return extremeBase(top)
+	}
+	key := extremeKey{perm, top}
+	if result, ok := copies[key]; ok {
+		return result
+	}
+	result := shallowCopy(perm)
+	copies[key] = result
+
+	children := childrenOf(perm)
+	flipped := 0
+	switch result := result.(type) {
+	case *PointerPermission:
+		result.BasePermission = extremeBase(top)
+	case *ChanPermission:
+		result.BasePermission = extremeBase(top)
+	case *ArrayPermission:
+		result.BasePermission = extremeBase(top)
+	case *SlicePermission:
+		result.BasePermission = extremeBase(top)
+	case *MapPermission:
+		result.BasePermission = extremeBase(top)
+	case *StructPermission:
+		result.BasePermission = extremeBase(top)
+	case *FuncPermission:
+		result.BasePermission = extremeBase(!top)
+		flipped = len(result.Receivers) + len(result.Params)
+	case *InterfacePermission:
+		result.BasePermission = extremeBase(top)
+	}
+	for i := range children {
+		children[i] = extreme(children[i], top != (i < flipped), copies)
+	}
+	setChildren(result, children)
+	return result
+}
+
+// extremeBase returns the greatest or the least base permission.
+func extremeBase(top bool) BasePermission {
+	if top {
+		return Owned | Mutable
+	}
+	return None
+}
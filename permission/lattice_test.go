@@ -0,0 +1,149 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"fmt"
+	"go/types"
+	"testing"
+)
+
+// latticeCorpus returns permissions of the type described by input: The
+// top and bottom permissions, and the type's permission converted to some
+// base permissions.
+func latticeCorpus(t *testing.T, input string) []Permission {
+	typ, err := Parsed(input)
+	if err != nil || typ == nil {
+		t.Fatalf("Invalid test input %s: %v", input, err)
+	}
+	perm := NewTypeMapper().NewFromType(typ)
+	corpus := []Permission{TopFor(typ), BottomFor(typ), perm}
+	for _, base := range []BasePermission{Owned | Mutable, Mutable, Owned | LinearValue, Value, ReadOnly, None} {
+		corpus = append(corpus, ConvertToBase(perm, base))
+	}
+	return corpus
+}
+
+var testcasesLatticeTypes = []string{
+	"int",
+	"*int",
+	"chan *int",
+	"[5]*int",
+	"[]*int",
+	"map[*int]*int",
+	"struct { x *int; y []int }",
+	"func(x *int) *int",
+	"interface { foo(x *int) *int }",
+	"interface{ foo(x interface{}) }",
+}
+
+func meet(t *testing.T, A, B Permission) Permission {
+	result, err := Intersect(A, B)
+	if err != nil {
+		t.Fatalf("Cannot intersect %v and %v: %s", A, B, err)
+	}
+	return result
+}
+
+func join(t *testing.T, A, B Permission) Permission {
+	result, err := Union(A, B)
+	if err != nil {
+		t.Fatalf("Cannot unite %v and %v: %s", A, B, err)
+	}
+	return result
+}
+
+func TestLattice_laws(t *testing.T) {
+	for _, input := range testcasesLatticeTypes {
+		input := input
+		t.Run(input, func(t *testing.T) {
+			corpus := latticeCorpus(t, input)
+			for _, a := range corpus {
+				for _, b := range corpus {
+					if !Equal(meet(t, a, b), meet(t, b, a)) || !Equal(join(t, a, b), join(t, b, a)) {
+						t.Errorf("Not commutative: %v and %v", a, b)
+					}
+					if !Equal(meet(t, a, join(t, a, b)), a) || !Equal(join(t, a, meet(t, a, b)), a) {
+						t.Errorf("Not absorptive: %v and %v", a, b)
+					}
+					if LessOrEqual(a, b) != Equal(join(t, a, b), b) {
+						t.Errorf("Order of %v and %v differs from union", a, b)
+					}
+					for _, c := range corpus {
+						if !Equal(meet(t, a, meet(t, b, c)), meet(t, meet(t, a, b), c)) {
+							t.Errorf("Intersection not associative: %v, %v, %v", a, b, c)
+						}
+						if !Equal(join(t, a, join(t, b, c)), join(t, join(t, a, b), c)) {
+							t.Errorf("Union not associative: %v, %v, %v", a, b, c)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLattice_extremes(t *testing.T) {
+	for _, input := range testcasesLatticeTypes {
+		input := input
+		t.Run(input, func(t *testing.T) {
+			corpus := latticeCorpus(t, input)
+			top, bottom := corpus[0], corpus[1]
+			for _, perm := range corpus {
+				if !LessOrEqual(perm, top) {
+					t.Errorf("%v is not at most %v", perm, top)
+				}
+				if !LessOrEqual(bottom, perm) {
+					t.Errorf("%v is not at most %v", bottom, perm)
+				}
+			}
+		})
+	}
+}
+
+func TestLattice(t *testing.T) {
+	for _, test := range []struct {
+		input  string
+		top    string
+		bottom string
+	}{
+		{"*int", "om * om", "n * n"},
+		{"func(*int) *int", "n func (n * n) om * om", "om func (om * om) n * n"},
+	} {
+		typ, err := Parsed(test.input)
+		if err != nil {
+			t.Fatalf("Invalid test input %s: %s", test.input, err)
+		}
+		if top := TopFor(typ); fmt.Sprint(top) != test.top {
+			t.Errorf("%s: Expected top %s, received %s", test.input, test.top, top)
+		}
+		if bottom := BottomFor(typ); fmt.Sprint(bottom) != test.bottom {
+			t.Errorf("%s: Expected bottom %s, received %s", test.input, test.bottom, bottom)
+		}
+	}
+
+	if _, ok := TopFor(types.Typ[types.UntypedNil]).(*NilPermission); !ok {
+		t.Errorf("Expected nil permission for untyped nil")
+	}
+
+	for _, test := range []struct {
+		A, B     string
+		expected bool
+	}{
+		{"or", "om", true},
+		{"om", "or", false},
+		{"m", "om", true},
+		{"or * or", "om * om", true},
+		{"om * om", "om * or", false},
+		{"om func (om)", "om func (or)", true},
+		{"om func (or)", "om func (om)", false},
+		{"om * om", "om chan om", false},
+	} {
+		A, _ := NewParser(test.A).Parse()
+		B, _ := NewParser(test.B).Parse()
+		if LessOrEqual(A, B) != test.expected {
+			t.Errorf("LessOrEqual(%s, %s): Expected %v", test.A, test.B, test.expected)
+		}
+	}
+}
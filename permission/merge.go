@@ -5,7 +5,6 @@ package permission
 
 import (
 	"fmt"
-	"reflect"
 )
 
 // mergeError is a bailout error type to use with panic() and recover()
@@ -98,7 +97,7 @@ func mergeRecover(err *error) {
 func ConvertTo(perm Permission, goal Permission) (result Permission, err error) {
 	defer mergeRecover(&err)
 	result = merge(perm, goal, &mergeState{make(map[mergeStateKey]Permission), mergeConversion})
-	if reflect.DeepEqual(result, perm) {
+	if Equal(result, perm) {
 		result = perm
 	}
 	return
@@ -111,7 +110,7 @@ func ConvertTo(perm Permission, goal Permission) (result Permission, err error)
 // types.
 func StrictConvertToBase(perm Permission, goal BasePermission) Permission {
 	result := convertToBase(perm, goal, (*convertToBaseState)(&mergeState{make(map[mergeStateKey]Permission), mergeStrictConversion}))
-	if reflect.DeepEqual(result, perm) {
+	if Equal(result, perm) {
 		result = perm
 	}
 	return result
@@ -121,7 +120,7 @@ func StrictConvertToBase(perm Permission, goal BasePermission) Permission {
 // inner permissions to make things consistent.
 func ConvertToBase(perm Permission, goal BasePermission) Permission {
 	result := convertToBase(perm, goal, (*convertToBaseState)(&mergeState{make(map[mergeStateKey]Permission), mergeConversion}))
-	if reflect.DeepEqual(result, perm) {
+	if Equal(result, perm) {
 		result = perm
 	}
 	return result
@@ -134,7 +133,7 @@ func ConvertToBase(perm Permission, goal BasePermission) Permission {
 func Intersect(perm Permission, goal Permission) (result Permission, err error) {
 	defer mergeRecover(&err)
 	result = merge(perm, goal, &mergeState{make(map[mergeStateKey]Permission), mergeIntersection})
-	if reflect.DeepEqual(result, perm) {
+	if Equal(result, perm) {
 		result = perm
 	}
 	return
@@ -150,7 +149,7 @@ func Intersect(perm Permission, goal Permission) (result Permission, err error)
 func Union(perm Permission, goal Permission) (result Permission, err error) {
 	defer mergeRecover(&err)
 	result = merge(perm, goal, &mergeState{make(map[mergeStateKey]Permission), mergeUnion})
-	if reflect.DeepEqual(result, perm) {
+	if Equal(result, perm) {
 		result = perm
 	}
 	return
@@ -270,12 +269,20 @@ func (p *StructPermission) merge(p2 Permission, state *mergeState) Permission {
 		next := &StructPermission{}
 		state.register(next, p, p2)
 		next.BasePermission = state.mergeBase(p.BasePermission, p2.BasePermission)
+		next.FieldNames = mergeNames(p.FieldNames, p2.FieldNames)
 		next.Fields = make([]Permission, len(p.Fields))
 		if len(p.Fields) != len(p2.Fields) {
 			panic(mergeError(fmt.Errorf("Cannot make %v compatible to %v: Different number of fields: %d vs %d", p, p2, len(p.Fields), len(p2.Fields))))
 		}
+		next.Declared = p.Declared
 		for i := 0; i < len(p.Fields); i++ {
 			next.Fields[i] = merge(p.Fields[i], p2.Fields[i], state)
+			if p.isDeclared(i) && (state.action == mergeConversion || state.action == mergeStrictConversion) {
+				declared := p.Fields[i].GetBasePermission()
+				if added := next.Fields[i].GetBasePermission() &^ declared; added != 0 {
+					panic(mergeError(fmt.Errorf("Cannot make %v compatible to %v: Field %d is declared %v, cannot add %v", p, p2, i, declared, added)))
+				}
+			}
 		}
 		return next
 	case *WildcardPermission:
@@ -290,6 +297,9 @@ func (p *FuncPermission) merge(p2 Permission, state *mergeState) Permission {
 	case *FuncPermission:
 		next := &FuncPermission{}
 		next.Name = p.Name
+		next.ReceiverNames = mergeNames(p.ReceiverNames, p2.ReceiverNames)
+		next.ParamNames = mergeNames(p.ParamNames, p2.ParamNames)
+		next.ResultNames = mergeNames(p.ResultNames, p2.ResultNames)
 		state.register(next, p, p2)
 
 		next.BasePermission = state.contravariant().mergeBase(p.BasePermission, p2.BasePermission)
@@ -328,6 +338,16 @@ func (p *FuncPermission) merge(p2 Permission, state *mergeState) Permission {
 	}
 }
 
+// mergeNames returns the names of fields or parameters of a merged
+// permission: The names of the first permission, if it has any, otherwise
+// the ones of the second one.
+func mergeNames(names, names2 []string) []string {
+	if names != nil {
+		return names
+	}
+	return names2
+}
+
 func (p *InterfacePermission) merge(p2 Permission, state *mergeState) Permission {
 	switch p2 := p2.(type) {
 	case *InterfacePermission:
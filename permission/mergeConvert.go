@@ -103,9 +103,16 @@ func (p *StructPermission) convertToBase(p2 BasePermission, state *convertToBase
 	state.register(next, p, p2)
 
 	next.BasePermission = p.BasePermission.convertToBaseBase(p2)
+	next.FieldNames = p.FieldNames
+	next.Declared = p.Declared
 	next.Fields = make([]Permission, len(p.Fields))
 	for i := 0; i < len(p.Fields); i++ {
-		next.Fields[i] = convertToBase(p.Fields[i], next.BasePermission, state)
+		goal := next.BasePermission
+		// Declared fields keep at most their declared permissions.
+		if p.isDeclared(i) {
+			goal &= p.Fields[i].GetBasePermission()
+		}
+		next.Fields[i] = convertToBase(p.Fields[i], goal, state)
 	}
 
 	return next
@@ -117,6 +124,9 @@ func (p *FuncPermission) convertToBase(p2 BasePermission, state *convertToBaseSt
 
 	next.BasePermission = p.BasePermission.convertToBaseBase(p2)
 	next.Name = p.Name
+	next.ReceiverNames = p.ReceiverNames
+	next.ParamNames = p.ParamNames
+	next.ResultNames = p.ResultNames
 	if p.Receivers != nil {
 		next.Receivers = make([]Permission, len(p.Receivers))
 		for i := 0; i < len(p.Receivers); i++ {
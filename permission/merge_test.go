@@ -144,6 +144,8 @@ var testcasesMerge = []mergeTestCase{
 	{mergeIntersection, "or map[or]or", "om map[om]om", "or map[or]or", ""},
 	{mergeIntersection, "om struct { om }", "or struct { or }", "or struct { or }", ""},
 	{mergeIntersection, "om struct { om }", "or struct { or; or }", nil, "number of fields"},
+	{mergeIntersection, "om struct { om }", "om struct { data om }", "om struct { data om }", ""},
+	{mergeUnion, "om func (om) om", "om func (buf om) (n om)", "om func (buf om) (n om)", ""},
 	{mergeIntersection, "om (om) func(om) om", "or (or) func(or) or", "om (om) func(om) or", ""},
 	{mergeIntersection, "om func(om)", "or func(or)", "om func(om)", ""},
 	{mergeUnion, "om func(om)", "or func(or)", "or func(or)", ""},
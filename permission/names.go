@@ -0,0 +1,169 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"fmt"
+	"go/types"
+)
+
+// ResolveNames matches the names of fields and parameters given in a
+// permission against the Go type the permission is for. Lists of fields
+// and parameters that are given by name are put into the order of the
+// type, so they can be written in any order. The permission is copied, and
+// a list is left alone if its names do not match the ones of the type; the
+// errors describe the mismatches.
+func ResolveNames(perm Permission, typ types.Type) (Permission, []error) {
+	r := nameResolver{copies: make(map[nameResolverKey]Permission)}
+	return r.resolve(perm, typ), r.errors
+}
+
+type nameResolverKey struct {
+	perm Permission
+	typ  types.Type
+}
+
+// nameResolver copies permissions for ResolveNames(), collecting errors.
+type nameResolver struct {
+	copies map[nameResolverKey]Permission
+	errors []error
+}
+
+// resolve copies perm, resolving the names in it against typ, which may
+// be nil if the type is not known.
+func (r *nameResolver) resolve(perm Permission, typ types.Type) Permission {
+	if childrenOf(perm) == nil {
+		return perm
+	}
+	key := nameResolverKey{perm, typ}
+	if result, ok := r.copies[key]; ok {
+		return result
+	}
+	result := shallowCopy(perm)
+	r.copies[key] = result
+
+	children := childrenOf(perm)
+	childTypes := make([]types.Type, len(children))
+	if typ != nil {
+		switch t := typ.Underlying().(type) {
+		case *types.Pointer:
+			childTypes[0] = t.Elem()
+		case *types.Chan:
+			childTypes[0] = t.Elem()
+		case *types.Array:
+			childTypes[0] = t.Elem()
+		case *types.Slice:
+			childTypes[0] = t.Elem()
+		case *types.Map:
+			childTypes[0], childTypes[1] = t.Key(), t.Elem()
+		case *types.Struct:
+			if perm, ok := perm.(*StructPermission); ok {
+				result := result.(*StructPermission)
+				var vars []*types.Var
+				for i := 0; i < t.NumFields(); i++ {
+					vars = append(vars, t.Field(i))
+				}
+				children, result.FieldNames = r.reorder("field", perm.Fields, perm.FieldNames, vars)
+				childTypes = typesOf(vars, len(children))
+			}
+		case *types.Signature:
+			if perm, ok := perm.(*FuncPermission); ok {
+				result := result.(*FuncPermission)
+				var recv []*types.Var
+				if t.Recv() != nil {
+					recv = append(recv, t.Recv())
+				}
+				receivers, receiverNames := r.reorder("receiver", perm.Receivers, perm.ReceiverNames, recv)
+				params, paramNames := r.reorder("parameter", perm.Params, perm.ParamNames, tupleVars(t.Params()))
+				results, resultNames := r.reorder("result", perm.Results, perm.ResultNames, tupleVars(t.Results()))
+				result.ReceiverNames, result.ParamNames, result.ResultNames = receiverNames, paramNames, resultNames
+
+				children = append(append(receivers, params...), results...)
+				childTypes = append(append(typesOf(recv, len(receivers)), typesOf(tupleVars(t.Params()), len(params))...), typesOf(tupleVars(t.Results()), len(results))...)
+			}
+		case *types.Interface:
+			if perm, ok := perm.(*InterfacePermission); ok {
+				for i, method := range perm.Methods {
+					for j := 0; j < t.NumMethods(); j++ {
+						if t.Method(j).Name() == method.Name {
+							childTypes[i] = t.Method(j).Type()
+						}
+					}
+				}
+			}
+		}
+	}
+	for i := range children {
+		children[i] = r.resolve(children[i], childTypes[i])
+	}
+	setChildren(result, children)
+	return result
+}
+
+// reorder puts a list of permissions given by name into the order of the
+// variables of a type. Lists without names, or with names that do not
+// match the variables, are returned as they are.
+func (r *nameResolver) reorder(kind string, perms []Permission, names []string, vars []*types.Var) ([]Permission, []string) {
+	if names == nil {
+		return perms, names
+	}
+	index := make(map[string]int)
+	for i, v := range vars {
+		index[v.Name()] = i
+	}
+	ordered := make([]Permission, len(vars))
+	given := make([]bool, len(vars))
+	errors := len(r.errors)
+	for i, name := range names {
+		j, ok := index[name]
+		switch {
+		case name == "":
+			r.errors = append(r.errors, fmt.Errorf("Missing name for %s %d", kind, i))
+		case !ok || name == "_":
+			r.errors = append(r.errors, fmt.Errorf("No %s named %s", kind, name))
+		case given[j]:
+			r.errors = append(r.errors, fmt.Errorf("Permission for %s %s given twice", kind, name))
+		default:
+			ordered[j] = perms[i]
+			given[j] = true
+		}
+	}
+	// Only report missing names if the given ones are fine.
+	if errors == len(r.errors) {
+		for j, v := range vars {
+			if !given[j] {
+				r.errors = append(r.errors, fmt.Errorf("Missing permission for %s %s", kind, v.Name()))
+			}
+		}
+	}
+	if errors != len(r.errors) {
+		return perms, names
+	}
+	orderedNames := make([]string, len(vars))
+	for j, v := range vars {
+		orderedNames[j] = v.Name()
+	}
+	return ordered, orderedNames
+}
+
+// tupleVars returns the variables in a tuple.
+func tupleVars(tuple *types.Tuple) []*types.Var {
+	var vars []*types.Var
+	for i := 0; i < tuple.Len(); i++ {
+		vars = append(vars, tuple.At(i))
+	}
+	return vars
+}
+
+// typesOf returns the types of the variables for a list of n permissions,
+// or no types if the numbers do not match.
+func typesOf(vars []*types.Var, n int) []types.Type {
+	result := make([]types.Type, n)
+	if len(vars) == n {
+		for i, v := range vars {
+			result[i] = v.Type()
+		}
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestResolveNames(t *testing.T) {
+	for _, test := range []struct {
+		typ      string
+		perm     string
+		expected string
+		errors   []string
+	}{
+		{"struct { data int; next *int }", "om struct {next om * ov; data ol}", "om struct {data ol; next om * ov}", nil},
+		{"struct { data int; next *int }", "om struct {ol; om * ov}", "om struct {ol; om * ov}", nil},
+		{"*struct { data int; next *int }", "om * om struct {next om * ov; data ol}", "om * om struct {data ol; next om * ov}", nil},
+		{"struct { data int; next *int }", "om struct {next om * ov; ol}", "om struct {next om * ov; ol}", []string{"Missing name for field 1"}},
+		{"struct { data int; next *int }", "om struct {next om * ov; foo ol}", "om struct {next om * ov; foo ol}", []string{"No field named foo"}},
+		{"struct { data int; next *int }", "om struct {data ol; data ol}", "om struct {data ol; data ol}", []string{"Permission for field data given twice"}},
+		{"struct { data int; next *int }", "om struct {data ol}", "om struct {data ol}", []string{"Missing permission for field next"}},
+		{"func(a int, b *int) (r int)", "om func (b om * ov, a ol) (r ov)", "om func (a ol, b om * ov) (r ov)", nil},
+		{"func(a int, b *int) (r int)", "om func (c ol, b om * ov) (x ov)", "om func (c ol, b om * ov) (x ov)", []string{"No parameter named c", "No result named x"}},
+		{"interface { m(a int, b int) }", "om interface {om func m(b ov, a ol)}", "om interface {om func m(a ol, b ov)}", nil},
+	} {
+		typ, err := Parsed(test.typ)
+		if err != nil {
+			t.Fatalf("Invalid type %s: %s", test.typ, err)
+		}
+		perm, err := NewParser(test.perm).Parse()
+		if err != nil {
+			t.Fatalf("Invalid permission %s: %s", test.perm, err)
+		}
+		result, errs := ResolveNames(perm, typ)
+		if fmt.Sprint(result) != test.expected {
+			t.Errorf("%s for %s: Expected %s, received %s", test.perm, test.typ, test.expected, result)
+		}
+		if fmt.Sprint(errs) != fmt.Sprint(test.errors) {
+			t.Errorf("%s for %s: Expected errors %v, received %v", test.perm, test.typ, test.errors, errs)
+		}
+	}
+}
+
+func TestResolveNames_cyclic(t *testing.T) {
+	typ, _ := Parsed("struct { data int; next *t }")
+	perm, _ := NewParser("A = om struct {next om * A; data ol}").Parse()
+	result, errs := ResolveNames(perm, typ)
+	if errs != nil || fmt.Sprint(result) != "A = om struct {data ol; next om * A}" {
+		t.Errorf("Unexpected %v, %v", result, errs)
+	}
+	if fmt.Sprint(perm) != "A = om struct {next om * A; data ol}" {
+		t.Errorf("Original permission was modified to %v", perm)
+	}
+}
@@ -5,54 +5,276 @@ package permission
 
 import (
 	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Parser is a parser for the permission syntax.
 //
-// This parser is implemented as a simple recursive parser, it has horrible
-// error reporting, but it works, and has a test suite.
+// This parser is implemented as a simple recursive parser. Errors are
+// reported as *SyntaxError values with the span of the offending input. An
+// error in an element of a list is recovered from at the next ',' or ';',
+// or at the end of the list, so several errors can be reported at once.
 //
-// The parser requires one lookahead token in the scanner.
+// The parser requires two lookahead tokens in the scanner, to tell names of
+// fields and parameters from permissions.
+//
+// Permissions can be given names, which can be referred to afterwards, also
+// inside the named permission itself, to describe cyclic permissions such as
+// "A = om * A". The String() methods of permissions use that syntax.
+// Names given in the input are local to it; names declared for several
+// inputs are kept in a Scope, see NewScopedParser().
 type Parser struct {
-	sc *Scanner
+	sc        *Scanner
+	scope     *Scope                // Names shared with other parsers, or nil
+	names     map[string]Permission // Permissions named so far
+	pending   []string              // Names of the permission being parsed
+	declaring string                // Name ParseDeclaration() puts in scope
+	errors    SyntaxErrors          // Errors recovered from so far
+
+	// Warnings about valid, but questionable input found by Parse().
+	Warnings []Warning
+}
+
+// Warning is a problem in the input of the parser that is not an error,
+// such as a base permission that is not written in its canonical form.
+// Start and End are offsets into the input, like for SyntaxError.
+type Warning struct {
+	Start   int
+	End     int
+	Message string
+	// Replacement for the input between Start and End, if any.
+	Suggestion string
 }
 
 // NewParser returns a new parser for the permission specification language.
 func NewParser(input string) *Parser {
-	return &Parser{NewScanner(input)}
+	return &Parser{sc: NewScanner(input)}
 }
 
-// Parse parses the permission specification language.
+// Scope holds named permissions that are shared between parsers, such as
+// permissions declared at the package level, which may refer to each other.
+type Scope struct {
+	names map[string]Permission
+
+	// Resolve is called for names that are not in the scope yet. It may
+	// parse the declaration of the name in the scope, so declarations can
+	// be parsed on demand, in any order.
+	Resolve func(name string)
+}
+
+// NewScope returns a new, empty scope.
+func NewScope() *Scope {
+	return &Scope{names: make(map[string]Permission)}
+}
+
+// Lookup returns the permission of a name in the scope, resolving it
+// if needed.
+func (s *Scope) Lookup(name string) (Permission, bool) {
+	perm, ok := s.names[name]
+	if !ok && s.Resolve != nil {
+		s.Resolve(name)
+		perm, ok = s.names[name]
+	}
+	return perm, ok
+}
+
+// NewScopedParser returns a new parser that can refer to the names in the
+// scope, and declare new ones using ParseDeclaration().
+func NewScopedParser(input string, scope *Scope) *Parser {
+	return &Parser{sc: NewScanner(input), scope: scope}
+}
+
+// lookup returns the permission of a name given in the input, or in the
+// scope of the parser.
+func (p *Parser) lookup(name string) (Permission, bool) {
+	if perm, ok := p.names[name]; ok {
+		return perm, true
+	}
+	if p.scope != nil {
+		return p.scope.Lookup(name)
+	}
+	return nil, false
+}
+
+// Parse parses the permission specification language. If the input is
+// invalid, the error is a SyntaxErrors list.
 //
 // @syntax main <- inner EOF
-func (p *Parser) Parse() (perm Permission, err error) {
+func (p *Parser) Parse() (Permission, error) {
+	var perm Permission
+	p.recoverError(func() {
+		perm = p.parseInner()
+
+		// Ensure that the inner run is complete
+		p.sc.Expect(TokenEndOfFile)
+	})
+	if len(p.errors) > 0 {
+		return nil, p.errors
+	}
+	return perm, nil
+}
+
+// ParseDeclaration parses the declaration of a named permission, and adds
+// the name to the scope of the parser, which must have one. The name is
+// declared as soon as its permission is created, so other declarations
+// parsed meanwhile, or the declaration itself, can refer to it.
+//
+// @syntax declaration <- NAME '=' inner EOF
+func (p *Parser) ParseDeclaration() (string, Permission, error) {
+	var perm Permission
+	p.recoverError(func() {
+		tok := p.sc.Expect(TokenWord)
+		if !isPermissionName(tok.Value) {
+			panic(tokenError(tok, fmt.Errorf("Expected a permission name, received %s", tok.Value)))
+		}
+		if _, ok := p.scope.names[tok.Value]; ok {
+			panic(tokenError(tok, fmt.Errorf("Permission name %s defined twice", tok.Value)))
+		}
+		p.declaring = tok.Value
+		p.sc.Expect(TokenEqual)
+		p.pending = append(p.pending, tok.Value)
+		perm = p.parseInner()
+		p.bind(perm)
+		p.sc.Expect(TokenEndOfFile)
+	})
+	if len(p.errors) > 0 {
+		// Do not hand out partial permissions.
+		if p.declaring != "" {
+			delete(p.scope.names, p.declaring)
+		}
+		return p.declaring, nil, p.errors
+	}
+	return p.declaring, perm, nil
+}
+
+// NamedPermission is a permission given for a name, such as the name of a
+// parameter, see ParseNamedList().
+type NamedPermission struct {
+	Name       string
+	Start      int // Offset of the name in the input
+	End        int // Offset of the byte after the name
+	Permission Permission
+}
+
+// IsNamedList checks whether the input starts like a list of permissions
+// for names, that is, with a word followed by a colon.
+func IsNamedList(input string) (ok bool) {
 	defer func() {
 		if r := recover(); r != nil {
-			switch rr := r.(type) {
-			case scannerError:
-				perm = nil
-				err = rr
-			default:
-				panic(rr)
+			if _, isSyntaxError := r.(*SyntaxError); !isSyntaxError {
+				panic(r)
 			}
+			ok = false
 		}
 	}()
-	perm = p.parseInner()
+	sc := NewScanner(input)
+	return sc.Scan().Type == TokenWord && sc.Scan().Type == TokenColon
+}
 
-	// Ensure that the inner run is complete
-	p.sc.Expect(TokenEndOfFile)
-	return perm, nil
+// ParseNamedList parses a list of permissions for names, like
+// "buf: om, n: v". Errors in one element are recovered from like in
+// lists of fields.
+//
+// @syntax namedList <- NAME ':' inner (',' NAME ':' inner)* EOF
+func (p *Parser) ParseNamedList() ([]NamedPermission, error) {
+	var list []NamedPermission
+	p.recoverError(func() {
+		p.parseFieldList(TokenComma, TokenEndOfFile, false, func() (string, Permission) {
+			name := p.sc.Expect(TokenWord)
+			p.sc.Expect(TokenColon)
+			perm := p.parseInner()
+			list = append(list, NamedPermission{name.Value, name.Start, name.End, perm})
+			return name.Value, perm
+		})
+		p.sc.Expect(TokenEndOfFile)
+	})
+	if len(p.errors) > 0 {
+		return nil, p.errors
+	}
+	return list, nil
+}
+
+// recoverError runs parse, and records a syntax error it panics with,
+// unless an error was recorded at the same place already, as happens when
+// unwinding from an unexpected end of file. It returns false if there was
+// an error.
+func (p *Parser) recoverError(parse func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, isSyntaxError := r.(*SyntaxError)
+			if !isSyntaxError {
+				panic(r)
+			}
+			if n := len(p.errors); n == 0 || p.errors[n-1].Start != err.Start {
+				p.errors = append(p.errors, err)
+			}
+			p.pending = nil
+			ok = false
+		}
+	}()
+	parse()
+	return true
+}
+
+// skipTo skips tokens until the next sep or end token outside of any
+// parens, brackets, or braces opened while skipping, or until the end of
+// the input. Unknown characters are skipped as well.
+func (p *Parser) skipTo(sep, end TokenType) {
+	depth := 0
+	for {
+		var tok Token
+		if !p.recoverQuietly(func() { tok = p.sc.Peek() }) {
+			continue
+		}
+		switch tok.Type {
+		case TokenEndOfFile:
+			return
+		case sep, end:
+			if depth == 0 {
+				return
+			}
+		}
+		switch tok.Type {
+		case TokenParenLeft, TokenBracketLeft, TokenBraceLeft:
+			depth++
+		case TokenParenRight, TokenBracketRight, TokenBraceRight:
+			if depth > 0 {
+				depth--
+			}
+		}
+		p.sc.Scan()
+	}
+}
+
+// recoverQuietly is like recoverError, but ignores the error.
+func (p *Parser) recoverQuietly(parse func()) bool {
+	errors := p.errors
+	defer func() { p.errors = errors }()
+	return p.recoverError(parse)
 }
 
 // parseInner parses a permission spec. The permission spec may contain
 // arbitrary garbage at the end, use Parse() to make sure that does not
 // happen
 //
-// @syntax inner <- '_' | [[basePermission] [func | map | chan | pointer | sliceOrArray] | basePermission]
+// @syntax inner <- '_' | NAME ['=' inner] | [[basePermission] [func | map | chan | pointer | sliceOrArray] | basePermission]
 func (p *Parser) parseInner() Permission {
 	if _, ok := p.sc.Accept(TokenWildcard); ok {
 		return &WildcardPermission{}
 	}
+	if tok := p.sc.Peek(); tok.Type == TokenWord && isPermissionName(tok.Value) {
+		p.sc.Scan()
+		if _, ok := p.sc.Accept(TokenEqual); ok {
+			return p.parseBinding(tok)
+		}
+		perm, ok := p.lookup(tok.Value)
+		if !ok {
+			panic(tokenError(tok, fmt.Errorf("Unknown permission name %s", tok.Value)))
+		}
+		return perm
+	}
 	basePerm := Owned | Mutable
 	haveBase := false
 	if p.sc.Peek().Type == TokenWord {
@@ -85,12 +307,59 @@ func (p *Parser) parseInner() Permission {
 	}
 }
 
+// isPermissionName checks whether a word is the name of a permission rather
+// than a base permission. Names start with an upper case letter, and are not
+// made of base permission letters only, like "R" or "RW" are.
+func isPermissionName(word string) bool {
+	first, _ := utf8.DecodeRuneInString(word)
+	return unicode.IsUpper(first) && !isBasePermissionWord(word)
+}
+
+// parseBinding parses the permission named by the name token. Composite
+// permissions are named as soon as they are created, so they can refer to
+// themselves.
+//
+// @syntax binding <- NAME '=' inner
+func (p *Parser) parseBinding(name Token) Permission {
+	if _, ok := p.lookup(name.Value); ok {
+		panic(tokenError(name, fmt.Errorf("Permission name %s defined twice", name.Value)))
+	}
+	for _, pending := range p.pending {
+		if pending == name.Value {
+			panic(tokenError(name, fmt.Errorf("Permission name %s defined twice", name.Value)))
+		}
+	}
+	p.pending = append(p.pending, name.Value)
+	perm := p.parseInner()
+	// A base permission, wildcard, or another name.
+	p.bind(perm)
+	return perm
+}
+
+// bind gives the pending names to perm.
+func (p *Parser) bind(perm Permission) {
+	if len(p.pending) == 0 {
+		return
+	}
+	if p.names == nil {
+		p.names = make(map[string]Permission)
+	}
+	for _, name := range p.pending {
+		if name == p.declaring {
+			p.scope.names[name] = perm
+		} else {
+			p.names[name] = perm
+		}
+	}
+	p.pending = nil
+}
+
 // @syntax basePermission ('o'|'r'|'w'|'R'|'W'|'m'|'l'|'v'|'a'|'n')+
 func (p *Parser) parseBasePermission() BasePermission {
 	var perm BasePermission
 	tok := p.sc.Expect(TokenWord)
 
-	for _, c := range tok.Value {
+	for i, c := range tok.Value {
 		switch c {
 		case 'o':
 			perm |= Owned
@@ -113,68 +382,170 @@ func (p *Parser) parseBasePermission() BasePermission {
 		case 'n':
 			perm |= None
 		default:
-			panic(p.sc.wrapError(fmt.Errorf("Unknown permission bit or type: %c", c)))
+			bit := Token{Start: tok.Start + i, End: tok.Start + i + utf8.RuneLen(c)}
+			panic(tokenError(bit, fmt.Errorf("Unknown permission bit or type: %c", c)))
 		}
 	}
 	if perm.String() != tok.Value {
-		fmt.Printf("Warning: Permission %v can be rewritten as %v\n", tok.Value, perm.String())
+		p.Warnings = append(p.Warnings, Warning{
+			Start:      tok.Start,
+			End:        tok.End,
+			Message:    fmt.Sprintf("Permission %s can be rewritten as %s", tok.Value, perm),
+			Suggestion: perm.String(),
+		})
 	}
 	return perm
 }
 
-// @syntax func <- ['(' param List ')'] 'func' '(' [paramList] ')' ( [inner] |  '(' [paramList] ')')
+// @syntax func <- ['(' paramList ')'] 'func' [NAME] '(' [paramList] ')' ( [inner] |  '(' [paramList] ')')
 func (p *Parser) parseFunc(bp BasePermission) Permission {
-	var name string
-	var receiver []Permission
-	var params []Permission
-	var results []Permission
+	perm := &FuncPermission{BasePermission: bp}
+	p.bind(perm)
 
 	// Parse either a "func" token or a receiver and a func token
 	if tok, _ := p.sc.Accept(TokenParenLeft, TokenFunc); tok.Type == TokenParenLeft {
-		receiver = p.parseFieldList(TokenComma)
+		perm.Receivers, perm.ReceiverNames = p.parseParamList(false)
 		p.sc.Expect(TokenParenRight)
 		p.sc.Expect(TokenFunc)
 	}
 
 	// Parse a name
 	if nameTok, ok := p.sc.Accept(TokenWord); ok {
-		name = nameTok.Value
+		perm.Name = nameTok.Value
 	}
 
 	// Pararameters
 	p.sc.Expect(TokenParenLeft)
-	if p.sc.Peek().Type != TokenParenRight {
-		params = p.parseFieldList(TokenComma)
-	}
+	perm.Params, perm.ParamNames = p.parseParamList(true)
 	p.sc.Expect(TokenParenRight)
 
 	// Results
 	if tok, _ := p.sc.Accept(TokenParenLeft); tok.Type == TokenParenLeft {
-		results = p.parseFieldList(TokenComma)
+		perm.Results, perm.ResultNames = p.parseParamList(false)
 		p.sc.Expect(TokenParenRight)
 	} else if tok := p.sc.Peek(); tok.Type == TokenWord {
 		// permission starts with word. We peek()ed first, so we can backtrack.
-		results = []Permission{p.parseInner()}
+		perm.Results = []Permission{p.parseInner()}
 	}
 
-	return &FuncPermission{BasePermission: bp, Name: name, Receivers: receiver, Params: params, Results: results}
+	return perm
 }
 
-// @syntax paramList <- inner (',' inner)*
-// @syntax fieldList <- inner (';' inner)*
-func (p *Parser) parseFieldList(sep TokenType) []Permission {
-	var tok Token
+// parseFieldList parses a list of elements separated by sep, which is
+// followed by an end token. An optional list may be empty, and is nil then.
+// If an element is invalid, the error is recorded, the element is nil, and
+// parsing continues after the next sep.
+//
+// The names of the elements are returned as well, or nil if no element has
+// a name.
+//
+// @syntax paramList <- named (',' named)*
+// @syntax fieldList <- named (';' named)*
+func (p *Parser) parseFieldList(sep, end TokenType, optional bool, parseElement func() (string, Permission)) ([]Permission, []string) {
 	var perms []Permission
+	var names []string
+	named := false
+	for {
+		var perm Permission
+		var name string
+		empty := false
+		p.recoverError(func() {
+			if optional && perms == nil && p.sc.Peek().Type == end {
+				empty = true
+				return
+			}
+			name, perm = parseElement()
+			// The caller reports a missing end token at the end of file.
+			if tok := p.sc.Peek(); tok.Type != sep && tok.Type != end && tok.Type != TokenEndOfFile {
+				p.sc.Expect(sep, end)
+			}
+		})
+		if empty {
+			return nil, nil
+		}
+		perms = append(perms, perm)
+		names = append(names, name)
+		named = named || name != ""
+		p.skipTo(sep, end)
 
-	perm := p.parseInner()
-	perms = append(perms, perm)
+		if _, ok := p.sc.Accept(sep); !ok {
+			if !named {
+				names = nil
+			}
+			return perms, names
+		}
+	}
+}
 
-	for tok = p.sc.Peek(); tok.Type == sep; tok = p.sc.Peek() {
-		p.sc.Scan()
-		perms = append(perms, p.parseInner())
+// parseNamed parses an element of a list of fields or parameters, which
+// may be preceded by the name of the field or parameter. A word is a name
+// if it is followed by a colon, or by something a permission can start
+// with, but does not start a permission itself: "next om * om" and
+// "r: func ()" have a name, "om * om" and "r func ()" have not.
+//
+// @syntax named <- [NAME [':']] inner
+func (p *Parser) parseNamed() (string, Permission) {
+	if isName, _ := p.peekName(); !isName {
+		return "", p.parseInner()
+	}
+	name := p.sc.Scan()
+	p.sc.Accept(TokenColon)
+	return name.Value, p.parseInner()
+}
+
+// peekName checks whether the next word is the name of a field or parameter,
+// see parseNamed. A word that is not a name is ambiguous if it only consists
+// of base permission letters and might have been meant as a name.
+func (p *Parser) peekName() (isName bool, ambiguous bool) {
+	first, ok := p.sc.Accept(TokenWord)
+	if !ok {
+		return false, false
+	}
+	next := p.sc.Peek()
+	p.sc.Unscan(first)
+
+	switch next.Type {
+	case TokenWord, TokenWildcard, TokenColon:
+		return true, false
+	case TokenStar, TokenBracketLeft, TokenChan, TokenMap, TokenFunc, TokenStruct, TokenInterface, TokenParenLeft:
+		if isBasePermissionWord(first.Value) {
+			return false, true
+		}
+		return true, false
+	}
+	return false, false
+}
+
+// parseParamList parses a list of receivers, parameters, or results. Like
+// in Go, either all parameters have names or none, so if some have names,
+// the parser warns about words without one that look like a name, such as
+// "r" in "(buf om, r func ())", and suggests writing "r:" instead.
+func (p *Parser) parseParamList(optional bool) ([]Permission, []string) {
+	var ambiguous []Token
+	perms, names := p.parseFieldList(TokenComma, TokenParenRight, optional, func() (string, Permission) {
+		if _, isAmbiguous := p.peekName(); isAmbiguous {
+			ambiguous = append(ambiguous, p.sc.Peek())
+		}
+		return p.parseNamed()
+	})
+	if names == nil {
+		return perms, names
+	}
+	for _, tok := range ambiguous {
+		p.Warnings = append(p.Warnings, Warning{
+			Start:      tok.Start,
+			End:        tok.End,
+			Message:    fmt.Sprintf("Permission %s is not a name, write %s: to use it as one", tok.Value, tok.Value),
+			Suggestion: tok.Value + ":",
+		})
 	}
+	return perms, names
+}
 
-	return perms
+// isBasePermissionWord checks whether a word only consists of base
+// permission letters.
+func isBasePermissionWord(word string) bool {
+	return strings.Trim(word, "orwRWmlvan") == ""
 }
 
 // @syntax sliceOrArray <- '[' [NUMBER|_] ']' inner
@@ -183,65 +554,84 @@ func (p *Parser) parseSliceOrArray(bp BasePermission) Permission {
 	_, isArray := p.sc.Accept(TokenNumber, TokenWildcard)
 	p.sc.Expect(TokenBracketRight)
 
-	rhs := p.parseInner()
-
 	if isArray {
-		return &ArrayPermission{BasePermission: bp, ElementPermission: rhs}
+		perm := &ArrayPermission{BasePermission: bp}
+		p.bind(perm)
+		perm.ElementPermission = p.parseInner()
+		return perm
 	}
-	return &SlicePermission{BasePermission: bp, ElementPermission: rhs}
+	perm := &SlicePermission{BasePermission: bp}
+	p.bind(perm)
+	perm.ElementPermission = p.parseInner()
+	return perm
 }
 
 // @syntax chan <- 'chan' inner
 func (p *Parser) parseChan(bp BasePermission) Permission {
+	perm := &ChanPermission{BasePermission: bp}
+	p.bind(perm)
 	p.sc.Expect(TokenChan)
-	rhs := p.parseInner()
-	return &ChanPermission{BasePermission: bp, ElementPermission: rhs}
+	perm.ElementPermission = p.parseInner()
+	return perm
 }
 
 // @syntax chan <- 'interface' '{' [fieldList] '}'
 func (p *Parser) parseInterface(bp BasePermission) Permission {
-	var fields []*FuncPermission
+	perm := &InterfacePermission{BasePermission: bp}
+	p.bind(perm)
 	p.sc.Expect(TokenInterface)
 	p.sc.Expect(TokenBraceLeft)
-	if p.sc.Peek().Type != TokenBraceRight {
-		newFields := p.parseFieldList(TokenSemicolon)
-		for _, field := range newFields {
-			field, ok := field.(*FuncPermission)
-			if !ok {
-				panic(p.sc.wrapError(fmt.Errorf("Only methods can be part of interfaces in previous field list")))
-			}
-			fields = append(fields, field)
-		}
+	methods, _ := p.parseFieldList(TokenSemicolon, TokenBraceRight, true, p.parseMethod)
+	for _, method := range methods {
+		method, _ := method.(*FuncPermission)
+		perm.Methods = append(perm.Methods, method)
 	}
 	p.sc.Expect(TokenBraceRight)
-	return &InterfacePermission{BasePermission: bp, Methods: fields}
+	return perm
+}
+
+// parseMethod parses a method of an interface. Methods are named inside
+// their permission, so it never returns a name.
+func (p *Parser) parseMethod() (string, Permission) {
+	start := p.sc.Peek()
+	perm := p.parseInner()
+	if _, ok := perm.(*FuncPermission); !ok {
+		panic(tokenError(start, fmt.Errorf("Only methods can be part of interfaces")))
+	}
+	return "", perm
 }
 
 // @syntax map <- 'map' '[' inner ']' inner
 func (p *Parser) parseMap(bp BasePermission) Permission {
+	perm := &MapPermission{BasePermission: bp}
+	p.bind(perm)
 	p.sc.Expect(TokenMap) // Map keyword
 
 	p.sc.Expect(TokenBracketLeft)
-	key := p.parseInner()
+	perm.KeyPermission = p.parseInner()
 	p.sc.Expect(TokenBracketRight)
 
-	val := p.parseInner()
+	perm.ValuePermission = p.parseInner()
 
-	return &MapPermission{BasePermission: bp, KeyPermission: key, ValuePermission: val}
+	return perm
 }
 
 // @syntax pointer <- '*' inner
 func (p *Parser) parsePointer(bp BasePermission) Permission {
+	perm := &PointerPermission{BasePermission: bp}
+	p.bind(perm)
 	p.sc.Expect(TokenStar)
-	rhs := p.parseInner()
-	return &PointerPermission{BasePermission: bp, Target: rhs}
+	perm.Target = p.parseInner()
+	return perm
 }
 
-// @syntax struct <- 'struct' '{' fieldList '}'
+// @syntax struct <- 'struct' '{' [fieldList] '}'
 func (p *Parser) parseStruct(bp BasePermission) Permission {
+	perm := &StructPermission{BasePermission: bp}
+	p.bind(perm)
 	p.sc.Expect(TokenStruct)
 	p.sc.Expect(TokenBraceLeft)
-	fields := p.parseFieldList(TokenSemicolon)
+	perm.Fields, perm.FieldNames = p.parseFieldList(TokenSemicolon, TokenBraceRight, true, p.parseNamed)
 	p.sc.Expect(TokenBraceRight)
-	return &StructPermission{BasePermission: bp, Fields: fields}
+	return perm
 }
@@ -145,8 +145,8 @@ var testCasesParser = map[string]Permission{
 	"l interface {r func(); w func()}": &InterfacePermission{
 		BasePermission: LinearValue,
 		Methods: []*FuncPermission{
-			&FuncPermission{Read, "", nil, nil, nil},
-			&FuncPermission{Write, "", nil, nil, nil},
+			&FuncPermission{BasePermission: Read},
+			&FuncPermission{BasePermission: Write},
 		},
 	},
 	"m interface {":   nil,
@@ -155,7 +155,6 @@ var testCasesParser = map[string]Permission{
 	"error interface": nil,
 	"interface error": nil,
 	"{}":              nil,
-	"m struct {}":     nil,
 	"m struct":        nil,
 	"m struct {":      nil,
 	"m struct }":      nil,
@@ -179,7 +178,84 @@ var testCasesParser = map[string]Permission{
 			LinearValue,
 		},
 	},
-	"_": &WildcardPermission{},
+	"m struct {}": &StructPermission{
+		BasePermission: Mutable,
+	},
+	"m struct {data om; next om * _}": &StructPermission{
+		BasePermission: Mutable,
+		Fields:         []Permission{Owned | Mutable, &PointerPermission{BasePermission: Owned | Mutable, Target: &WildcardPermission{}}},
+		FieldNames:     []string{"data", "next"},
+	},
+	"m struct {Data om; v; a * v; n v}": &StructPermission{
+		BasePermission: Mutable,
+		Fields:         []Permission{Owned | Mutable, Value, &PointerPermission{BasePermission: Any, Target: Value}, Value},
+		FieldNames:     []string{"Data", "", "", "n"},
+	},
+	"om (r om) func (buf om, n v) (err ol)": &FuncPermission{
+		BasePermission: Owned | Mutable,
+		Receivers:      []Permission{Owned | Mutable},
+		Params:         []Permission{Owned | Mutable, Value},
+		Results:        []Permission{Owned | LinearValue},
+		ReceiverNames:  []string{"r"},
+		ParamNames:     []string{"buf", "n"},
+		ResultNames:    []string{"err"},
+	},
+	"m struct {data2 om; _x v}": &StructPermission{
+		BasePermission: Mutable,
+		Fields:         []Permission{Owned | Mutable, Value},
+		FieldNames:     []string{"data2", "_x"},
+	},
+	"om func (buf2 om, n_bytes v)": &FuncPermission{
+		BasePermission: Owned | Mutable,
+		Params:         []Permission{Owned | Mutable, Value},
+		ParamNames:     []string{"buf2", "n_bytes"},
+	},
+	"m struct {own * om; or chan om}": &StructPermission{
+		BasePermission: Mutable,
+		Fields: []Permission{
+			&PointerPermission{BasePermission: Owned | Write, Target: Owned | Mutable},
+			&ChanPermission{BasePermission: Owned | Read, ElementPermission: Owned | Mutable},
+		},
+	},
+	"m struct {own: om * om; v: v [] om; or: or chan om; r: r func ()}": &StructPermission{
+		BasePermission: Mutable,
+		Fields: []Permission{
+			&PointerPermission{BasePermission: Owned | Mutable, Target: Owned | Mutable},
+			&SlicePermission{BasePermission: Value, ElementPermission: Owned | Mutable},
+			&ChanPermission{BasePermission: Owned | Read, ElementPermission: Owned | Mutable},
+			&FuncPermission{BasePermission: Read},
+		},
+		FieldNames: []string{"own", "v", "or", "r"},
+	},
+	"om func (r: r func (), v v) (or: or chan om)": &FuncPermission{
+		BasePermission: Owned | Mutable,
+		Params:         []Permission{&FuncPermission{BasePermission: Read}, Value},
+		ParamNames:     []string{"r", "v"},
+		Results:        []Permission{&ChanPermission{BasePermission: Owned | Read, ElementPermission: Owned | Mutable}},
+		ResultNames:    []string{"or"},
+	},
+	"m struct {data}":   nil,
+	"m struct {data om": nil,
+	"om func (buf) om":  nil,
+	"om func () buf om": nil,
+	"_":                 &WildcardPermission{},
+	"A = om":            Owned | Mutable,
+	"A = B = om":        Owned | Mutable,
+	"A = om * A": func() Permission {
+		perm := &PointerPermission{BasePermission: Owned | Mutable}
+		perm.Target = perm
+		return perm
+	}(),
+	"m struct {A = om; A}": &StructPermission{
+		BasePermission: Mutable,
+		Fields:         []Permission{Owned | Mutable, Owned | Mutable},
+	},
+	"A":                       nil,
+	"om * A":                  nil,
+	"A = om * A = m":          nil,
+	"m struct {A = m; A = m}": nil,
+	"A = A":                   nil,
+	"A m":                     nil,
 }
 
 func helper() (perm Permission, err error) {
@@ -240,3 +316,156 @@ func TestParserParse_panic(t *testing.T) {
 	var p *Parser
 	p.Parse()
 }
+
+func TestParser_errors(t *testing.T) {
+	type span struct{ start, end int }
+	for _, test := range []struct {
+		input    string
+		expected []span
+		message  string
+	}{
+		{"om * x", []span{{5, 6}}, "At 5-6: Unknown permission bit or type: x"},
+		{"om * om )", []span{{8, 9}}, "At 8-9: Expected end of file, received closing paren"},
+		{"om * B", []span{{5, 6}}, "At 5-6: Unknown permission name B"},
+		{"A = om * A = om", []span{{9, 10}}, "At 9-10: Permission name A defined twice"},
+		{"om struct {x; om; om * y}", []span{{11, 12}, {23, 24}}, ""},
+		{"om struct {om * om om; ox}", []span{{19, 21}, {24, 25}}, "At 19-21: Expected operator ';' or operator '}', received word \"om\"; At 24-25: Unknown permission bit or type: x"},
+		{"om func (x, om, y) (z)", []span{{9, 10}, {16, 17}, {20, 21}}, ""},
+		{"om struct {om struct {om [x] om}; x}", []span{{26, 27}, {34, 35}}, ""},
+		{"om struct {om struct {om", []span{{24, 24}}, "At 24-24: Expected operator '}', received end of file"},
+		{"om interface {om; om func ()}", []span{{14, 16}}, "At 14-16: Only methods can be part of interfaces"},
+		{"om * \xff", []span{{5, 6}}, "At 5-6: Encoding error"},
+		{"om struct {#; ox}", []span{{11, 12}, {15, 16}}, ""},
+	} {
+		perm, err := NewParser(test.input).Parse()
+		errs, ok := err.(SyntaxErrors)
+		if perm != nil || !ok {
+			t.Errorf("%s: Expected syntax errors, received %v, %v", test.input, perm, err)
+			continue
+		}
+		var spans []span
+		for _, err := range errs {
+			spans = append(spans, span{err.Start, err.End})
+		}
+		if !reflect.DeepEqual(spans, test.expected) {
+			t.Errorf("%s: Expected errors at %v, received %v", test.input, test.expected, err)
+		}
+		if test.message != "" && err.Error() != test.message {
+			t.Errorf("%s: Expected message %s, received %s", test.input, test.message, err)
+		}
+	}
+}
+
+func TestParser_warnings(t *testing.T) {
+	p := NewParser("om * orwRW struct {ov; m; vl}")
+	if _, err := p.Parse(); err != nil {
+		t.Fatalf("Cannot parse: %s", err)
+	}
+	expected := []Warning{
+		{5, 10, "Permission orwRW can be rewritten as om", "om"},
+		{26, 28, "Permission vl can be rewritten as l", "l"},
+	}
+	if !reflect.DeepEqual(p.Warnings, expected) {
+		t.Errorf("Expected warnings %v, received %v", expected, p.Warnings)
+	}
+}
+
+func TestParser_ambiguousNames(t *testing.T) {
+	testCases := []struct {
+		input    string
+		warnings []Warning
+	}{
+		{"om func (buf om, r func ())", []Warning{{17, 18, "Permission r is not a name, write r: to use it as one", "r:"}}},
+		{"om func (buf om, r: r func ())", nil},
+		{"om func (r func ())", nil},
+		{"om (r om) func () (err ol, v [] om)", []Warning{{27, 28, "Permission v is not a name, write v: to use it as one", "v:"}}},
+	}
+	for _, test := range testCases {
+		p := NewParser(test.input)
+		if _, err := p.Parse(); err != nil {
+			t.Errorf("%s: Cannot parse: %s", test.input, err)
+		}
+		if !reflect.DeepEqual(p.Warnings, test.warnings) {
+			t.Errorf("%s: Expected warnings %v, received %v", test.input, test.warnings, p.Warnings)
+		}
+	}
+}
+
+func TestParser_scope(t *testing.T) {
+	decls := map[string]string{
+		"Tree":   "Tree = om struct {om [] Forest; v}",
+		"Forest": "Forest = om [] Tree",
+		"Alias":  "Alias = Tree",
+		"Loop":   "Loop = Loop",
+		"Broken": "Broken = om * x",
+	}
+	scope := NewScope()
+	scope.Resolve = func(name string) {
+		if decl, ok := decls[name]; ok {
+			delete(decls, name)
+			NewScopedParser(decl, scope).ParseDeclaration()
+		}
+	}
+
+	perm, err := NewScopedParser("om * Tree", scope).Parse()
+	if err != nil {
+		t.Fatalf("Cannot parse: %s", err)
+	}
+	expected, _ := NewParser("om * A = om struct {om [] om [] A; v}").Parse()
+	if !Equal(perm, expected) {
+		t.Errorf("Expected %v, received %v", expected, perm)
+	}
+	if alias, _ := scope.Lookup("Alias"); alias != perm.(*PointerPermission).Target {
+		t.Errorf("Expected alias to be the same as tree, received %v", alias)
+	}
+
+	for _, input := range []string{"Loop", "Broken", "Unknown", "om struct {Tree = om; Tree}"} {
+		if perm, err := NewScopedParser(input, scope).Parse(); err == nil {
+			t.Errorf("Input %s: Expected error, received %v", input, perm)
+		}
+	}
+	for _, input := range []string{"Tree = om", "om = om", "A = om foo", "A"} {
+		if name, perm, err := NewScopedParser(input, scope).ParseDeclaration(); err == nil {
+			t.Errorf("Input %s: Expected error, received %s = %v", input, name, perm)
+		}
+	}
+	if _, ok := scope.Lookup("A"); ok {
+		t.Errorf("Invalid declaration of A is in scope")
+	}
+}
+
+func TestParser_namedList(t *testing.T) {
+	for input, expected := range map[string]bool{
+		"buf: om":      true,
+		"return:om":    true,
+		"om * om":      false,
+		"om func ()":   false,
+		"# buf: om":    false,
+		"buf : om, n:": true,
+		"buf2: om":     true,
+		"n_bytes: v":   true,
+		"_: om":        false,
+	} {
+		if IsNamedList(input) != expected {
+			t.Errorf("IsNamedList(%q): Expected %v", input, expected)
+		}
+	}
+
+	list, err := NewParser("buf: om * om, n: v, return: ol").ParseNamedList()
+	if err != nil {
+		t.Fatalf("Cannot parse: %s", err)
+	}
+	expected := []NamedPermission{
+		{"buf", 0, 3, &PointerPermission{BasePermission: Owned | Mutable, Target: Owned | Mutable}},
+		{"n", 14, 15, Value},
+		{"return", 20, 26, Owned | LinearValue},
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("Expected %v, received %v", expected, list)
+	}
+
+	_, err = NewParser("buf: ox, n v, return: ol").ParseNamedList()
+	if errs, ok := err.(SyntaxErrors); !ok || len(errs) != 2 || errs[0].Start != 6 || errs[1].Start != 11 {
+		t.Errorf("Expected two errors, received %v", err)
+	}
+}
@@ -65,7 +65,13 @@ func (perm BasePermission) String() string {
 	case ReadOnly:
 		return result + "r"
 	case Any &^ Owned:
-		return "a" // special case: any implies owned.
+		// special case: any implies owned, so "a" would parse back as
+		// owned. Spell out the unowned form to keep the output parsable
+		// to the same permission.
+		if perm&Owned == 0 {
+			return "rw"
+		}
+		return "a"
 	case None:
 		return result + "n"
 	default:
@@ -164,6 +170,11 @@ func (p *MapPermission) GetBasePermission() BasePermission {
 type StructPermission struct {
 	BasePermission BasePermission // Permission of the struct itself
 	Fields         []Permission   // Permissions of the fields, in order
+	FieldNames     []string       // Names of the fields, if given
+	// Declared marks the fields whose permissions were declared on the
+	// fields themselves. Conversions may take permissions away from them,
+	// but not add any. Nil if no field is declared.
+	Declared []bool
 }
 
 // GetBasePermission gets the base permission
@@ -171,6 +182,12 @@ func (p *StructPermission) GetBasePermission() BasePermission {
 	return p.BasePermission
 }
 
+// isDeclared checks whether the permission of the i-th field was declared
+// on the field.
+func (p *StructPermission) isDeclared(i int) bool {
+	return p.Declared != nil && p.Declared[i]
+}
+
 // FuncPermission describes permissions of functions
 type FuncPermission struct {
 	BasePermission BasePermission // Permission of the function itself
@@ -178,6 +195,9 @@ type FuncPermission struct {
 	Receivers      []Permission   // Permissions of the receiver
 	Params         []Permission   // Permissions of the parameters
 	Results        []Permission   // Permissions of results
+	ReceiverNames  []string       // Names of the receivers, if given
+	ParamNames     []string       // Names of the parameters, if given
+	ResultNames    []string       // Names of the results, if given
 }
 
 // GetBasePermission gets the base permission
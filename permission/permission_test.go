@@ -29,6 +29,7 @@ var testcasesPermissionString = []struct {
 	{Write | ExclWrite, "wW"},
 	{Write | ExclRead, "wR"},
 	{Read | ExclRead, "rR"},
+	{Read | Write, "rw"},
 }
 
 func TestPermissionString(t *testing.T) {
@@ -6,6 +6,7 @@ package permission
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -20,7 +21,7 @@ const (
 	TokenParenLeft                     // Opening parenthesis.
 	TokenParenRight                    // Closing parenthesis.
 	TokenComma                         // A Comma
-	TokenWord                          // A word (string of letters)
+	TokenWord                          // A word (a Go identifier)
 	TokenFunc                          // The word "func"
 	TokenInterface                     // The word "interface"
 	TokenMap                           // The word "map"
@@ -35,6 +36,8 @@ const (
 	TokenBraceRight                    // The character '}'
 	TokenSemicolon                     // The character ';'
 	TokenWildcard                      // The character '_'
+	TokenEqual                         // The character '='
+	TokenColon                         // The character ':'
 )
 
 var tokenTypeString = map[TokenType]string{
@@ -57,6 +60,8 @@ var tokenTypeString = map[TokenType]string{
 	TokenBraceRight:   "operator '}'",
 	TokenSemicolon:    "operator ';'",
 	TokenWildcard:     "operator '_'",
+	TokenEqual:        "operator '='",
+	TokenColon:        "operator ':'",
 }
 
 func (typ TokenType) String() string {
@@ -68,10 +73,13 @@ func (typ TokenType) String() string {
 	}
 }
 
-// Token has a type and a value
+// Token has a type and a value, and the offsets of its first byte and of
+// the byte after it in the input.
 type Token struct {
 	Type  TokenType
 	Value string
+	Start int
+	End   int
 }
 
 func (tok Token) String() string {
@@ -80,23 +88,46 @@ func (tok Token) String() string {
 
 // Scanner scans input for tokens used in the permission description language.
 //
-// It provides a single lookahead token to use.
+// Tokens can be put back with Unscan(), so the scanner can provide as many
+// lookahead tokens as needed.
 type Scanner struct {
-	input     string // Input string
-	offset    int    // Offset in the input string
-	start     int    // Start of the current rune
-	buffer    Token  // A token that was unscanned
-	hasBuffer bool   // Whether buffer contains an unscanned token
+	input  string  // Input string
+	offset int     // Offset in the input string
+	start  int     // Start of the current rune
+	buffer []Token // Tokens that were unscanned, the last one first
 }
 
-// An error in the error.
-type scannerError struct {
-	error
-	offset int
+// describe describes the token for error messages, like 'word "foo"'.
+func (tok Token) describe() string {
+	switch tok.Type {
+	case TokenWord, TokenNumber:
+		return fmt.Sprintf("%s %q", tok.Type, tok.Value)
+	}
+	return tok.Type.String()
+}
+
+// SyntaxError is an error in the input of the scanner or parser. The span
+// of the error is given as byte offsets into the input, so callers can map
+// it to a position in the file the input was taken from.
+type SyntaxError struct {
+	Start int   // Offset of the first byte of the erroneous text
+	End   int   // Offset of the byte after the erroneous text
+	Err   error // The error at that place
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("At %d-%d: %s", err.Start, err.End, err.Err)
 }
 
-func (err scannerError) Error() string {
-	return fmt.Sprintf("At element ending at %d: %s", err.offset, err.error.Error())
+// SyntaxErrors is a list of syntax errors, sorted by their position.
+type SyntaxErrors []*SyntaxError
+
+func (errs SyntaxErrors) Error() string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
 }
 
 // NewScanner creates a new scanner
@@ -107,39 +138,49 @@ func NewScanner(input string) *Scanner {
 // Scan the next token.
 func (sc *Scanner) Scan() Token {
 	// We put a token back, so let's give that out again.
-	if sc.hasBuffer {
-		tok := sc.buffer
-		sc.buffer = Token{}
-		sc.hasBuffer = false
+	if n := len(sc.buffer); n > 0 {
+		tok := sc.buffer[n-1]
+		sc.buffer = sc.buffer[:n-1]
 		return tok
 	}
 	for {
 		switch ch := sc.readRune(); {
 		case ch == 0:
-			return Token{}
+			return Token{Start: sc.offset, End: sc.offset}
 		case ch == '(':
-			return Token{TokenParenLeft, "("}
+			return sc.token(TokenParenLeft, "(")
 		case ch == ')':
-			return Token{TokenParenRight, ")"}
+			return sc.token(TokenParenRight, ")")
 		case ch == '*':
-			return Token{TokenStar, "*"}
+			return sc.token(TokenStar, "*")
 		case ch == '[':
-			return Token{TokenBracketLeft, "["}
+			return sc.token(TokenBracketLeft, "[")
 		case ch == ']':
-			return Token{TokenBracketRight, "]"}
+			return sc.token(TokenBracketRight, "]")
 		case ch == '{':
-			return Token{TokenBraceLeft, "{"}
+			return sc.token(TokenBraceLeft, "{")
 		case ch == '}':
-			return Token{TokenBraceRight, "}"}
+			return sc.token(TokenBraceRight, "}")
 		case ch == ',':
-			return Token{TokenComma, ","}
+			return sc.token(TokenComma, ",")
 		case ch == ';':
-			return Token{TokenSemicolon, ";"}
+			return sc.token(TokenSemicolon, ";")
 		case ch == '_':
-			return Token{TokenWildcard, "_"}
+			// A wildcard, unless it starts a word like "_x".
+			start, end := sc.start, sc.offset
+			if next := sc.readRune(); isIdentifierRune(next) {
+				sc.offset = start
+				return sc.scanWhile(TokenWord, isIdentifierRune)
+			}
+			sc.start, sc.offset = start, end
+			return sc.token(TokenWildcard, "_")
+		case ch == '=':
+			return sc.token(TokenEqual, "=")
+		case ch == ':':
+			return sc.token(TokenColon, ":")
 		case unicode.IsLetter(ch):
 			sc.unreadRune()
-			tok := sc.scanWhile(TokenWord, unicode.IsLetter)
+			tok := sc.scanWhile(TokenWord, isIdentifierRune)
 			assignKeyword(&tok)
 			return tok
 		case unicode.IsDigit(ch):
@@ -152,10 +193,15 @@ func (sc *Scanner) Scan() Token {
 	}
 }
 
-// Unscan makes a token available again for Scan()
+// token creates a token for the rune just read.
+func (sc *Scanner) token(typ TokenType, value string) Token {
+	return Token{typ, value, sc.start, sc.offset}
+}
+
+// Unscan makes a token available again for Scan(). Tokens must be put
+// back in the reverse order they were scanned in.
 func (sc *Scanner) Unscan(tok Token) {
-	sc.buffer = tok
-	sc.hasBuffer = true
+	sc.buffer = append(sc.buffer, tok)
 }
 
 // Peek at the next token.
@@ -182,11 +228,15 @@ func (sc *Scanner) Accept(types ...TokenType) (tok Token, ok bool) {
 	return tok, false
 }
 
-// Expect calls accept and panic()s if Accept fails
+// Expect calls accept and panic()s with a *SyntaxError if Accept fails.
 func (sc *Scanner) Expect(types ...TokenType) Token {
 	tok, ok := sc.Accept(types...)
 	if !ok {
-		panic(sc.wrapError(fmt.Errorf("Expected one of %v, received %v", types, tok)))
+		var expected []string
+		for _, typ := range types {
+			expected = append(expected, typ.String())
+		}
+		panic(tokenError(tok, fmt.Errorf("Expected %s, received %s", strings.Join(expected, " or "), tok.describe())))
 	}
 	return tok
 }
@@ -198,6 +248,9 @@ func (sc *Scanner) readRune() rune {
 	case r == utf8.RuneError && size == 0:
 		return 0
 	case r == utf8.RuneError:
+		// Skip the byte, so scanning can continue after the error.
+		sc.start = sc.offset
+		sc.offset += size
 		panic(sc.wrapError(fmt.Errorf("Encoding error")))
 	default:
 		sc.start = sc.offset
@@ -221,12 +274,23 @@ func (sc *Scanner) scanWhile(typ TokenType, acceptor func(rune) bool) Token {
 		sc.unreadRune()
 	}
 
-	return Token{typ, sc.input[start:sc.offset]}
+	return Token{typ, sc.input[start:sc.offset], start, sc.offset}
 }
 
-// Annotate error with position information
+// isIdentifierRune checks whether a rune can continue a word. Words are Go
+// identifiers, so they can be used as names of fields and parameters.
+func isIdentifierRune(ch rune) bool {
+	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_'
+}
+
+// wrapError annotates an error with the span of the current rune.
 func (sc *Scanner) wrapError(err error) error {
-	return scannerError{err, sc.offset}
+	return &SyntaxError{sc.start, sc.offset, err}
+}
+
+// tokenError annotates an error with the span of a token.
+func tokenError(tok Token, err error) error {
+	return &SyntaxError{tok.Start, tok.End, err}
 }
 
 // assignKeyword looks at the value of a word token and if it is a keyword,
@@ -19,13 +19,49 @@ func TestTokenTypeString(t *testing.T) {
 }
 
 func TestScannerError(t *testing.T) {
-	err := scannerError{error: errors.New("testerror"), offset: 42}
+	err := &SyntaxError{Start: 40, End: 42, Err: errors.New("testerror")}
 	s := err.Error()
 
 	if !strings.Contains(s, "testerror") {
 		t.Errorf("expected %s to contain testerror", s)
 	}
-	if !strings.Contains(s, "42") {
-		t.Errorf("expected %s to contain 42", s)
+	if !strings.Contains(s, "40-42") {
+		t.Errorf("expected %s to contain 40-42", s)
+	}
+	if s := (SyntaxErrors{err, err}).Error(); s != err.Error()+"; "+err.Error() {
+		t.Errorf("unexpected error list %s", s)
+	}
+}
+
+func TestScannerIdentifiers(t *testing.T) {
+	sc := NewScanner("buf2 n_bytes _x _ _")
+	for _, expected := range []Token{
+		{TokenWord, "buf2", 0, 4},
+		{TokenWord, "n_bytes", 5, 12},
+		{TokenWord, "_x", 13, 15},
+		{TokenWildcard, "_", 16, 17},
+		{TokenWildcard, "_", 18, 19},
+		{TokenEndOfFile, "", 19, 19},
+	} {
+		if tok := sc.Scan(); tok != expected {
+			t.Errorf("Expected %v at %d-%d, received %v at %d-%d", expected, expected.Start, expected.End, tok, tok.Start, tok.End)
+		}
+	}
+}
+
+func TestScannerSpans(t *testing.T) {
+	sc := NewScanner(" om *\tfoo[12]")
+	for _, expected := range []Token{
+		{TokenWord, "om", 1, 3},
+		{TokenStar, "*", 4, 5},
+		{TokenWord, "foo", 6, 9},
+		{TokenBracketLeft, "[", 9, 10},
+		{TokenNumber, "12", 10, 12},
+		{TokenBracketRight, "]", 12, 13},
+		{TokenEndOfFile, "", 13, 13},
+	} {
+		if tok := sc.Scan(); tok != expected {
+			t.Errorf("Expected %v at %d-%d, received %v at %d-%d", expected, expected.Start, expected.End, tok, tok.Start, tok.End)
+		}
 	}
 }
@@ -0,0 +1,237 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *PointerPermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *ChanPermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *ArrayPermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *SlicePermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *MapPermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *StructPermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *FuncPermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *InterfacePermission) String() string { return permissionString(p) }
+
+// String renders the permission in the syntax accepted by the parser.
+func (p *WildcardPermission) String() string { return "_" }
+
+// String renders the permission like a parenthesized list of results. There
+// is no syntax for tuples, so this cannot be parsed back.
+func (p *TuplePermission) String() string { return permissionString(p) }
+
+// printer renders permissions in the syntax of the parser. Permissions that
+// are part of a cycle get a name where they are printed first, like in
+// "A = om * A", and are referred to by that name afterwards.
+type printer struct {
+	buf     bytes.Buffer
+	cyclic  map[Permission]bool   // Permissions that need a name
+	visited map[Permission]bool   // Permissions seen by findCycles()
+	active  map[Permission]bool   // Permissions findCycles() is inside of
+	names   map[Permission]string // Names of cyclic permissions printed so far
+}
+
+// permissionString renders a permission, see printer. Equal permissions are
+// rendered the same, as they are minimized first.
+func permissionString(perm Permission) string {
+	perm = Minimize(perm)
+	p := printer{
+		cyclic:  make(map[Permission]bool),
+		visited: make(map[Permission]bool),
+		active:  make(map[Permission]bool),
+		names:   make(map[Permission]string),
+	}
+	p.findCycles(perm)
+	p.print(perm)
+	return p.buf.String()
+}
+
+// findCycles marks all permissions that refer back to themselves.
+func (p *printer) findCycles(perm Permission) {
+	children := childrenOf(perm)
+	if children == nil {
+		return
+	}
+	if p.active[perm] {
+		p.cyclic[perm] = true
+		return
+	}
+	if p.visited[perm] {
+		return
+	}
+	p.visited[perm] = true
+	p.active[perm] = true
+	for _, child := range children {
+		p.findCycles(child)
+	}
+	p.active[perm] = false
+}
+
+// childrenOf returns the permissions a composite permission is made of, or
+// nil if the permission is not a composite one.
+func childrenOf(perm Permission) []Permission {
+	switch perm := perm.(type) {
+	case *PointerPermission:
+		return []Permission{perm.Target}
+	case *ChanPermission:
+		return []Permission{perm.ElementPermission}
+	case *ArrayPermission:
+		return []Permission{perm.ElementPermission}
+	case *SlicePermission:
+		return []Permission{perm.ElementPermission}
+	case *MapPermission:
+		return []Permission{perm.KeyPermission, perm.ValuePermission}
+	case *StructPermission:
+		return append([]Permission{}, perm.Fields...)
+	case *FuncPermission:
+		children := append([]Permission{}, perm.Receivers...)
+		children = append(children, perm.Params...)
+		return append(children, perm.Results...)
+	case *InterfacePermission:
+		children := []Permission{}
+		for _, method := range perm.Methods {
+			children = append(children, method)
+		}
+		return children
+	case *TuplePermission:
+		return append([]Permission{}, perm.Elements...)
+	}
+	return nil
+}
+
+// cycleName returns the k-th name for a cyclic permission. Names start
+// with an upper case letter and cannot be read as base permissions, so
+// "R" and "W" are skipped.
+func cycleName(k int) string {
+	const letters = "ABCDEFGHIJKLMNOPQSTUVXYZ"
+	if k < len(letters) {
+		return letters[k : k+1]
+	}
+	return cycleName(k/len(letters)-1) + letters[k%len(letters):k%len(letters)+1]
+}
+
+// print renders perm into the buffer.
+func (p *printer) print(perm Permission) {
+	if p.cyclic[perm] {
+		if name, ok := p.names[perm]; ok {
+			p.buf.WriteString(name)
+			return
+		}
+		name := cycleName(len(p.names))
+		p.names[perm] = name
+		fmt.Fprintf(&p.buf, "%s = ", name)
+	}
+
+	switch perm := perm.(type) {
+	case nil:
+		p.buf.WriteString("<nil>")
+	case BasePermission:
+		p.buf.WriteString(perm.String())
+	case *PointerPermission:
+		fmt.Fprintf(&p.buf, "%s * ", perm.BasePermission)
+		p.print(perm.Target)
+	case *ChanPermission:
+		fmt.Fprintf(&p.buf, "%s chan ", perm.BasePermission)
+		p.print(perm.ElementPermission)
+	case *ArrayPermission:
+		fmt.Fprintf(&p.buf, "%s [_] ", perm.BasePermission)
+		p.print(perm.ElementPermission)
+	case *SlicePermission:
+		fmt.Fprintf(&p.buf, "%s [] ", perm.BasePermission)
+		p.print(perm.ElementPermission)
+	case *MapPermission:
+		fmt.Fprintf(&p.buf, "%s map[", perm.BasePermission)
+		p.print(perm.KeyPermission)
+		p.buf.WriteString("] ")
+		p.print(perm.ValuePermission)
+	case *StructPermission:
+		fmt.Fprintf(&p.buf, "%s struct {", perm.BasePermission)
+		p.printList("; ", perm.Fields, perm.FieldNames)
+		p.buf.WriteString("}")
+	case *FuncPermission:
+		p.printFunc(perm)
+	case *InterfacePermission:
+		fmt.Fprintf(&p.buf, "%s interface {", perm.BasePermission)
+		for k, method := range perm.Methods {
+			if k > 0 {
+				p.buf.WriteString("; ")
+			}
+			p.print(method)
+		}
+		p.buf.WriteString("}")
+	case *TuplePermission:
+		fmt.Fprintf(&p.buf, "%s (", perm.BasePermission)
+		p.printList(", ", perm.Elements, nil)
+		p.buf.WriteString(")")
+	default:
+		fmt.Fprint(&p.buf, perm)
+	}
+}
+
+// printFunc renders a function permission. A single result is written
+// without parentheses, unless it does not start with a word, or is named.
+func (p *printer) printFunc(perm *FuncPermission) {
+	fmt.Fprintf(&p.buf, "%s ", perm.BasePermission)
+	if len(perm.Receivers) > 0 {
+		p.buf.WriteString("(")
+		p.printList(", ", perm.Receivers, perm.ReceiverNames)
+		p.buf.WriteString(") ")
+	}
+	p.buf.WriteString("func ")
+	if perm.Name != "" {
+		p.buf.WriteString(perm.Name)
+	}
+	p.buf.WriteString("(")
+	p.printList(", ", perm.Params, perm.ParamNames)
+	p.buf.WriteString(")")
+
+	switch {
+	case len(perm.Results) == 0:
+	case len(perm.Results) == 1 && !isWildcardPermission(perm.Results[0]) && perm.ResultNames == nil:
+		p.buf.WriteString(" ")
+		p.print(perm.Results[0])
+	default:
+		p.buf.WriteString(" (")
+		p.printList(", ", perm.Results, perm.ResultNames)
+		p.buf.WriteString(")")
+	}
+}
+
+// isWildcardPermission checks if perm is the wildcard.
+func isWildcardPermission(perm Permission) bool {
+	_, ok := perm.(*WildcardPermission)
+	return ok
+}
+
+// printList renders a list of permissions, separated by sep. Permissions
+// with a name in names are preceded by it.
+func (p *printer) printList(sep string, perms []Permission, names []string) {
+	for k, perm := range perms {
+		if k > 0 {
+			p.buf.WriteString(sep)
+		}
+		if k < len(names) && names[k] != "" {
+			p.buf.WriteString(names[k] + " ")
+		}
+		p.print(perm)
+	}
+}
@@ -0,0 +1,101 @@
+// (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+// Licensed under the 2-Clause BSD license, see LICENSE for more information.
+
+package permission
+
+import (
+	"fmt"
+	"testing"
+)
+
+var testcasesString = []struct {
+	input    string
+	expected string
+}{
+	{"om", "om"},
+	{"_", "_"},
+	{"m * l", "m * l"},
+	{"m chan l", "m chan l"},
+	{"m [1] a", "m [_] a"},
+	{"m [] a", "m [] a"},
+	{"a", "a"},
+	{"rw * a", "rw * a"},
+	{"a struct {rw; a}", "a struct {rw; a}"},
+	{"m map[v]l", "m map[v] l"},
+	{"m struct {v; l}", "m struct {v; l}"},
+	{"m struct {}", "m struct {}"},
+	{"m func foo(v) a", "m func foo(v) a"},
+	{"m func (v, l) (a, r)", "m func (v, l) (a, r)"},
+	{"m func () (_)", "m func () (_)"},
+	{"m (v) func ()", "m (v) func ()"},
+	{"m interface {}", "m interface {}"},
+	{"m interface {m func ()}", "m interface {m func ()}"},
+	{"m interface {m func (); l func bar() v}", "m interface {m func (); l func bar() v}"},
+	{"A = om * A", "A = om * A"},
+	{"om * A = om * A", "A = om * A"},
+	{"A = om * om * A", "A = om * A"},
+	{"om struct {A = om * A; B = om * om * B}", "om struct {A = om * A; A}"},
+	{"A = om struct {om * A; om * A}", "A = om struct {om * A; om * A}"},
+	{"A = om struct {B = om * B; om * A}", "A = om struct {B = om * B; om * A}"},
+	{"A = om func (A) A", "A = om func (A) A"},
+	{"A = om interface {om (A) func ()}", "A = om interface {om (A) func ()}"},
+	{"m struct {data om; next om * _}", "m struct {data om; next om * _}"},
+	{"m struct {data om; v}", "m struct {data om; v}"},
+	{"m (r om) func (buf om, n v) (err om)", "m (r om) func (buf om, n v) (err om)"},
+	{"A = om struct {v; next A}", "A = om struct {v; next A}"},
+	{"m struct {a om * m struct {x om}; b om * m struct {y om}}", "m struct {a om * m struct {x om}; b om * m struct {y om}}"},
+}
+
+func TestPermissionString_roundTrip(t *testing.T) {
+	for _, test := range testcasesString {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			perm, err := NewParser(test.input).Parse()
+			if err != nil {
+				t.Fatalf("Cannot parse: %s", err)
+			}
+			if str := fmt.Sprint(perm); str != test.expected {
+				t.Errorf("Expected %s, received %s", test.expected, str)
+			}
+			again, err := NewParser(fmt.Sprint(perm)).Parse()
+			if err != nil {
+				t.Fatalf("Cannot parse output %s: %s", perm, err)
+			}
+			if !Equal(perm, again) {
+				t.Errorf("Output %s parses to different permission %s", perm, again)
+			}
+		})
+	}
+}
+
+func TestPermissionString_baseRoundTrip(t *testing.T) {
+	for perm := BasePermission(0); perm <= Owned|Mutable; perm++ {
+		parsed, err := NewParser(perm.String()).Parse()
+		if err != nil {
+			t.Errorf("%s (%d) does not parse: %s", perm, perm, err)
+		} else if parsed.GetBasePermission() != perm {
+			t.Errorf("%s (%d) parses as %s (%d)", perm, perm, parsed, parsed.GetBasePermission())
+		}
+	}
+}
+
+func TestPermissionString_shared(t *testing.T) {
+	// A permission that is shared, but not cyclic, is printed in full.
+	shared := &PointerPermission{BasePermission: Owned | Mutable, Target: Mutable}
+	perm := &StructPermission{BasePermission: Mutable, Fields: []Permission{shared, shared}}
+	if perm.String() != "m struct {om * m; om * m}" {
+		t.Errorf("Unexpected %s", perm)
+	}
+}
+
+func TestPermissionString_other(t *testing.T) {
+	tuple := &TuplePermission{BasePermission: Owned | Mutable, Elements: []Permission{Mutable, &NilPermission{}, nil}}
+	if tuple.String() != "om (m, untyped nil, <nil>)" {
+		t.Errorf("Unexpected %s", tuple)
+	}
+	for k, name := range map[int]string{0: "A", 16: "Q", 17: "S", 23: "Z", 24: "AA", 49: "BB"} {
+		if cycleName(k) != name {
+			t.Errorf("Name %d: Expected %s, received %s", k, name, cycleName(k))
+		}
+	}
+}
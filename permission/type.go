@@ -7,25 +7,96 @@ package permission
 import (
 	"fmt"
 	"go/types"
+	"reflect"
 )
 
-const basicPermission = Mutable
-
 // TypeMapper maintains a map from types to permissions, so recursive types
 // and type references can be handled correctly.
-type TypeMapper map[types.Type]Permission
+//
+// The permissions of struct fields can be declared on the fields, either by
+// annotations registered with AnnotateField, or by "lingo" struct tags.
+// These replace the permissions of the field types wherever the struct
+// type is used. Similarly, named types can have default permissions,
+// registered with AnnotateType. All other base permissions are chosen by
+// a default policy.
+type TypeMapper struct {
+	defaults DefaultPolicy
+	types    map[types.Type]Permission
+	fields   map[*types.Var]Permission
+	named    map[*types.TypeName]Permission
+	pending  map[*types.TypeName]bool // Named types being mapped
+	// Errors in the declared permissions of fields, which could not be
+	// parsed or converted to the types of the fields. Such fields get the
+	// permissions of their types instead.
+	Errors []*FieldError
+}
+
+// FieldError is an error in the permission declared for a struct field.
+type FieldError struct {
+	Field *types.Var
+	Err   error
+}
+
+func (err *FieldError) Error() string {
+	return fmt.Sprintf("Cannot use declared permission of field %s: %s", err.Field.Name(), err.Err)
+}
 
 // NewTypeMapper constructs a new type mapper
-func NewTypeMapper() TypeMapper {
-	return make(TypeMapper)
+func NewTypeMapper() *TypeMapper {
+	return NewTypeMapperWithDefaults(MutableDefaults)
 }
 
-// NewFromType constructs a new permission that is as permissive
-// as possible for a given type.
-//
-// TODO ownership
-func (typeMapper TypeMapper) NewFromType(t0 types.Type) (result Permission) {
-	if r, ok := typeMapper[t0]; ok {
+// NewTypeMapperWithDefaults constructs a new type mapper choosing base
+// permissions by the given default policy.
+func NewTypeMapperWithDefaults(defaults DefaultPolicy) *TypeMapper {
+	return &TypeMapper{
+		defaults: defaults,
+		types:    make(map[types.Type]Permission),
+		fields:   make(map[*types.Var]Permission),
+		named:    make(map[*types.TypeName]Permission),
+		pending:  make(map[*types.TypeName]bool),
+	}
+}
+
+// AnnotateType declares the default permission of a named type, which is
+// used for all values of the type. A nil permission means the type has no
+// default permission. Types must be annotated before they are mapped.
+func (typeMapper *TypeMapper) AnnotateType(name *types.TypeName, perm Permission) {
+	typeMapper.named[name] = perm
+}
+
+// AnnotateField declares the permission of a struct field, overriding any
+// "lingo" tag of the field. A nil permission means the field has no
+// declared permission. Fields must be annotated before their struct type
+// is mapped.
+func (typeMapper *TypeMapper) AnnotateField(field *types.Var, perm Permission) {
+	typeMapper.fields[field] = perm
+}
+
+// FieldTag returns the permission in a struct tag of the form lingo:"...".
+func FieldTag(tag string) (string, bool) {
+	return reflect.StructTag(tag).Lookup("lingo")
+}
+
+// NewFromTypeIn constructs the permission of a value of type t used in the
+// context ctx. The default policy chooses its base permission, or, if the
+// type has a declared default permission, whether it is owned.
+func (typeMapper *TypeMapper) NewFromTypeIn(t types.Type, ctx Context) Permission {
+	perm := typeMapper.NewFromType(t)
+	if _, ok := perm.(*NilPermission); ok {
+		return perm
+	}
+	goal := typeMapper.defaults(t, ctx)
+	if named, ok := t.(*types.Named); ok && typeMapper.named[named.Obj()] != nil {
+		goal = perm.GetBasePermission()&^Owned | goal&Owned
+	}
+	return ConvertToBase(perm, goal)
+}
+
+// NewFromType constructs a new permission for a given type, with the base
+// permissions the default policy chooses for fields.
+func (typeMapper *TypeMapper) NewFromType(t0 types.Type) (result Permission) {
+	if r, ok := typeMapper.types[t0]; ok {
 		return r
 	}
 	// Simple type dispatch
@@ -50,7 +121,16 @@ func (typeMapper TypeMapper) NewFromType(t0 types.Type) (result Permission) {
 		if t.Kind() == types.UntypedNil {
 			return &NilPermission{}
 		}
-		return basicPermission
+		return typeMapper.defaults(t, FieldContext)
+	case *types.Named:
+		if decl := typeMapper.named[t.Obj()]; decl != nil && !typeMapper.pending[t.Obj()] {
+			return typeMapper.newFromNamedType(t, decl)
+		}
+		// Fall through to the underlying type.
+		t0 = t.Underlying()
+		if t0 != t {
+			return typeMapper.NewFromType(t0)
+		}
 	default:
 		// Fall through to the underlying type.
 		t0 = t.Underlying()
@@ -61,9 +141,25 @@ func (typeMapper TypeMapper) NewFromType(t0 types.Type) (result Permission) {
 	panic(fmt.Errorf("Cannot create permission for type %#v", t0))
 }
 
-func (typeMapper TypeMapper) newFromChanType(t *types.Chan) Permission {
-	perm := &ChanPermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+// newFromNamedType converts the permission of the underlying type of a named
+// type to its default permission. While the underlying type is mapped, the
+// named type refers to it directly; the conversion then closes the cycle.
+func (typeMapper *TypeMapper) newFromNamedType(t *types.Named, decl Permission) Permission {
+	typeMapper.pending[t.Obj()] = true
+	underlying := typeMapper.NewFromType(t.Underlying())
+	delete(typeMapper.pending, t.Obj())
+
+	perm, err := ConvertTo(underlying, decl)
+	if err != nil {
+		perm = underlying
+	}
+	typeMapper.types[t] = perm
+	return perm
+}
+
+func (typeMapper *TypeMapper) newFromChanType(t *types.Chan) Permission {
+	perm := &ChanPermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	perm.ElementPermission = typeMapper.NewFromType(t.Elem())
 	return perm
 }
@@ -73,45 +169,83 @@ type arrayOrSliceType interface {
 	Elem() types.Type
 }
 
-func (typeMapper TypeMapper) newFromArrayType(t arrayOrSliceType) Permission {
-	perm := &ArrayPermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromArrayType(t arrayOrSliceType) Permission {
+	perm := &ArrayPermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	perm.ElementPermission = typeMapper.NewFromType(t.Elem())
 	return perm
 }
 
-func (typeMapper TypeMapper) newFromSliceType(t arrayOrSliceType) Permission {
-	perm := &SlicePermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromSliceType(t arrayOrSliceType) Permission {
+	perm := &SlicePermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	perm.ElementPermission = typeMapper.NewFromType(t.Elem())
 	return perm
 }
 
-func (typeMapper TypeMapper) newFromMapType(t *types.Map) Permission {
-	perm := &MapPermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromMapType(t *types.Map) Permission {
+	perm := &MapPermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	perm.KeyPermission = typeMapper.NewFromType(t.Key())
 	perm.ValuePermission = typeMapper.NewFromType(t.Elem())
 	return perm
 }
-func (typeMapper TypeMapper) newFromPointerType(t *types.Pointer) Permission {
-	perm := &PointerPermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromPointerType(t *types.Pointer) Permission {
+	perm := &PointerPermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	perm.Target = typeMapper.NewFromType(t.Elem())
 	return perm
 }
-func (typeMapper TypeMapper) newFromStructType(t *types.Struct) Permission {
-	perm := &StructPermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromStructType(t *types.Struct) Permission {
+	perm := &StructPermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
+	decls := make([]Permission, t.NumFields())
 	for i := 0; i < t.NumFields(); i++ {
 		perm.Fields = append(perm.Fields, typeMapper.NewFromType(t.Field(i).Type()))
+		decls[i] = typeMapper.fieldAnnotation(t, i)
+		if decls[i] != nil && perm.Declared == nil {
+			perm.Declared = make([]bool, t.NumFields())
+		}
+	}
+	// Fields are converted to their declared permissions only when all
+	// fields are known, as the field types may refer to the struct.
+	for i, decl := range decls {
+		if decl == nil {
+			continue
+		}
+		perm.Declared[i] = true
+		if field, err := ConvertTo(perm.Fields[i], decl); err == nil {
+			perm.Fields[i] = field
+		} else {
+			perm.Declared[i] = false
+			typeMapper.Errors = append(typeMapper.Errors, &FieldError{t.Field(i), err})
+		}
+	}
+	return perm
+}
+
+// fieldAnnotation returns the declared permission of the i-th field of a
+// struct type, or nil if there is none, or it cannot be parsed. Tags that
+// cannot be parsed are recorded in Errors.
+func (typeMapper *TypeMapper) fieldAnnotation(t *types.Struct, i int) Permission {
+	if perm, ok := typeMapper.fields[t.Field(i)]; ok {
+		return perm
+	}
+	text, ok := FieldTag(t.Tag(i))
+	if !ok {
+		return nil
+	}
+	perm, err := NewParser(text).Parse()
+	if err != nil {
+		typeMapper.Errors = append(typeMapper.Errors, &FieldError{t.Field(i), err})
+		return nil
 	}
 	return perm
 }
 
-func (typeMapper TypeMapper) newFromSignatureType(t *types.Signature) Permission {
-	perm := &FuncPermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromSignatureType(t *types.Signature) Permission {
+	perm := &FuncPermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	if r := t.Recv(); r != nil {
 		perm.Receivers = append(perm.Receivers, typeMapper.NewFromType(r.Type()))
 	}
@@ -124,9 +258,9 @@ func (typeMapper TypeMapper) newFromSignatureType(t *types.Signature) Permission
 	return perm
 }
 
-func (typeMapper TypeMapper) newFromInterfaceType(t *types.Interface) Permission {
-	perm := &InterfacePermission{BasePermission: basicPermission}
-	typeMapper[t] = perm
+func (typeMapper *TypeMapper) newFromInterfaceType(t *types.Interface) Permission {
+	perm := &InterfacePermission{BasePermission: typeMapper.defaults(t, FieldContext)}
+	typeMapper.types[t] = perm
 	for i := 0; i < t.NumMethods(); i++ {
 		methType := t.Method(i)
 		methPerm := typeMapper.NewFromType(methType.Type()).(*FuncPermission)
@@ -3,11 +3,13 @@
 package permission
 
 import (
+	"fmt"
 	"go/ast"
 	goparser "go/parser"
 	"go/token"
 	"go/types"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -88,6 +90,15 @@ var testCases = map[string]Permission{
 		Results: []Permission{Mutable},
 	},
 	"interface { foo(int) t}": newInterfaceWithMethod(),
+	"struct { x int64 `lingo:\"ol\"`; y *int `lingo:\"om * or\"`; z int `lingo:\"o(\"` }": &StructPermission{
+		BasePermission: Mutable,
+		Fields: []Permission{
+			Owned | LinearValue,
+			&PointerPermission{BasePermission: Owned | Mutable, Target: Owned | ReadOnly},
+			Mutable,
+		},
+		Declared: []bool{true, true, false},
+	},
 }
 
 func Parsed(s string) (types.Type, error) {
@@ -144,6 +155,78 @@ func TestNewFromType_invalid(t *testing.T) {
 	NewTypeMapper().NewFromType(typ)
 }
 
+func TestNewFromType_annotatedField(t *testing.T) {
+	typ, err := Parsed("struct { x int `lingo:\"or\"`; y int }")
+	if err != nil {
+		t.Fatalf("Invalid test input: %s", err)
+	}
+	st := typ.Underlying().(*types.Struct)
+	mapper := NewTypeMapper()
+	mapper.AnnotateField(st.Field(0), nil)
+	mapper.AnnotateField(st.Field(1), Owned|LinearValue)
+	perm := mapper.NewFromType(typ)
+	expected := &StructPermission{
+		BasePermission: Mutable,
+		Fields:         []Permission{Mutable, Owned | LinearValue},
+		Declared:       []bool{false, true},
+	}
+	if !reflect.DeepEqual(perm, expected) {
+		t.Errorf("Unexpected permission %v, expected %v", perm, expected)
+	}
+
+	// Use sites may take permissions away from the field, but not add any.
+	if perm, err := ConvertTo(perm, Owned|Value); err != nil || fmt.Sprint(perm) != "ov struct {ov; ov}" {
+		t.Errorf("Unexpected conversion to ov: %v, %v", perm, err)
+	}
+	if perm, err := ConvertTo(perm, Owned|Mutable); err != nil || fmt.Sprint(perm) != "om struct {om; ol}" {
+		t.Errorf("Unexpected conversion to om: %v, %v", perm, err)
+	}
+	goal, _ := NewParser("om struct {om; om}").Parse()
+	if _, err := ConvertTo(perm, goal); err == nil {
+		t.Errorf("Expected an error converting to %v", goal)
+	}
+}
+
+func TestNewFromType_fieldErrors(t *testing.T) {
+	typ, err := Parsed("struct { x int `lingo:\"om * om\"`; y int `lingo:\"o(\"`; z int `lingo:\"or\"` }")
+	if err != nil {
+		t.Fatalf("Invalid test input: %s", err)
+	}
+	st := typ.Underlying().(*types.Struct)
+	mapper := NewTypeMapper()
+	perm := mapper.NewFromType(typ)
+	if fmt.Sprint(perm) != "m struct {m; m; or}" {
+		t.Errorf("Unexpected permission %v", perm)
+	}
+	if len(mapper.Errors) != 2 || mapper.Errors[0].Field != st.Field(1) || mapper.Errors[1].Field != st.Field(0) {
+		t.Fatalf("Expected errors for y and x, received %v", mapper.Errors)
+	}
+	if msg := mapper.Errors[1].Error(); !strings.Contains(msg, "field x") {
+		t.Errorf("Unexpected message %s", msg)
+	}
+}
+
+func TestNewFromType_annotatedType(t *testing.T) {
+	typ, err := Parsed("struct { next *t }")
+	if err != nil {
+		t.Fatalf("Invalid test input: %s", err)
+	}
+	mapper := NewTypeMapper()
+	mapper.AnnotateType(typ.(*types.Named).Obj(), Owned|Value)
+	perm, ok := mapper.NewFromType(typ).(*StructPermission)
+	if !ok || perm.BasePermission != Owned|Value {
+		t.Fatalf("Unexpected permission %v", perm)
+	}
+	next := perm.Fields[0].(*PointerPermission)
+	target := next.Target.(*StructPermission)
+	if next.BasePermission != Owned|Value || target.Fields[0].(*PointerPermission).Target != target {
+		t.Errorf("Expected the default to apply to the recursive reference, received %v", next)
+	}
+	if mapper.NewFromType(typ) != perm {
+		t.Errorf("Expected the permission of the named type to be cached")
+	}
+}
+
 func TestNewFromType_nil(t *testing.T) {
 	x := types.Typ[types.UntypedNil]
 	perm := NewTypeMapper().NewFromType(x)